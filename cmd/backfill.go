@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"homepower/types"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+	_ "time/tzdata" // the image has no zoneinfo for the tz parameter to be looked up in
+)
+
+// openMetricsContentType is served for ?format=openmetrics, which can be backfilled into Prometheus's TSDB with:
+//
+//	promtool tsdb create-blocks-from openmetrics history.om data/
+const openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+type energySample struct {
+	start           time.Time
+	energyWattHours int
+}
+
+// writeEnergyHistoryOpenMetrics writes each bucket of the history as a sample of the energy used in it, stamped with
+// when the bucket started.  Buckets are in the device's local time, which is the location given by the energy-history
+// endpoint's tz parameter, e.g. ?tz=Europe/London, or the exporter's own time zone when there is none; in a container
+// that is normally UTC, which would shift every bucket by the household's offset from it.
+func writeEnergyHistoryOpenMetrics(w io.Writer, labels map[string]string, history *types.EnergyHistory, location *time.Location) error {
+	var hourly, daily, monthly []energySample
+	for _, hour := range history.Hourly {
+		hourly = append(hourly, energySample{time.Date(hour.Year, time.Month(hour.Month), hour.Day, hour.Hour, 0, 0, 0, location), hour.EnergyWattHours})
+	}
+	for _, day := range history.Daily {
+		daily = append(daily, energySample{time.Date(day.Year, time.Month(day.Month), day.Day, 0, 0, 0, 0, location), day.EnergyWattHours})
+	}
+	for _, month := range history.Monthly {
+		monthly = append(monthly, energySample{time.Date(month.Year, time.Month(month.Month), 1, 0, 0, 0, 0, location), month.EnergyWattHours})
+	}
+
+	buffered := bufio.NewWriter(w)
+	formattedLabels := formatOpenMetricsLabels(labels)
+	writeEnergyFamily(buffered, "common_hourly_energy_wh", "Energy used in the hour, as recorded by the device", formattedLabels, hourly)
+	writeEnergyFamily(buffered, "common_daily_energy_wh", "Energy used in the day, as recorded by the device", formattedLabels, daily)
+	writeEnergyFamily(buffered, "common_monthly_energy_wh", "Energy used in the month, as recorded by the device", formattedLabels, monthly)
+	_, _ = buffered.WriteString("# EOF\n")
+	return buffered.Flush()
+}
+
+// writeEnergyFamily writes nothing for an empty family, and otherwise its samples in time order, as OpenMetrics needs
+func writeEnergyFamily(w *bufio.Writer, name string, help string, labels string, samples []energySample) {
+	if len(samples) == 0 {
+		return
+	}
+	slices.SortFunc(samples, func(a, b energySample) int { return a.start.Compare(b.start) })
+	_, _ = fmt.Fprintf(w, "# TYPE %s gauge\n# HELP %s %s\n", name, name, help)
+	for _, sample := range samples {
+		_, _ = fmt.Fprintf(w, "%s%s %d %d\n", name, labels, sample.energyWattHours, sample.start.Unix())
+	}
+}
+
+var openMetricsLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatOpenMetricsLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var pairs []string
+	for _, name := range slices.Sorted(maps.Keys(labels)) {
+		pairs = append(pairs, name+`="`+openMetricsLabelEscaper.Replace(labels[name])+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"homepower/types"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnergyHistoryIsWrittenAsOpenMetricsInTimeOrder(t *testing.T) {
+	history := &types.EnergyHistory{
+		Hourly: []types.HourlyEnergy{{Year: 2024, Month: 8, Day: 9, Hour: 1, EnergyWattHours: 12}, {Year: 2024, Month: 8, Day: 9, Hour: 0, EnergyWattHours: 10}},
+		Daily:  []types.DailyEnergy{{Year: 2024, Month: 8, Day: 9, EnergyWattHours: 22}},
+	}
+	var output bytes.Buffer
+	assert.NoError(t, writeEnergyHistoryOpenMetrics(&output, map[string]string{"dev_name": `Desk "Lamp"`, "room": "Study"}, history, time.UTC))
+	assert.Equal(t, `# TYPE common_hourly_energy_wh gauge
+# HELP common_hourly_energy_wh Energy used in the hour, as recorded by the device
+common_hourly_energy_wh{dev_name="Desk \"Lamp\"",room="Study"} 10 1723161600
+common_hourly_energy_wh{dev_name="Desk \"Lamp\"",room="Study"} 12 1723165200
+# TYPE common_daily_energy_wh gauge
+# HELP common_daily_energy_wh Energy used in the day, as recorded by the device
+common_daily_energy_wh{dev_name="Desk \"Lamp\"",room="Study"} 22 1723161600
+# EOF
+`, output.String())
+}
+
+func TestEnergyHistoryBucketsStartAtMidnightInTheGivenTimeZone(t *testing.T) {
+	history := &types.EnergyHistory{Daily: []types.DailyEnergy{{Year: 2024, Month: 8, Day: 9, EnergyWattHours: 22}}}
+	london, err := time.LoadLocation("Europe/London")
+	assert.NoError(t, err)
+	var output bytes.Buffer
+	assert.NoError(t, writeEnergyHistoryOpenMetrics(&output, map[string]string{"room": "Study"}, history, london))
+	// Midnight in British Summer Time is an hour before midnight UTC
+	assert.Contains(t, output.String(), `common_daily_energy_wh{room="Study"} 22 1723158000`)
+}
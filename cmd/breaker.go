@@ -0,0 +1,71 @@
+package main
+
+import (
+	"time"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (bs breakerState) String() string {
+	switch bs {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+const breakerFailureThreshold = 3
+const maximumBackoff = 5 * time.Minute
+
+// circuitBreaker stops a device that keeps failing from being polled on every tick.  After breakerFailureThreshold
+// failures in a row it opens, and polls are skipped until its backoff has passed, at which point it is half-open and
+// one attempt is let through: success closes it, failure re-opens it with double the backoff, up to maximumBackoff.
+type circuitBreaker struct {
+	initialBackoff time.Duration
+	state          breakerState
+	failures       int
+	backoff        time.Duration
+	retryAt        time.Time
+}
+
+func newCircuitBreaker(pollInterval time.Duration) *circuitBreaker {
+	return &circuitBreaker{initialBackoff: min(2*pollInterval, maximumBackoff)}
+}
+
+// allow reports whether the device should be polled now, moving an open breaker to half-open once its backoff is over
+func (cb *circuitBreaker) allow(now time.Time) bool {
+	if cb.state == breakerOpen && !now.Before(cb.retryAt) {
+		cb.state = breakerHalfOpen
+	}
+	return cb.state != breakerOpen
+}
+
+func (cb *circuitBreaker) recordSuccess() {
+	cb.state = breakerClosed
+	cb.failures = 0
+	cb.backoff = 0
+}
+
+func (cb *circuitBreaker) recordFailure(now time.Time) {
+	cb.failures++
+	switch cb.state {
+	case breakerClosed:
+		if cb.failures < breakerFailureThreshold {
+			return
+		}
+		cb.backoff = cb.initialBackoff
+	case breakerHalfOpen:
+		cb.backoff = min(2*cb.backoff, maximumBackoff)
+	}
+	cb.state = breakerOpen
+	cb.retryAt = now.Add(cb.backoff)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreakerOpensAfterRepeatedFailuresAndBacksOff(t *testing.T) {
+	now := time.Now()
+	breaker := newCircuitBreaker(10 * time.Second)
+
+	for range breakerFailureThreshold - 1 {
+		assert.True(t, breaker.allow(now))
+		breaker.recordFailure(now)
+	}
+	assert.Equal(t, breakerClosed, breaker.state)
+
+	breaker.recordFailure(now)
+	assert.Equal(t, breakerOpen, breaker.state)
+	assert.False(t, breaker.allow(now.Add(19*time.Second)))
+
+	now = now.Add(20 * time.Second)
+	assert.True(t, breaker.allow(now))
+	assert.Equal(t, breakerHalfOpen, breaker.state)
+	breaker.recordFailure(now)
+	assert.Equal(t, 40*time.Second, breaker.backoff)
+	assert.False(t, breaker.allow(now.Add(39*time.Second)))
+
+	for range 10 {
+		now = breaker.retryAt
+		assert.True(t, breaker.allow(now))
+		breaker.recordFailure(now)
+	}
+	assert.Equal(t, maximumBackoff, breaker.backoff)
+
+	assert.True(t, breaker.allow(breaker.retryAt))
+	breaker.recordSuccess()
+	assert.Equal(t, breakerClosed, breaker.state)
+	assert.True(t, breaker.allow(now))
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"homepower/types"
+	"net/http"
+	"time"
+)
+
+const controlTimeout = 5 * time.Second
+
+func (s *supervisor) deviceByIp(ip string) (*runningDevice, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, running := range s.running {
+		if running.cfg.Ip == ip {
+			return running, true
+		}
+	}
+	return nil, false
+}
+
+type switchRequest struct {
+	On *bool `json:"on"`
+}
+
+type lightRequest struct {
+	On                 *bool `json:"on"`
+	Brightness         *int  `json:"brightness"`
+	Hue                *int  `json:"hue"`
+	Saturation         *int  `json:"saturation"`
+	ColourTemperature  *int  `json:"color_temp"`
+	TransitionPeriodMs int   `json:"transition_ms"`
+}
+
+// addDeviceControlHandlers adds POST endpoints that change a device's state and reply with its status, as given by
+// /api/devices, once the change has been made
+func addDeviceControlHandlers(mux *http.ServeMux, devices *supervisor) {
+	mux.HandleFunc("POST /api/devices/{ip}/relay", controlHandler(devices, func(ctx context.Context, dev types.PollableDevice, r *http.Request) error {
+		controller, supported := dev.(types.RelayController)
+		if !supported {
+			return types.ErrNotSupported
+		}
+		var request switchRequest
+		if err := decodeControlRequest(r, &request); err != nil || request.On == nil {
+			return errBadRequest
+		}
+		return controller.SetRelay(ctx, *request.On)
+	}))
+	mux.HandleFunc("POST /api/devices/{ip}/led", controlHandler(devices, func(ctx context.Context, dev types.PollableDevice, r *http.Request) error {
+		controller, supported := dev.(types.LedController)
+		if !supported {
+			return types.ErrNotSupported
+		}
+		var request switchRequest
+		if err := decodeControlRequest(r, &request); err != nil || request.On == nil {
+			return errBadRequest
+		}
+		return controller.SetLed(ctx, *request.On)
+	}))
+	mux.HandleFunc("POST /api/devices/{ip}/light", controlHandler(devices, func(ctx context.Context, dev types.PollableDevice, r *http.Request) error {
+		controller, supported := dev.(types.LightController)
+		if !supported {
+			return types.ErrNotSupported
+		}
+		var request lightRequest
+		if err := decodeControlRequest(r, &request); err != nil || request.TransitionPeriodMs < 0 {
+			return errBadRequest
+		}
+		return controller.SetLightState(ctx, types.LightState{
+			On:                request.On,
+			Brightness:        request.Brightness,
+			Hue:               request.Hue,
+			Saturation:        request.Saturation,
+			ColourTemperature: request.ColourTemperature,
+			TransitionPeriod:  time.Duration(request.TransitionPeriodMs) * time.Millisecond,
+		})
+	}))
+}
+
+var errBadRequest = errors.New("request body is not valid for this endpoint")
+
+// errModelNotDetected is returned for a device given only a driver that has not yet answered to have its model detected
+var errModelNotDetected = errors.New("the device's model has not been detected yet")
+
+func decodeControlRequest(r *http.Request, into any) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(nil, r.Body, 4096))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(into)
+}
+
+func controlHandler(devices *supervisor, control func(ctx context.Context, dev types.PollableDevice, r *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		running, found := devices.deviceByIp(r.PathValue("ip"))
+		if !found {
+			http.Error(w, "no device is configured with that ip", http.StatusNotFound)
+			return
+		}
+		dev := running.pollable()
+		if dev == nil {
+			http.Error(w, errModelNotDetected.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), controlTimeout)
+		defer cancel()
+		if err := control(ctx, dev, r); err != nil {
+			switch {
+			case errors.Is(err, errBadRequest), errors.Is(err, types.ErrInvalidValue):
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			case errors.Is(err, types.ErrNotSupported):
+				http.Error(w, err.Error(), http.StatusNotImplemented)
+			default:
+				http.Error(w, err.Error(), http.StatusBadGateway)
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(running.status.toJson(running.cfg, dev))
+	}
+}
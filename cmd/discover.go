@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"homepower/config"
+	"homepower/device/kasa"
+	"homepower/types"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// discoverDevices broadcasts for Kasa devices and prints a devices block for the manifest, noting which devices the
+// current manifest (if one is given) already has.  It returns the exit code for the process.
+func discoverDevices(args []string) int {
+	flags := flag.NewFlagSet("discover", flag.ContinueOnError)
+	wait := flags.Duration("wait", 3*time.Second, "how long to wait for replies")
+	broadcastAddress := flags.String("broadcast", kasa.DiscoveryBroadcastAddress, "address and port to broadcast to")
+	manifest := flags.String("manifest", os.Getenv(config.DeviceConfigFilepathVariable), "device manifest to compare against")
+	flags.Usage = func() {
+		_, _ = fmt.Fprintln(os.Stderr, "usage: homepower discover [-wait 3s] [-broadcast 255.255.255.255:9999] [-manifest path]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 {
+		return 2
+	}
+
+	var configured []types.DeviceConfig
+	if *manifest != "" {
+		var err error
+		if configured, err = config.ReadDeviceConfig(*manifest); err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *wait)
+	defer cancel()
+	found, err := kasa.Discover(ctx, *broadcastAddress)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	_, _ = fmt.Fprintf(os.Stderr, "found %d kasa device(s)\n", len(found))
+	writeDiscoveredDevices(os.Stdout, found, configured, *manifest != "")
+	return 0
+}
+
+func writeDiscoveredDevices(out io.Writer, found []kasa.DiscoveredDevice, configured []types.DeviceConfig, compare bool) {
+	configuredByIp := make(map[string]types.DeviceConfig, len(configured))
+	for _, cfg := range configured {
+		configuredByIp[cfg.Ip] = cfg
+	}
+
+	_, _ = fmt.Fprintln(out, "devices:")
+	for _, device := range found {
+		lines := []string{
+			"- name: " + strconv.Quote(device.Alias),
+			"  room: \"\"",
+			"  ip: " + strconv.Quote(device.Ip),
+		}
+		model, supported := types.DeviceTypeForReportedModel(device.Model)
+		if supported {
+			lines = append(lines, "  model: "+strconv.Quote(types.ModelNameFor(model)))
+		} else {
+			lines = append(lines, "  model: "+strconv.Quote(device.Model))
+		}
+		lines = append(lines, "  driver: \"kasa\"")
+
+		var note string
+		cfg, alreadyConfigured := configuredByIp[device.Ip]
+		switch {
+		case !supported:
+			note = "model " + device.Model + " is not supported"
+		case alreadyConfigured:
+			note = "already in the manifest as " + strings.TrimSpace(cfg.Room+" "+cfg.Name)
+		case compare:
+			note = "missing from the manifest"
+		}
+		if note != "" {
+			_, _ = fmt.Fprintln(out, "  # "+note)
+		}
+		// Entries that should not be pasted in as they are are commented out
+		prefix := "  "
+		if !supported || alreadyConfigured {
+			prefix = "  # "
+		}
+		for _, line := range lines {
+			_, _ = fmt.Fprintln(out, prefix+line)
+		}
+		_, _ = fmt.Fprintln(out)
+	}
+}
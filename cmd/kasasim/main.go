@@ -0,0 +1,54 @@
+// kasasim serves a simulated Kasa device, so that the exporter can be run and tried out without real devices
+package main
+
+import (
+	"flag"
+	"fmt"
+	"homepower/device/kasa/kasatest"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+func main() {
+	os.Exit(simulate(os.Args[1:]))
+}
+
+func simulate(args []string) int {
+	flags := flag.NewFlagSet("kasasim", flag.ContinueOnError)
+	model := flags.String("model", "HS110", "device to simulate: one of "+strings.Join(kasatest.Models, ", "))
+	address := flags.String("listen", "127.0.0.1:9999", "address and port to listen on")
+	faultName := flags.String("fault", kasatest.NoFault.String(), "fault to inject: none, truncated-header, split-packets or error-code")
+	flags.Usage = func() {
+		_, _ = fmt.Fprintln(os.Stderr, "usage: kasasim [-model HS110] [-listen 127.0.0.1:9999] [-fault none]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 {
+		return 2
+	}
+	fault, err := kasatest.ParseFault(*faultName)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	profile, err := kasatest.LoadProfile(*model)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	server, err := kasatest.Listen(*address, profile)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	server.SetFault(fault)
+	_, _ = fmt.Fprintf(os.Stderr, "simulating a %s on %s with fault %s\n", *model, server.Addr(), fault)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+	_ = server.Close()
+	return 0
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"homepower/config"
 	"homepower/device"
 	"homepower/types"
@@ -11,8 +10,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
-	"strconv"
-	"sync"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -20,105 +18,219 @@ import (
 )
 
 func main() {
-	var configs = config.ReadConfigAndCredentials()
-	registry := prometheus.NewRegistry()
-
-	var sigIntReceived = closeOnSigInt(make(chan bool, 1))
-	var allExited sync.WaitGroup
-	allExited.Add(len(configs.Devices))
-
-	for _, cfg := range configs.Devices {
-		pollableDevice, err := device.Factory(cfg, &configs.TapoCredentials, registry)
-		if err != nil {
-			panic(fmt.Errorf("could not create device driver for %s (%s): %w", cfg.Ip, cfg.Name, err))
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "validate":
+			os.Exit(validateConfig(os.Args[2:]))
+		case "discover":
+			os.Exit(discoverDevices(os.Args[2:]))
 		}
-		scrapeMetrics := registerScrapeMetrics(pollableDevice, registry)
-		go pollDevice(&allExited, sigIntReceived, cfg, pollableDevice, scrapeMetrics)
 	}
 
+	deviceConfigFilepath, credentialFilepath, err := config.ConfigFilepathsFromEnvironment()
+	if err != nil {
+		log.Fatalf("could not find the config: %v", err)
+	}
+	configs, err := config.LoadConfigAndCredentials(deviceConfigFilepath, credentialFilepath)
+	if err != nil {
+		log.Fatalf("could not load the device config: %v", err)
+	}
+	webConfig, err := config.ReadWebConfigFromEnvironment()
+	if err != nil {
+		log.Fatalf("could not load the web config: %v", err)
+	}
+	registry := prometheus.NewRegistry()
+
+	shutdown, triggerShutdown := cancelOnTerminationSignal(context.Background())
+	devices := newSupervisor(shutdown, registry)
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Location", "/metrics")
 		w.WriteHeader(307)
 	})
 	mux.Handle("GET /metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
-	go startHttpServer(9981, mux, sigIntReceived)
+	addDeviceApiHandlers(mux, devices)
+	addDeviceControlHandlers(mux, devices)
+	// Probes come from the kubelet, which cannot be given credentials, so they are served without authentication
+	probes := http.NewServeMux()
+	addStatusHandlers(probes, &devices.ready)
+	probes.Handle("/", requireAuthentication(webConfig, mux))
+	serverStopped := make(chan error, 1)
+	go func() {
+		err := startHttpServer(shutdown, webConfig, probes)
+		if err != nil {
+			log.Printf("http server failed: %v", err)
+			triggerShutdown()
+		}
+		serverStopped <- err
+	}()
+
+	// A device that cannot be started is left out rather than stopping the exporter, as on a reload
+	for _, err := range devices.apply(configs) {
+		log.Printf("%v", err)
+	}
+	go reloadConfigOnChange(shutdown, devices, deviceConfigFilepath, credentialFilepath)
 
-	allExited.Wait()
+	<-shutdown.Done()
+	devices.waitForAll()
+	if err := <-serverStopped; err != nil {
+		os.Exit(1)
+	}
 	os.Exit(0)
 }
 
-func closeOnSigInt(channel chan bool) chan bool {
+func cancelOnTerminationSignal(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
 	var signals = make(chan os.Signal, 1)
-	signal.Notify(signals, os.Interrupt)
-	go func() { <-signals; println("Received SIGINT"); close(channel) }()
-	return channel
-}
-
-func startHttpServer(port int16, mux *http.ServeMux, sigIntReceived chan bool) {
-	server := http.Server{
-		Addr:              ":" + strconv.Itoa(int(port)),
-		Handler:           mux,
-		ReadTimeout:       1500 * time.Millisecond,
-		ReadHeaderTimeout: 500 * time.Millisecond,
-		WriteTimeout:      2000 * time.Second,
-	}
-	println("Listening on port " + strconv.Itoa(int(port)))
-	go func() {
-		<-sigIntReceived
-		println("Received signal to shut down http server")
-		if err := server.Shutdown(context.Background()); err != nil {
-			println(err.Error())
-		}
-	}()
-	log.Println(server.ListenAndServe())
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() { received := <-signals; println("Received " + received.String()); cancel() }()
+	return ctx, cancel
 }
 
-func pollDevice(allExited *sync.WaitGroup, sigIntReceived <-chan bool, cfg types.DeviceConfig, dev types.PollableDevice, scrapeMetrics prometheusScrapeMetrics) {
-	println("Polling", cfg.Room, cfg.Name, "every 10 seconds")
-	defer allExited.Done()
-	ticker := time.NewTicker(10 * time.Second)
+func pollDevice(ctx context.Context, cfg types.DeviceConfig, dev types.PollableDevice, deviceSeries *types.GatedRegisterer, scrapeMetrics prometheusScrapeMetrics, status *pollStatus) {
+	println("Polling", cfg.Room, cfg.Name, "every", cfg.PollInterval.String(), "with up to", cfg.PollJitter.String(), "jitter")
+	ticker := time.NewTicker(cfg.PollInterval)
+	breaker := newCircuitBreaker(cfg.PollInterval)
 	for {
 		select {
-		case <-sigIntReceived:
+		case <-ctx.Done():
 			println("Received should exit signal for", cfg.Room, cfg.Name)
 			ticker.Stop()
 			return
 		case <-ticker.C:
-			time.Sleep(rand.N(2000 * time.Millisecond))
+			if !breaker.allow(time.Now()) {
+				continue
+			}
+			if cfg.PollJitter > 0 {
+				select {
+				case <-ctx.Done():
+					continue
+				case <-time.After(rand.N(cfg.PollJitter)):
+				}
+			}
+
+			if breaker.state == breakerHalfOpen {
+				// Only pay for a full poll (and, for Tapo, a handshake) once something is listening again
+				if err := device.ProbeReachable(ctx, cfg); err != nil {
+					if ctx.Err() != nil {
+						continue
+					}
+					breaker.recordFailure(time.Now())
+					status.recordFailure(time.Now(), err)
+					status.recordBreaker(breaker)
+					scrapeMetrics.breakerState.Set(float64(breaker.state))
+					log.Printf("[%s %s] is still unreachable, next attempt in %s", cfg.Room, cfg.Name, breaker.backoff)
+					continue
+				}
+			}
 
 			timeBefore := time.Now()
-			err := dev.PollDeviceAndUpdateMetrics()
+			err := dev.PollDeviceAndUpdateMetrics(ctx)
 			scrapeMetrics.lastScrapeDuration.Set(time.Since(timeBefore).Seconds())
+			if ctx.Err() != nil {
+				continue
+			}
 
+			previousState := breaker.state
 			if err == nil {
 				scrapeMetrics.successes.Inc()
+				scrapeMetrics.deviceUp.Set(1)
+				scrapeMetrics.lastSuccessTimestamp.Set(float64(timeBefore.UnixMilli()) / 1000)
+				deviceSeries.SetOpen(true)
+				status.recordSuccess(timeBefore)
+				breaker.recordSuccess()
+				if previousState != breakerClosed {
+					log.Printf("[%s %s] has recovered, resuming polling every %s", cfg.Room, cfg.Name, cfg.PollInterval)
+				}
 			} else {
 				scrapeMetrics.failures.Inc()
-				dev.ResetMetricsToRogueValues()
+				scrapeMetrics.deviceUp.Set(0)
+				status.recordFailure(timeBefore, err)
+				if cfg.FailureMode == types.StaleSeries {
+					deviceSeries.SetOpen(false)
+				} else {
+					dev.ResetMetricsToRogueValues()
+				}
 				dev.ResetDeviceConnection()
+				breaker.recordFailure(time.Now())
 				log.Printf("could not query [%s %s]: %v", cfg.Room, cfg.Name, err)
+				if breaker.state == breakerOpen {
+					log.Printf("[%s %s] has failed %d times in a row, next attempt in %s", cfg.Room, cfg.Name, breaker.failures, breaker.backoff)
+				}
+			}
+			status.recordBreaker(breaker)
+			scrapeMetrics.breakerState.Set(float64(breaker.state))
+		}
+	}
+}
+
+// detectModel asks a device that the manifest gives only a driver for its model, retrying at the poll interval and
+// backing off as polling does, so that a device which is unreachable at startup is picked up once it comes back.
+// Returns false if the context is cancelled first.
+func detectModel(ctx context.Context, cfg types.DeviceConfig, tapoAccounts *config.TapoAccounts, status *pollStatus) (types.DeviceConfig, bool) {
+	ticker := time.NewTicker(cfg.PollInterval)
+	defer ticker.Stop()
+	breaker := newCircuitBreaker(cfg.PollInterval)
+	for {
+		if breaker.allow(time.Now()) {
+			detected, err := device.DetectModel(ctx, cfg, tapoAccounts)
+			if ctx.Err() != nil {
+				return cfg, false
+			}
+			if err == nil {
+				return detected, true
+			}
+			breaker.recordFailure(time.Now())
+			status.recordFailure(time.Now(), err)
+			status.recordBreaker(breaker)
+			log.Printf("could not detect the model of [%s %s]: %v", cfg.Room, cfg.Name, err)
+			if breaker.state == breakerOpen {
+				log.Printf("[%s %s] has failed %d times in a row, next attempt in %s", cfg.Room, cfg.Name, breaker.failures, breaker.backoff)
 			}
 		}
+		select {
+		case <-ctx.Done():
+			return cfg, false
+		case <-ticker.C:
+		}
 	}
 }
 
 type prometheusScrapeMetrics struct {
-	successes          prometheus.Counter
-	failures           prometheus.Counter
-	lastScrapeDuration prometheus.Gauge
+	successes            prometheus.Counter
+	failures             prometheus.Counter
+	lastScrapeDuration   prometheus.Gauge
+	pollInterval         prometheus.Gauge
+	breakerState         prometheus.Gauge
+	deviceUp             prometheus.Gauge
+	lastSuccessTimestamp prometheus.Gauge
 }
 
-func registerScrapeMetrics(dev types.PollableDevice, registry prometheus.Registerer) prometheusScrapeMetrics {
+func registerScrapeMetrics(cfg types.DeviceConfig, dev types.PollableDevice, registry prometheus.Registerer) prometheusScrapeMetrics {
 	successes := prometheus.NewCounter(prometheus.CounterOpts{Namespace: "common", Name: "scrape_successes_total", ConstLabels: dev.CommonMetricLabels()})
 	registry.MustRegister(successes)
 	failures := prometheus.NewCounter(prometheus.CounterOpts{Namespace: "common", Name: "scrape_failures_total", ConstLabels: dev.CommonMetricLabels()})
 	registry.MustRegister(failures)
 	lastScrapeDuration := prometheus.NewGauge(prometheus.GaugeOpts{Namespace: "common", Name: "last_scrape_duration_ms", ConstLabels: dev.CommonMetricLabels()})
 	registry.MustRegister(lastScrapeDuration)
+	pollInterval := prometheus.NewGauge(prometheus.GaugeOpts{Namespace: "common", Name: "poll_interval_seconds", ConstLabels: dev.CommonMetricLabels()})
+	registry.MustRegister(pollInterval)
+	pollInterval.Set(cfg.PollInterval.Seconds())
+	// 0 = closed (polling normally), 1 = open (backing off), 2 = half-open (trying again)
+	breakerState := prometheus.NewGauge(prometheus.GaugeOpts{Namespace: "common", Name: "circuit_breaker_state", ConstLabels: dev.CommonMetricLabels()})
+	registry.MustRegister(breakerState)
+	deviceUp := prometheus.NewGauge(prometheus.GaugeOpts{Namespace: "common", Name: "device_up", ConstLabels: dev.CommonMetricLabels()})
+	registry.MustRegister(deviceUp)
+	lastSuccessTimestamp := prometheus.NewGauge(prometheus.GaugeOpts{Namespace: "common", Name: "last_success_timestamp_seconds", ConstLabels: dev.CommonMetricLabels()})
+	registry.MustRegister(lastSuccessTimestamp)
 	return prometheusScrapeMetrics{
-		successes:          successes,
-		failures:           failures,
-		lastScrapeDuration: lastScrapeDuration,
+		successes:            successes,
+		failures:             failures,
+		lastScrapeDuration:   lastScrapeDuration,
+		pollInterval:         pollInterval,
+		breakerState:         breakerState,
+		deviceUp:             deviceUp,
+		lastSuccessTimestamp: lastSuccessTimestamp,
 	}
 }
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"homepower/config"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const configChangeCheckInterval = 15 * time.Second
+
+// reloadConfigOnChange re-reads the config files whenever SIGHUP is received or either file is seen to have changed,
+// and applies the result to the running devices.  An invalid config is logged and otherwise ignored.
+func reloadConfigOnChange(ctx context.Context, devices *supervisor, deviceConfigFilepath string, credentialFilepath string) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+	ticker := time.NewTicker(configChangeCheckInterval)
+	defer ticker.Stop()
+
+	lastSeen := fingerprintFiles(deviceConfigFilepath, credentialFilepath)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangups:
+			println("Received SIGHUP, reloading config")
+		case <-ticker.C:
+			if fingerprintFiles(deviceConfigFilepath, credentialFilepath) == lastSeen {
+				continue
+			}
+			println("Config files have changed, reloading config")
+		}
+		lastSeen = fingerprintFiles(deviceConfigFilepath, credentialFilepath)
+
+		appConfig, err := config.LoadConfigAndCredentials(deviceConfigFilepath, credentialFilepath)
+		if err != nil {
+			log.Printf("could not reload config, continuing with the previous config: %v", err)
+			continue
+		}
+		for _, err := range devices.apply(appConfig) {
+			log.Println(err)
+		}
+	}
+}
+
+// fingerprintFiles summarises the size and modification time of each file; it is cheaper than hashing the contents
+// and also notices the symlink swaps used when Kubernetes updates a mounted ConfigMap or Secret.
+func fingerprintFiles(filepaths ...string) string {
+	var fingerprint string
+	for _, filepath := range filepaths {
+		if info, err := os.Stat(filepath); err == nil {
+			fingerprint += filepath + "@" + info.ModTime().String() + "/" + strconv.FormatInt(info.Size(), 10) + ";"
+		} else {
+			fingerprint += filepath + "@missing;"
+		}
+	}
+	return fingerprint
+}
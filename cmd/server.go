@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"homepower/config"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// startHttpServer serves until the context is cancelled, and returns an error if the server could not be started or
+// stopped for any other reason
+func startHttpServer(ctx context.Context, webConfig *config.WebConfig, handler http.Handler) error {
+	server := http.Server{
+		Addr:              webConfig.ListenAddress,
+		Handler:           handler,
+		ReadTimeout:       1500 * time.Millisecond,
+		ReadHeaderTimeout: 500 * time.Millisecond,
+		WriteTimeout:      2000 * time.Second,
+	}
+	if webConfig.TLSServerConfig != nil {
+		tlsConfig, err := newTlsConfig(webConfig.TLSServerConfig)
+		if err != nil {
+			return fmt.Errorf("could not configure TLS: %w", err)
+		}
+		server.TLSConfig = tlsConfig
+	}
+	go func() {
+		<-ctx.Done()
+		println("Received signal to shut down http server")
+		if err := server.Shutdown(context.Background()); err != nil {
+			println(err.Error())
+		}
+	}()
+	var err error
+	if server.TLSConfig != nil {
+		println("Listening with TLS on " + webConfig.ListenAddress)
+		// The certificate comes from TLSConfig.GetCertificate, so no filenames are passed here
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		println("Listening on " + webConfig.ListenAddress)
+		err = server.ListenAndServe()
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func newTlsConfig(tlsServerConfig *config.TLSServerConfig) (*tls.Config, error) {
+	certificates := &reloadingCertificate{certFile: tlsServerConfig.CertFile, keyFile: tlsServerConfig.KeyFile}
+	if _, err := certificates.get(nil); err != nil {
+		return nil, err
+	}
+	clientAuth, err := tlsServerConfig.ClientAuth()
+	if err != nil {
+		return nil, err
+	}
+	minVersion, maxVersion := tlsServerConfig.Versions()
+	tlsConfig := &tls.Config{
+		GetCertificate: certificates.get,
+		ClientAuth:     clientAuth,
+		MinVersion:     minVersion,
+		MaxVersion:     maxVersion,
+	}
+	if tlsServerConfig.ClientCAFile != "" {
+		caBytes, err := os.ReadFile(tlsServerConfig.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read client_ca_file: %w", err)
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(caBytes) {
+			return nil, errors.New("no certificates could be read from client_ca_file " + tlsServerConfig.ClientCAFile)
+		}
+	}
+	return tlsConfig, nil
+}
+
+// reloadingCertificate re-reads the certificate and key whenever either file's modification time changes, so that
+// renewed certificates are picked up without a restart.  If the new pair cannot be loaded, the previous one is kept.
+type reloadingCertificate struct {
+	certFile    string
+	keyFile     string
+	mutex       sync.Mutex
+	loadedMtime time.Time
+	certificate *tls.Certificate
+}
+
+func (rc *reloadingCertificate) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	mtime, err := latestModificationTime(rc.certFile, rc.keyFile)
+	if err != nil {
+		if rc.certificate != nil {
+			return rc.certificate, nil
+		}
+		return nil, err
+	}
+	if rc.certificate != nil && mtime.Equal(rc.loadedMtime) {
+		return rc.certificate, nil
+	}
+	certificate, err := tls.LoadX509KeyPair(rc.certFile, rc.keyFile)
+	if err != nil {
+		if rc.certificate != nil {
+			log.Printf("could not reload TLS certificate, continuing with the previous one: %v", err)
+			rc.loadedMtime = mtime
+			return rc.certificate, nil
+		}
+		return nil, fmt.Errorf("could not load TLS certificate: %w", err)
+	}
+	if rc.certificate != nil {
+		log.Println("Reloaded TLS certificate from " + rc.certFile)
+	}
+	rc.certificate = &certificate
+	rc.loadedMtime = mtime
+	return rc.certificate, nil
+}
+
+func latestModificationTime(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// requireAuthentication accepts either basic auth against the bcrypt hashes in the web config, or one of its bearer
+// tokens.  When neither is configured, requests are passed through untouched.
+func requireAuthentication(webConfig *config.WebConfig, next http.Handler) http.Handler {
+	if !webConfig.RequiresAuthentication() {
+		return next
+	}
+	checker := &credentialChecker{webConfig: webConfig}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if checker.isAuthorised(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(webConfig.BasicAuthUsers) > 0 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="homepower"`)
+		} else {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="homepower"`)
+		}
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	})
+}
+
+type credentialChecker struct {
+	webConfig *config.WebConfig
+	// bcrypt is deliberately slow, so passwords that have already been accepted are remembered by their digest
+	verified sync.Map
+}
+
+func (cc *credentialChecker) isAuthorised(r *http.Request) bool {
+	if username, password, ok := r.BasicAuth(); ok {
+		hash, found := cc.webConfig.BasicAuthUsers[username]
+		if !found {
+			return false
+		}
+		digest := sha256.Sum256([]byte(username + "\x00" + password + "\x00" + hash))
+		if _, seen := cc.verified.Load(digest); seen {
+			return true
+		}
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+			return false
+		}
+		cc.verified.Store(digest, struct{}{})
+		return true
+	}
+	if token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found && token != "" {
+		for _, allowed := range cc.webConfig.BearerTokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(allowed)) == 1 {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"homepower/types"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// energyHistoryTimeout is longer than a control request's, as a year of history takes a dozen or so calls to the device
+const energyHistoryTimeout = 30 * time.Second
+
+// pollStatus is written by a device's polling goroutine and read by the status endpoints
+type pollStatus struct {
+	ready               *readiness
+	mutex               sync.Mutex
+	lastSuccess         time.Time
+	lastFailure         time.Time
+	lastError           string
+	consecutiveFailures int
+	breaker             breakerState
+	nextAttempt         time.Time
+}
+
+func (ps *pollStatus) recordSuccess(at time.Time) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	ps.lastSuccess = at
+	ps.consecutiveFailures = 0
+	ps.ready.pollCompleted.Store(true)
+}
+
+func (ps *pollStatus) recordFailure(at time.Time, err error) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	ps.lastFailure = at
+	ps.lastError = err.Error()
+	ps.consecutiveFailures++
+	ps.ready.pollCompleted.Store(true)
+}
+
+func (ps *pollStatus) recordBreaker(breaker *circuitBreaker) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	ps.breaker = breaker.state
+	ps.nextAttempt = time.Time{}
+	if breaker.state == breakerOpen {
+		ps.nextAttempt = breaker.retryAt
+	}
+}
+
+type deviceStatusJson struct {
+	Name                string     `json:"name"`
+	Room                string     `json:"room"`
+	Ip                  string     `json:"ip"`
+	Model               string     `json:"model"`
+	Driver              string     `json:"driver"`
+	Protocol            string     `json:"protocol,omitempty"`
+	LastSuccess         *time.Time `json:"last_success"`
+	LastFailure         *time.Time `json:"last_failure"`
+	LastError           string     `json:"last_error,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	CircuitBreaker      string     `json:"circuit_breaker"`
+	NextAttempt         *time.Time `json:"next_attempt,omitempty"`
+	Status              any        `json:"status"`
+}
+
+func (ps *pollStatus) toJson(cfg types.DeviceConfig, dev types.PollableDevice) deviceStatusJson {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	return deviceStatusJson{
+		Name:                cfg.Name,
+		Room:                cfg.Room,
+		Ip:                  cfg.Ip,
+		Model:               types.ModelNameFor(modelOf(cfg, dev)),
+		Driver:              driverName(cfg.Driver),
+		Protocol:            protocolOf(dev),
+		LastSuccess:         timeOrNil(ps.lastSuccess),
+		LastFailure:         timeOrNil(ps.lastFailure),
+		LastError:           ps.lastError,
+		ConsecutiveFailures: ps.consecutiveFailures,
+		CircuitBreaker:      ps.breaker.String(),
+		NextAttempt:         timeOrNil(ps.nextAttempt),
+		Status:              lastStatusOf(dev),
+	}
+}
+
+// modelOf, protocolOf and lastStatusOf allow for a device whose model is still being detected, which has no driver yet
+func modelOf(cfg types.DeviceConfig, dev types.PollableDevice) types.DeviceType {
+	if dev == nil {
+		return cfg.Model
+	}
+	return dev.Model()
+}
+
+func protocolOf(dev types.PollableDevice) string {
+	if dev == nil {
+		return ""
+	}
+	return dev.Protocol()
+}
+
+func lastStatusOf(dev types.PollableDevice) any {
+	if dev == nil {
+		return nil
+	}
+	return dev.LastStatus()
+}
+
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func driverName(driver types.DeviceDriver) string {
+	switch driver {
+	case types.Kasa:
+		return "kasa"
+	case types.Tapo:
+		return "tapo"
+	default:
+		return "unknown"
+	}
+}
+
+func (s *supervisor) deviceStatuses() []deviceStatusJson {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	statuses := make([]deviceStatusJson, 0, len(s.running))
+	for _, running := range s.running {
+		statuses = append(statuses, running.status.toJson(running.cfg, running.pollable()))
+	}
+	slices.SortFunc(statuses, func(a, b deviceStatusJson) int {
+		return cmp.Or(cmp.Compare(a.Room, b.Room), cmp.Compare(a.Name, b.Name))
+	})
+	return statuses
+}
+
+// readiness becomes ready once the config has been loaded and any device has finished a poll, whether or not the
+// poll succeeded, as an unreachable device should not stop the exporter from being scraped
+type readiness struct {
+	configLoaded  atomic.Bool
+	pollCompleted atomic.Bool
+}
+
+func addStatusHandlers(mux *http.ServeMux, ready *readiness) {
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		switch {
+		case !ready.configLoaded.Load():
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("config has not been loaded\n"))
+		case !ready.pollCompleted.Load():
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("no device has been polled yet\n"))
+		default:
+			_, _ = w.Write([]byte("ok\n"))
+		}
+	})
+}
+
+func addDeviceApiHandlers(mux *http.ServeMux, devices *supervisor) {
+	mux.HandleFunc("GET /api/devices", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(devices.deviceStatuses())
+	})
+	mux.HandleFunc("GET /api/devices/{ip}/energy-history", func(w http.ResponseWriter, r *http.Request) {
+		running, found := devices.deviceByIp(r.PathValue("ip"))
+		if !found {
+			http.Error(w, "no device is configured with that ip", http.StatusNotFound)
+			return
+		}
+		dev := running.pollable()
+		if dev == nil {
+			http.Error(w, errModelNotDetected.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		provider, supported := dev.(types.EnergyHistoryProvider)
+		if !supported {
+			http.Error(w, "device does not keep energy history", http.StatusNotImplemented)
+			return
+		}
+		// The device does not say which time zone its history is kept in, so the caller gives it
+		location := time.Local
+		if tz := r.URL.Query().Get("tz"); tz != "" {
+			var err error
+			if location, err = time.LoadLocation(tz); err != nil {
+				http.Error(w, "tz must be a time zone such as Europe/London", http.StatusBadRequest)
+				return
+			}
+		}
+		year := time.Now().In(location).Year()
+		if yearParam := r.URL.Query().Get("year"); yearParam != "" {
+			var err error
+			if year, err = strconv.Atoi(yearParam); err != nil {
+				http.Error(w, "year must be a number", http.StatusBadRequest)
+				return
+			}
+		}
+		format := r.URL.Query().Get("format")
+		if format != "" && format != "json" && format != "openmetrics" {
+			http.Error(w, "format must be json or openmetrics", http.StatusBadRequest)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), energyHistoryTimeout)
+		defer cancel()
+		history, err := provider.EnergyHistory(ctx, year)
+		if err != nil {
+			if errors.Is(err, types.ErrNotSupported) {
+				http.Error(w, err.Error(), http.StatusNotImplemented)
+			} else {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+			}
+			return
+		}
+		if format == "openmetrics" {
+			w.Header().Set("Content-Type", openMetricsContentType)
+			_ = writeEnergyHistoryOpenMetrics(w, dev.CommonMetricLabels(), history, location)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(history)
+	})
+	mux.HandleFunc("GET /api/devices/{ip}/rules", func(w http.ResponseWriter, r *http.Request) {
+		running, found := devices.deviceByIp(r.PathValue("ip"))
+		if !found {
+			http.Error(w, "no device is configured with that ip", http.StatusNotFound)
+			return
+		}
+		dev := running.pollable()
+		if dev == nil {
+			http.Error(w, errModelNotDetected.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		provider, supported := dev.(types.RulesProvider)
+		if !supported {
+			http.Error(w, "device does not keep rules", http.StatusNotImplemented)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), controlTimeout)
+		defer cancel()
+		rules, err := provider.Rules(ctx)
+		if err != nil {
+			if errors.Is(err, types.ErrNotSupported) {
+				http.Error(w, err.Error(), http.StatusNotImplemented)
+			} else {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(rules)
+	})
+}
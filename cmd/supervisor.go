@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"homepower/config"
+	"homepower/device"
+	"homepower/types"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// deviceKey identifies a device across config reloads, so that changing its IP or model recreates it in place
+type deviceKey struct {
+	room string
+	name string
+}
+
+func keyFor(cfg types.DeviceConfig) deviceKey {
+	return deviceKey{room: cfg.Room, name: cfg.Name}
+}
+
+type runningDevice struct {
+	cfg         types.DeviceConfig
+	credentials config.Credentials
+	registerer  *types.TrackingRegisterer
+	device      atomic.Pointer[types.PollableDevice] // nil until a device given only a driver has had its model detected
+	status      *pollStatus
+	stop        context.CancelFunc
+	exited      chan struct{}
+}
+
+// supervisor owns one polling goroutine per configured device, and starts and stops them as the config changes
+type supervisor struct {
+	ctx      context.Context
+	registry prometheus.Registerer
+	mutex    sync.Mutex
+	running  map[deviceKey]*runningDevice
+	ready    readiness
+}
+
+func newSupervisor(ctx context.Context, registry prometheus.Registerer) *supervisor {
+	return &supervisor{
+		ctx:      ctx,
+		registry: registry,
+		running:  map[deviceKey]*runningDevice{},
+	}
+}
+
+// apply brings the running pollers in line with the given config: devices that have gone are stopped and have their
+// metrics unregistered, devices that have changed are recreated, and new devices are started.
+func (s *supervisor) apply(appConfig *config.AppConfig) []error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	wanted := make(map[deviceKey]types.DeviceConfig, len(appConfig.Devices))
+	for _, cfg := range appConfig.Devices {
+		wanted[keyFor(cfg)] = cfg
+	}
+	for key, running := range s.running {
+		if cfg, found := wanted[key]; !found || cfg != running.cfg || !sameCredentials(cfg, running.credentials, &appConfig.TapoAccounts) {
+			log.Printf("Stopping poller for %s %s (%s)\n", running.cfg.Room, running.cfg.Name, running.cfg.Ip)
+			running.stopAndUnregister()
+			delete(s.running, key)
+		}
+	}
+
+	var errs []error
+	for _, cfg := range appConfig.Devices {
+		key := keyFor(cfg)
+		if _, found := s.running[key]; found {
+			continue
+		}
+		running, err := s.start(cfg, &appConfig.TapoAccounts)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("could not create device driver for %s (%s): %w", cfg.Ip, cfg.Name, err))
+			continue
+		}
+		s.running[key] = running
+	}
+	s.ready.configLoaded.Store(true)
+	return errs
+}
+
+// sameCredentials reports whether a device would still log in with the same email and password, so that a password
+// change in the credentials file (or its secrets) recreates the device
+func sameCredentials(cfg types.DeviceConfig, previous config.Credentials, tapoAccounts *config.TapoAccounts) bool {
+	current, err := tapoAccounts.For(cfg.Credentials)
+	return err == nil && previous == current
+}
+
+// start creates the device's driver and its polling goroutine.  A device given only a driver has its model detected
+// by that goroutine instead, so that one which is switched off does not hold up the others or stop the exporter.
+func (s *supervisor) start(cfg types.DeviceConfig, tapoAccounts *config.TapoAccounts) (*runningDevice, error) {
+	credentials, err := tapoAccounts.For(cfg.Credentials)
+	if err != nil {
+		return nil, err
+	}
+	ctx, stop := context.WithCancel(s.ctx)
+	running := &runningDevice{
+		cfg:         cfg,
+		credentials: credentials,
+		registerer:  types.NewTrackingRegisterer(s.registry),
+		status:      &pollStatus{ready: &s.ready},
+		stop:        stop,
+		exited:      make(chan struct{}),
+	}
+	if cfg.Model != types.UnknownModel {
+		pollableDevice, deviceSeries, scrapeMetrics, err := running.create(cfg, tapoAccounts)
+		if err != nil {
+			stop()
+			return nil, err
+		}
+		go func() {
+			defer close(running.exited)
+			pollDevice(ctx, cfg, pollableDevice, deviceSeries, scrapeMetrics, running.status)
+		}()
+		return running, nil
+	}
+	go func() {
+		defer close(running.exited)
+		detected, found := detectModel(ctx, cfg, tapoAccounts, running.status)
+		if !found {
+			return
+		}
+		pollableDevice, deviceSeries, scrapeMetrics, err := running.create(detected, tapoAccounts)
+		if err != nil {
+			log.Printf("could not create device driver for %s (%s): %v", cfg.Ip, cfg.Name, err)
+			return
+		}
+		pollDevice(ctx, detected, pollableDevice, deviceSeries, scrapeMetrics, running.status)
+	}()
+	return running, nil
+}
+
+func (r *runningDevice) create(cfg types.DeviceConfig, tapoAccounts *config.TapoAccounts) (types.PollableDevice, *types.GatedRegisterer, prometheusScrapeMetrics, error) {
+	// The device's own series go through a gate so that they can be hidden after a failed poll, whereas the scrape
+	// metrics (including common_device_up) are always exposed
+	deviceSeries := types.NewGatedRegisterer(r.registerer)
+	deviceSeries.SetOpen(cfg.FailureMode == types.RogueValues)
+	pollableDevice, err := device.Factory(cfg, tapoAccounts, deviceSeries)
+	if err != nil {
+		r.registerer.UnregisterAll()
+		return nil, nil, prometheusScrapeMetrics{}, err
+	}
+	scrapeMetrics := registerScrapeMetrics(cfg, pollableDevice, r.registerer)
+	r.device.Store(&pollableDevice)
+	return pollableDevice, deviceSeries, scrapeMetrics, nil
+}
+
+// pollable is the device's driver, or nil while its model is still being detected
+func (r *runningDevice) pollable() types.PollableDevice {
+	if dev := r.device.Load(); dev != nil {
+		return *dev
+	}
+	return nil
+}
+
+func (r *runningDevice) stopAndUnregister() {
+	r.stop()
+	<-r.exited
+	r.registerer.UnregisterAll()
+}
+
+// waitForAll blocks until every poller has exited, which happens once the supervisor's context has been cancelled
+func (s *supervisor) waitForAll() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, running := range s.running {
+		<-running.exited
+	}
+}
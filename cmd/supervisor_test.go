@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"homepower/config"
+	"homepower/types"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeviceWithNoModelIsStartedEvenWhenUnreachable(t *testing.T) {
+	// Nothing listens on the Kasa ports of the loopback address, so the model probe fails straight away
+	const unreachableIp = "127.0.0.1"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	devices := newSupervisor(ctx, prometheus.NewRegistry())
+	errs := devices.apply(&config.AppConfig{Devices: []types.DeviceConfig{{
+		Name:         "Lamp",
+		Room:         "Office",
+		Model:        types.UnknownModel,
+		Driver:       types.Kasa,
+		Ip:           unreachableIp,
+		PollInterval: time.Hour,
+	}}})
+	assert.Empty(t, errs)
+
+	assert.Eventually(t, func() bool {
+		statuses := devices.deviceStatuses()
+		return len(statuses) == 1 && statuses[0].ConsecutiveFailures == 1
+	}, 10*time.Second, 10*time.Millisecond)
+	running, found := devices.deviceByIp(unreachableIp)
+	assert.True(t, found)
+	assert.Nil(t, running.pollable())
+
+	cancel()
+	devices.waitForAll()
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"homepower/config"
+	"os"
+)
+
+// validateConfig checks the manifest and credentials given as arguments (or in the usual environment variables) and
+// returns the exit code for the process, so that it can be used to gate changes to the config.
+func validateConfig(args []string) int {
+	deviceConfigFilepath := os.Getenv(config.DeviceConfigFilepathVariable)
+	credentialFilepath := os.Getenv(config.CredentialFilepathVariable)
+	if len(args) > 0 {
+		deviceConfigFilepath = args[0]
+	}
+	if len(args) > 1 {
+		credentialFilepath = args[1]
+	}
+	if deviceConfigFilepath == "" || len(args) > 2 {
+		_, _ = fmt.Fprintln(os.Stderr, "usage: homepower validate [device manifest path] [credentials path]")
+		return 2
+	}
+
+	diagnostics := config.ValidateConfigFiles(deviceConfigFilepath, credentialFilepath)
+	errorCount := 0
+	for _, diagnostic := range diagnostics {
+		_, _ = fmt.Fprintln(os.Stderr, diagnostic.String())
+		if diagnostic.Severity == config.SeverityError {
+			errorCount++
+		}
+	}
+	_, _ = fmt.Fprintf(os.Stderr, "%d error(s), %d warning(s)\n", errorCount, len(diagnostics)-errorCount)
+	if errorCount > 0 {
+		return 1
+	}
+	return 0
+}
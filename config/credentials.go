@@ -0,0 +1,103 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// The default Tapo account may also be given (or overridden) through the environment, either directly or, with the
+// _FILE suffix, as the path to a file holding the value, e.g. a Docker or Kubernetes secret.
+const TapoEmailVariable = "HOMEPOWER_TAPO_EMAIL"
+const TapoPasswordVariable = "HOMEPOWER_TAPO_PASSWORD"
+
+const fileVariableSuffix = "_FILE"
+
+// credentialSource is one account in the credentials file.  Each of the email and password can be given literally,
+// as the name of an environment variable, or as the path to a file, but only one of the three.
+type credentialSource struct {
+	Email        string `yaml:"email"`
+	EmailEnv     string `yaml:"email_env"`
+	EmailFile    string `yaml:"email_file"`
+	Password     string `yaml:"password"`
+	PasswordEnv  string `yaml:"password_env"`
+	PasswordFile string `yaml:"password_file"`
+}
+
+var credentialSourceKeys = []string{"email", "email_env", "email_file", "password", "password_env", "password_file"}
+
+func (cs credentialSource) resolve() (Credentials, error) {
+	email, err := resolveSecret("email", cs.Email, cs.EmailEnv, cs.EmailFile)
+	if err != nil {
+		return Credentials{}, err
+	}
+	password, err := resolveSecret("password", cs.Password, cs.PasswordEnv, cs.PasswordFile)
+	if err != nil {
+		return Credentials{}, err
+	}
+	return Credentials{EmailAddress: email, Password: password}, nil
+}
+
+// withEnvironmentOverrides replaces each field of the default account for which HOMEPOWER_TAPO_EMAIL or
+// HOMEPOWER_TAPO_PASSWORD (or their _FILE variants) are set
+func (cs credentialSource) withEnvironmentOverrides() credentialSource {
+	if literal, envName, file, found := sourceFromEnvironment(TapoEmailVariable); found {
+		cs.Email, cs.EmailEnv, cs.EmailFile = literal, envName, file
+	}
+	if literal, envName, file, found := sourceFromEnvironment(TapoPasswordVariable); found {
+		cs.Password, cs.PasswordEnv, cs.PasswordFile = literal, envName, file
+	}
+	return cs
+}
+
+func sourceFromEnvironment(variable string) (literal string, envName string, file string, found bool) {
+	if _, found := os.LookupEnv(variable); found {
+		return "", variable, "", true
+	}
+	if file, found := os.LookupEnv(variable + fileVariableSuffix); found {
+		return "", "", file, true
+	}
+	return "", "", "", false
+}
+
+func resolveSecret(field string, literal string, envName string, file string) (string, error) {
+	sources := 0
+	for _, source := range []string{literal, envName, file} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return "", errors.New("only one of " + field + ", " + field + "_env or " + field + "_file may be given")
+	}
+	switch {
+	case envName != "":
+		value, found := os.LookupEnv(envName)
+		if !found {
+			return "", errors.New("environment variable " + envName + " for the " + field + " is not set")
+		}
+		return value, nil
+	case file != "":
+		fileBytes, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("could not read %s file: %w", field, err)
+		}
+		// Secrets written with echo or an editor usually end with a newline that is not part of the value
+		return strings.TrimRight(string(fileBytes), "\r\n"), nil
+	default:
+		return literal, nil
+	}
+}
+
+// For returns the credentials of the named Tapo account, or of the default account if the name is empty
+func (ta *TapoAccounts) For(name string) (Credentials, error) {
+	if name == "" {
+		return ta.Default, nil
+	}
+	credentials, found := ta.Named[name]
+	if !found {
+		return Credentials{}, errors.New("tapo account " + name + " is not defined in the credentials file")
+	}
+	return credentials, nil
+}
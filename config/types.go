@@ -5,11 +5,18 @@ import (
 )
 
 type AppConfig struct {
-	Devices         []types.DeviceConfig
-	TapoCredentials Credentials
+	Devices      []types.DeviceConfig
+	TapoAccounts TapoAccounts
 }
 
 type Credentials struct {
 	EmailAddress string
 	Password     string
 }
+
+// TapoAccounts holds the default Tapo account and any others named in the credentials file, which devices refer to
+// with the credentials key in the manifest
+type TapoAccounts struct {
+	Default Credentials
+	Named   map[string]Credentials
+}
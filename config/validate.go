@@ -0,0 +1,417 @@
+package config
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"homepower/types"
+	"maps"
+	"net"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type Severity int
+
+const (
+	SeverityError Severity = iota
+	SeverityWarning
+)
+
+type Diagnostic struct {
+	File     string
+	Line     int
+	Column   int
+	Severity Severity
+	Message  string
+}
+
+func (d Diagnostic) String() string {
+	severity := "error"
+	if d.Severity == SeverityWarning {
+		severity = "warning"
+	}
+	return fmt.Sprintf("%s:%d:%d: %s: %s", d.File, d.Line, d.Column, severity, d.Message)
+}
+
+func HasErrors(diagnostics []Diagnostic) bool {
+	for _, diagnostic := range diagnostics {
+		if diagnostic.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateConfigFiles checks the device manifest and credentials file for every problem it can find, rather than
+// stopping at the first one.  An empty credentialFilepath is only a problem if the manifest contains Tapo devices.
+// Diagnostics for the manifest come first, and each file's are in the order of their position in it.
+func ValidateConfigFiles(deviceConfigFilepath string, credentialFilepath string) []Diagnostic {
+	v := validator{}
+	tapoAccounts := v.validateDeviceManifest(deviceConfigFilepath)
+	v.validateTapoCredentials(credentialFilepath, deviceConfigFilepath, tapoAccounts)
+	slices.SortStableFunc(v.diagnostics, func(a, b Diagnostic) int {
+		return cmp.Or(
+			cmp.Compare(fileOrder(a.File, deviceConfigFilepath), fileOrder(b.File, deviceConfigFilepath)),
+			cmp.Compare(a.Line, b.Line),
+			cmp.Compare(a.Column, b.Column))
+	})
+	return v.diagnostics
+}
+
+func fileOrder(file string, deviceConfigFilepath string) int {
+	if file == deviceConfigFilepath {
+		return 0
+	}
+	return 1
+}
+
+type validator struct {
+	diagnostics []Diagnostic
+}
+
+func (v *validator) report(file string, node *yaml.Node, severity Severity, format string, args ...any) {
+	diagnostic := Diagnostic{File: file, Severity: severity, Message: fmt.Sprintf(format, args...)}
+	if node != nil {
+		diagnostic.Line = node.Line
+		diagnostic.Column = node.Column
+	}
+	v.diagnostics = append(v.diagnostics, diagnostic)
+}
+
+var yamlErrorLine = regexp.MustCompile(`line (\d+)`)
+
+func (v *validator) parseYamlFile(file string) *yaml.Node {
+	fileBytes, err := os.ReadFile(file)
+	if err != nil {
+		v.report(file, nil, SeverityError, "could not read file: %v", err)
+		return nil
+	}
+	var document yaml.Node
+	if err := yaml.Unmarshal(fileBytes, &document); err != nil {
+		diagnostic := Diagnostic{File: file, Severity: SeverityError, Message: err.Error()}
+		var typeError *yaml.TypeError
+		if !errors.As(err, &typeError) {
+			if match := yamlErrorLine.FindStringSubmatch(err.Error()); match != nil {
+				diagnostic.Line, _ = strconv.Atoi(match[1])
+			}
+		}
+		v.diagnostics = append(v.diagnostics, diagnostic)
+		return nil
+	}
+	if document.Kind != yaml.DocumentNode || len(document.Content) == 0 {
+		v.report(file, nil, SeverityError, "file is empty")
+		return nil
+	}
+	root := document.Content[0]
+	if root.Kind != yaml.MappingNode {
+		v.report(file, root, SeverityError, "expected a mapping at the top level of the file")
+		return nil
+	}
+	return root
+}
+
+type mappingEntry struct {
+	key   *yaml.Node
+	value *yaml.Node
+}
+
+func (v *validator) mappingEntries(file string, node *yaml.Node, knownKeys ...string) map[string]mappingEntry {
+	entries := make(map[string]mappingEntry, len(node.Content)/2)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if _, duplicate := entries[key.Value]; duplicate {
+			v.report(file, key, SeverityError, "key '%s' is repeated", key.Value)
+		} else if !slices.Contains(knownKeys, key.Value) {
+			v.report(file, key, SeverityWarning, "unknown key '%s' will be ignored", key.Value)
+		}
+		entries[key.Value] = mappingEntry{key: key, value: value}
+	}
+	return entries
+}
+
+func (v *validator) scalar(file string, entries map[string]mappingEntry, key string) (string, *yaml.Node) {
+	entry, found := entries[key]
+	if !found {
+		return "", nil
+	}
+	if entry.value.Kind != yaml.ScalarNode {
+		v.report(file, entry.value, SeverityError, "expected '%s' to be a single value", key)
+		return "", entry.value
+	}
+	return entry.value.Value, entry.value
+}
+
+func (v *validator) duration(file string, entries map[string]mappingEntry, key string, mustBePositive bool) {
+	value, node := v.scalar(file, entries, key)
+	if node == nil || node.Kind != yaml.ScalarNode {
+		return
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		v.report(file, node, SeverityError, "'%s' is not a valid duration for %s, e.g. \"10s\"", value, key)
+	} else if duration < 0 || (mustBePositive && duration == 0) {
+		v.report(file, node, SeverityError, "%s must be greater than zero", key)
+	}
+}
+
+func (v *validator) boolean(file string, entries map[string]mappingEntry, key string) (bool, *yaml.Node) {
+	_, node := v.scalar(file, entries, key)
+	if node == nil || node.Kind != yaml.ScalarNode {
+		return false, node
+	}
+	var value bool
+	if err := node.Decode(&value); err != nil {
+		v.report(file, node, SeverityError, "expected %s to be true or false", key)
+	}
+	return value, node
+}
+
+func (v *validator) failureMode(file string, entries map[string]mappingEntry) {
+	value, node := v.scalar(file, entries, "failure_mode")
+	if node == nil || node.Kind != yaml.ScalarNode {
+		return
+	}
+	if _, err := types.FailureModeForName(value); err != nil {
+		v.report(file, node, SeverityError, "unknown failure_mode '%s', expected one of rogue or stale", value)
+	}
+}
+
+// validateDeviceManifest returns the Tapo accounts that the manifest's devices need, each mapped to the first device
+// that uses it; the default account has an empty name
+func (v *validator) validateDeviceManifest(file string) (tapoAccounts map[string]*yaml.Node) {
+	tapoAccounts = map[string]*yaml.Node{}
+	root := v.parseYamlFile(file)
+	if root == nil {
+		return tapoAccounts
+	}
+	entries := v.mappingEntries(file, root, "poll_interval", "poll_jitter", "credentials", "failure_mode", "devices")
+	v.duration(file, entries, "poll_interval", true)
+	v.duration(file, entries, "poll_jitter", false)
+	v.failureMode(file, entries)
+	defaultAccount, _ := v.scalar(file, entries, "credentials")
+
+	devices, found := entries["devices"]
+	if !found {
+		v.report(file, root, SeverityError, "no devices have been listed")
+		return tapoAccounts
+	}
+	if devices.value.Kind != yaml.SequenceNode {
+		v.report(file, devices.value, SeverityError, "expected devices to be a list")
+		return tapoAccounts
+	}
+
+	seenIps := map[string]*yaml.Node{}
+	seenNames := map[roomAndName]*yaml.Node{}
+	for _, device := range devices.value.Content {
+		if device.Kind != yaml.MappingNode {
+			v.report(file, device, SeverityError, "expected each device to be a mapping of name, room, ip, model and driver")
+			continue
+		}
+		driver, account := v.validateDevice(file, device, seenIps, seenNames)
+		if account == "" {
+			account = defaultAccount
+		}
+		// Kasa devices only log in when they need KLAP, so they require an account only if they name one
+		if driver != types.Tapo && (driver != types.Kasa || account == "") {
+			continue
+		}
+		if _, seen := tapoAccounts[account]; !seen {
+			tapoAccounts[account] = device
+		}
+	}
+	return tapoAccounts
+}
+
+// roomAndName identifies a device; joining the two into the full name would make e.g. "Back" and "Bedroom Lamp"
+// collide with "Back Bedroom" and "Lamp"
+type roomAndName struct {
+	room string
+	name string
+}
+
+func (v *validator) validateDevice(file string, device *yaml.Node, seenIps map[string]*yaml.Node, seenNames map[roomAndName]*yaml.Node) (driver types.DeviceDriver, account string) {
+	entries := v.mappingEntries(file, device, "name", "room", "ip", "model", "driver", "poll_interval", "poll_jitter", "credentials", "failure_mode", "use_outlet_aliases", "keep_connection_open")
+	name, nameNode := v.scalar(file, entries, "name")
+	room, _ := v.scalar(file, entries, "room")
+	ip, ipNode := v.scalar(file, entries, "ip")
+	modelName, modelNode := v.scalar(file, entries, "model")
+	driverName, driverNode := v.scalar(file, entries, "driver")
+	account, _ = v.scalar(file, entries, "credentials")
+	v.duration(file, entries, "poll_interval", true)
+	v.duration(file, entries, "poll_jitter", false)
+	v.failureMode(file, entries)
+	useOutletAliases, useOutletAliasesNode := v.boolean(file, entries, "use_outlet_aliases")
+	keepConnectionOpen, keepConnectionOpenNode := v.boolean(file, entries, "keep_connection_open")
+
+	if nameNode == nil || strings.TrimSpace(name) == "" {
+		v.report(file, device, SeverityWarning, "device has no name")
+	}
+	fullName := strings.TrimSpace(room + " " + name)
+	if firstSeen, duplicate := seenNames[roomAndName{room, name}]; duplicate {
+		v.report(file, device, SeverityError, "room and name '%s' are already used by the device on line %d", fullName, firstSeen.Line)
+	} else {
+		seenNames[roomAndName{room, name}] = device
+	}
+
+	if ipNode == nil || strings.TrimSpace(ip) == "" {
+		v.report(file, device, SeverityError, "device '%s' has no ip", fullName)
+	} else if net.ParseIP(ip) == nil && !isHostname(ip) {
+		v.report(file, ipNode, SeverityError, "'%s' is neither an IP address nor a hostname", ip)
+	} else if firstSeen, duplicate := seenIps[ip]; duplicate {
+		v.report(file, ipNode, SeverityError, "ip %s is already used by the device on line %d", ip, firstSeen.Line)
+	} else {
+		seenIps[ip] = ipNode
+	}
+
+	driver, err := types.DriverForName(driverName)
+	if err != nil {
+		v.report(file, driverNode, SeverityError, "unknown driver '%s', expected one of kasa or tapo", driverName)
+		return types.Unknown, account
+	}
+	if modelName == "" {
+		if driver == types.Unknown {
+			v.report(file, device, SeverityError, "device '%s' must specify a model, a driver, or both", fullName)
+		}
+		if keepConnectionOpen && driver == types.Tapo {
+			v.report(file, keepConnectionOpenNode, SeverityWarning, "keep_connection_open is only used by kasa devices")
+		}
+		return driver, account
+	}
+	model, found := types.LookupDeviceType(modelName)
+	if !found {
+		v.report(file, modelNode, SeverityError, "unknown model '%s'", modelName)
+		return driver, account
+	}
+	if driver != types.Unknown && types.DriverFor(model) != driver {
+		v.report(file, driverNode, SeverityError, "model %s is not supported by the %s driver", modelName, driverName)
+	}
+	if useOutletAliases && !types.HasOutlets(model) {
+		v.report(file, useOutletAliasesNode, SeverityWarning, "use_outlet_aliases is only used by power strips")
+	} else if useOutletAliases && types.DriverFor(model) == types.Tapo {
+		v.report(file, useOutletAliasesNode, SeverityWarning, "use_outlet_aliases is only used by kasa power strips; tapo strips always name each socket by its nickname")
+	}
+	if keepConnectionOpen && types.DriverFor(model) != types.Kasa {
+		v.report(file, keepConnectionOpenNode, SeverityWarning, "keep_connection_open is only used by kasa devices")
+	}
+	return types.DriverFor(model), account
+}
+
+var hostnameLabel = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
+
+// isHostname checks the syntax of a DNS name, which is looked up each time the device is dialled rather than here
+func isHostname(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if !hostnameLabel.MatchString(label) {
+			return false
+		}
+	}
+	return true
+}
+
+// validateTapoCredentials checks that every account used by the manifest can be resolved.  The default account is
+// only required when a Tapo device uses it, and may be supplied wholly or partly through the environment.
+func (v *validator) validateTapoCredentials(file string, deviceConfigFile string, tapoAccounts map[string]*yaml.Node) {
+	entries := map[string]mappingEntry{}
+	var root *yaml.Node
+	if file != "" {
+		root = v.parseYamlFile(file)
+		if root == nil {
+			return
+		}
+		entries = v.mappingEntries(file, root, "tapo", "tapo_accounts")
+	} else if len(tapoAccounts) == 0 {
+		return
+	}
+
+	tapo, found := entries["tapo"]
+	_, usesDefault := tapoAccounts[""]
+	if found {
+		v.validateAccount(file, tapo.key, tapo.value, "", usesDefault)
+	} else if usesDefault {
+		environment := credentialSource{}.withEnvironmentOverrides()
+		emailFromEnvironment := environment.EmailEnv != "" || environment.EmailFile != ""
+		passwordFromEnvironment := environment.PasswordEnv != "" || environment.PasswordFile != ""
+		if !emailFromEnvironment || !passwordFromEnvironment {
+			if file == "" {
+				v.report(deviceConfigFile, nil, SeverityError, "tapo devices are present but no credentials file has been given")
+			} else {
+				v.report(file, root, SeverityError, "tapo devices are present but no tapo credentials have been given")
+			}
+		} else {
+			v.validateAccount(deviceConfigFile, nil, nil, "", true)
+		}
+	}
+
+	namedAccounts := map[string]mappingEntry{}
+	if accounts, found := entries["tapo_accounts"]; found {
+		if accounts.value.Kind != yaml.MappingNode {
+			v.report(file, accounts.value, SeverityError, "expected tapo_accounts to be a mapping of account names to credentials")
+		} else {
+			namedAccounts = v.mappingEntries(file, accounts.value, keysOf(accounts.value)...)
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(namedAccounts)) {
+		_, used := tapoAccounts[name]
+		v.validateAccount(file, namedAccounts[name].key, namedAccounts[name].value, name, used)
+	}
+	for _, name := range slices.Sorted(maps.Keys(tapoAccounts)) {
+		if _, defined := namedAccounts[name]; name != "" && !defined {
+			v.report(deviceConfigFile, tapoAccounts[name], SeverityError, "tapo account '%s' is not defined in the credentials file", name)
+		}
+	}
+}
+
+// keysOf lists every key of a mapping whose keys are names chosen by the user rather than fixed
+func keysOf(node *yaml.Node) []string {
+	keys := make([]string, 0, len(node.Content)/2)
+	for i := 0; i < len(node.Content); i += 2 {
+		keys = append(keys, node.Content[i].Value)
+	}
+	return keys
+}
+
+// validateAccount checks one account in the credentials file; a nil value means the default account comes entirely
+// from the environment.  Missing values are only errors for accounts that are used.
+func (v *validator) validateAccount(file string, key *yaml.Node, value *yaml.Node, name string, used bool) {
+	source := credentialSource{}
+	if value != nil {
+		if value.Kind != yaml.MappingNode {
+			v.report(file, value, SeverityError, "expected tapo credentials to be a mapping of email and password")
+			return
+		}
+		entries := v.mappingEntries(file, value, credentialSourceKeys...)
+		source.Email, _ = v.scalar(file, entries, "email")
+		source.EmailEnv, _ = v.scalar(file, entries, "email_env")
+		source.EmailFile, _ = v.scalar(file, entries, "email_file")
+		source.Password, _ = v.scalar(file, entries, "password")
+		source.PasswordEnv, _ = v.scalar(file, entries, "password_env")
+		source.PasswordFile, _ = v.scalar(file, entries, "password_file")
+	}
+	if name == "" {
+		source = source.withEnvironmentOverrides()
+	}
+	for _, field := range []struct{ name, literal, envName, file string }{
+		{"email", source.Email, source.EmailEnv, source.EmailFile},
+		{"password", source.Password, source.PasswordEnv, source.PasswordFile},
+	} {
+		resolved, err := resolveSecret(field.name, field.literal, field.envName, field.file)
+		if err != nil {
+			v.report(file, key, SeverityError, "%v", err)
+		} else if resolved == "" && used && name == "" {
+			v.report(file, key, SeverityError, "tapo devices are present but the tapo %s is missing", field.name)
+		} else if resolved == "" && used {
+			v.report(file, key, SeverityError, "tapo account '%s' has no %s", name, field.name)
+		}
+	}
+}
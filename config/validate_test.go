@@ -0,0 +1,309 @@
+package config
+
+import (
+	"homepower/types"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTempFile(t *testing.T, name string, contents string) string {
+	path := filepath.Join(t.TempDir(), name)
+	assert.NoError(t, os.WriteFile(path, []byte(contents), 0600))
+	return path
+}
+
+func TestValidateExampleConfig(t *testing.T) {
+	diagnostics := ValidateConfigFiles("exampleDeviceManifest.yaml", "exampleCredentials.yaml")
+	assert.Empty(t, diagnostics)
+}
+
+func TestValidateReportsEveryProblemWithItsPosition(t *testing.T) {
+	manifest := writeTempFile(t, "manifest.yaml", `poll_interval: "soon"
+devices:
+  - name: "Lamp"
+    room: "Office"
+    ip: "192.168.1.10"
+    model: "HS100"
+  - name: "Lamp"
+    room: "Office"
+    ip: "192.168.1.10"
+    model: "HS999"
+  - name: "Kettle"
+    model: "P110"
+    driver: "kasa"
+  - name: "Toaster"
+    ip: "192.168.1.12"
+    colour: "red"
+`)
+	credentials := writeTempFile(t, "credentials.yaml", `tapo:
+  email: "someone@example.com"
+`)
+
+	var messages []string
+	for _, diagnostic := range ValidateConfigFiles(manifest, credentials) {
+		messages = append(messages, diagnostic.String())
+	}
+	assert.Equal(t, []string{
+		manifest + `:1:16: error: 'soon' is not a valid duration for poll_interval, e.g. "10s"`,
+		manifest + `:7:5: error: room and name 'Office Lamp' are already used by the device on line 3`,
+		manifest + `:9:9: error: ip 192.168.1.10 is already used by the device on line 5`,
+		manifest + `:10:12: error: unknown model 'HS999'`,
+		manifest + `:11:5: error: device 'Kettle' has no ip`,
+		manifest + `:13:13: error: model P110 is not supported by the kasa driver`,
+		manifest + `:14:5: error: device 'Toaster' must specify a model, a driver, or both`,
+		manifest + `:16:5: warning: unknown key 'colour' will be ignored`,
+		credentials + `:1:1: error: tapo devices are present but the tapo password is missing`,
+	}, messages)
+}
+
+func TestValidateRequiresCredentialsOnlyForTapoDevices(t *testing.T) {
+	manifest := writeTempFile(t, "manifest.yaml", `devices:
+  - name: "Lamp"
+    ip: "192.168.1.10"
+    driver: "kasa"
+`)
+	assert.Empty(t, ValidateConfigFiles(manifest, ""))
+
+	manifest = writeTempFile(t, "manifest.yaml", `devices:
+  - name: "Lamp"
+    ip: "192.168.1.10"
+    driver: "tapo"
+`)
+	diagnostics := ValidateConfigFiles(manifest, "")
+	assert.Len(t, diagnostics, 1)
+	assert.True(t, HasErrors(diagnostics))
+}
+
+func TestValidateChecksTheTapoAccountsThatDevicesUse(t *testing.T) {
+	manifest := writeTempFile(t, "manifest.yaml", `devices:
+  - name: "Kettle"
+    ip: "192.168.1.10"
+    driver: "tapo"
+    credentials: "second_household"
+  - name: "Toaster"
+    ip: "192.168.1.11"
+    driver: "tapo"
+    credentials: "third_household"
+  - name: "Lamp"
+    ip: "192.168.1.12"
+    driver: "kasa"
+    credentials: "fourth_household"
+  - name: "Heater"
+    ip: "192.168.1.13"
+    driver: "kasa"
+`)
+	credentials := writeTempFile(t, "credentials.yaml", `tapo_accounts:
+  second_household:
+    email: "someone@example.com"
+    password: "hunter2"
+    password_env: "HOMEPOWER_TEST_UNSET_PASSWORD"
+  unused:
+    email_env: "HOMEPOWER_TEST_UNSET_EMAIL"
+`)
+
+	var messages []string
+	for _, diagnostic := range ValidateConfigFiles(manifest, credentials) {
+		messages = append(messages, diagnostic.String())
+	}
+	assert.Equal(t, []string{
+		manifest + `:6:5: error: tapo account 'third_household' is not defined in the credentials file`,
+		manifest + `:10:5: error: tapo account 'fourth_household' is not defined in the credentials file`,
+		credentials + `:2:3: error: only one of password, password_env or password_file may be given`,
+		credentials + `:6:3: error: environment variable HOMEPOWER_TEST_UNSET_EMAIL for the email is not set`,
+	}, messages)
+}
+
+func TestLoadResolvesTapoAccountsFromEnvironmentAndFiles(t *testing.T) {
+	manifest := writeTempFile(t, "manifest.yaml", `credentials: "second_household"
+devices:
+  - name: "Kettle"
+    ip: "192.168.1.10"
+    model: "P110"
+  - name: "Plug"
+    ip: "192.168.1.11"
+    model: "P100"
+    credentials: "first_household"
+  - name: "Lamp"
+    ip: "192.168.1.12"
+    model: "HS100"
+`)
+	passwordFile := writeTempFile(t, "password", "from a file\n")
+	credentials := writeTempFile(t, "credentials.yaml", `tapo_accounts:
+  first_household:
+    email_env: "HOMEPOWER_TEST_EMAIL"
+    password_file: "`+passwordFile+`"
+  second_household:
+    email: "second@example.com"
+    password: "hunter2"
+`)
+	t.Setenv("HOMEPOWER_TEST_EMAIL", "first@example.com")
+	t.Setenv(TapoEmailVariable, "default@example.com")
+	t.Setenv(TapoPasswordVariable+"_FILE", passwordFile)
+
+	appConfig, err := LoadConfigAndCredentials(manifest, credentials)
+	assert.NoError(t, err)
+	assert.Equal(t, "second_household", appConfig.Devices[0].Credentials)
+	assert.Equal(t, "first_household", appConfig.Devices[1].Credentials)
+	// Kasa devices use the same account for KLAP, when they need it
+	assert.Equal(t, "second_household", appConfig.Devices[2].Credentials)
+	assert.Equal(t, Credentials{EmailAddress: "first@example.com", Password: "from a file"}, appConfig.TapoAccounts.Named["first_household"])
+	assert.Equal(t, Credentials{EmailAddress: "second@example.com", Password: "hunter2"}, appConfig.TapoAccounts.Named["second_household"])
+	assert.Equal(t, Credentials{EmailAddress: "default@example.com", Password: "from a file"}, appConfig.TapoAccounts.Default)
+}
+
+func TestFailureModeDefaultsToTheTopLevelSetting(t *testing.T) {
+	manifest := writeTempFile(t, "manifest.yaml", `failure_mode: "stale"
+devices:
+  - name: "Lamp"
+    ip: "192.168.1.10"
+    model: "HS100"
+  - name: "Kettle"
+    ip: "192.168.1.11"
+    model: "HS110"
+    failure_mode: "rogue"
+  - name: "Toaster"
+    ip: "192.168.1.12"
+    model: "HS110"
+    failure_mode: "sometimes"
+`)
+	var messages []string
+	for _, diagnostic := range ValidateConfigFiles(manifest, "") {
+		messages = append(messages, diagnostic.String())
+	}
+	assert.Equal(t, []string{manifest + `:13:19: error: unknown failure_mode 'sometimes', expected one of rogue or stale`}, messages)
+
+	manifest = writeTempFile(t, "manifest.yaml", `failure_mode: "stale"
+devices:
+  - name: "Lamp"
+    ip: "192.168.1.10"
+    model: "HS100"
+  - name: "Kettle"
+    ip: "192.168.1.11"
+    model: "HS110"
+    failure_mode: "rogue"
+`)
+	appConfig, err := LoadConfigAndCredentials(manifest, "")
+	assert.NoError(t, err)
+	assert.Equal(t, types.FailureMode(types.StaleSeries), appConfig.Devices[0].FailureMode)
+	assert.Equal(t, types.FailureMode(types.RogueValues), appConfig.Devices[1].FailureMode)
+}
+
+func TestOutletAliasesAreOnlyForPowerStrips(t *testing.T) {
+	manifest := writeTempFile(t, "manifest.yaml", `devices:
+  - name: "Desk"
+    ip: "192.168.1.10"
+    model: "HS300"
+    use_outlet_aliases: true
+  - name: "Kettle"
+    ip: "192.168.1.11"
+    model: "HS110"
+    use_outlet_aliases: yes please
+  - name: "Toaster"
+    ip: "192.168.1.12"
+    model: "HS100"
+    use_outlet_aliases: true
+`)
+	var messages []string
+	for _, diagnostic := range ValidateConfigFiles(manifest, "") {
+		messages = append(messages, diagnostic.String())
+	}
+	assert.Equal(t, []string{
+		manifest + `:9:25: error: expected use_outlet_aliases to be true or false`,
+		manifest + `:13:25: warning: use_outlet_aliases is only used by power strips`,
+	}, messages)
+
+	devices, err := ReadDeviceConfig(writeTempFile(t, "manifest.yaml", `devices:
+  - name: "Desk"
+    ip: "192.168.1.10"
+    model: "HS300"
+    use_outlet_aliases: true
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, types.DeviceType(types.KasaHS300), devices[0].Model)
+	assert.True(t, devices[0].UseOutletAliases)
+}
+
+func TestKeepConnectionOpenIsOnlyForKasaDevices(t *testing.T) {
+	manifest := writeTempFile(t, "manifest.yaml", `devices:
+  - name: "Lamp"
+    ip: "192.168.1.10"
+    model: "KL130B"
+    keep_connection_open: true
+  - name: "Heater"
+    ip: "192.168.1.11"
+    driver: "tapo"
+    keep_connection_open: true
+`)
+	var messages []string
+	for _, diagnostic := range ValidateConfigFiles(manifest, "") {
+		messages = append(messages, diagnostic.String())
+	}
+	assert.Contains(t, messages, manifest+`:9:27: warning: keep_connection_open is only used by kasa devices`)
+	assert.NotContains(t, messages, manifest+`:5:27: warning: keep_connection_open is only used by kasa devices`)
+
+	devices, err := ReadDeviceConfig(manifest)
+	assert.NoError(t, err)
+	assert.Equal(t, true, devices[0].KeepConnectionOpen)
+}
+
+func TestOutletAliasesAreNotUsedByTapoStrips(t *testing.T) {
+	manifest := writeTempFile(t, "manifest.yaml", `devices:
+  - name: "Desk"
+    ip: "192.168.1.10"
+    model: "P304M"
+    use_outlet_aliases: true
+`)
+	credentials := writeTempFile(t, "credentials.yaml", `tapo:
+  email: "someone@example.com"
+  password: "hunter2"
+`)
+	var messages []string
+	for _, diagnostic := range ValidateConfigFiles(manifest, credentials) {
+		messages = append(messages, diagnostic.String())
+	}
+	assert.Equal(t, []string{
+		manifest + `:5:25: warning: use_outlet_aliases is only used by kasa power strips; tapo strips always name each socket by its nickname`,
+	}, messages)
+}
+
+func TestValidateAcceptsHostnamesButNotMalformedAddresses(t *testing.T) {
+	manifest := writeTempFile(t, "manifest.yaml", `devices:
+  - name: "Lamp"
+    room: "Office"
+    ip: "office-lamp.home.arpa"
+    model: "HS100"
+  - name: "Kettle"
+    room: "Kitchen"
+    ip: "kettle"
+    model: "HS100"
+  - name: "Toaster"
+    room: "Kitchen"
+    ip: "192.168.1.300:9999"
+    model: "HS100"
+`)
+
+	var messages []string
+	for _, diagnostic := range ValidateConfigFiles(manifest, "") {
+		messages = append(messages, diagnostic.String())
+	}
+	assert.Equal(t, []string{
+		manifest + `:12:9: error: '192.168.1.300:9999' is neither an IP address nor a hostname`,
+	}, messages)
+}
+
+func TestDevicesAreOnlyDuplicatesWhenBothRoomAndNameMatch(t *testing.T) {
+	manifest := writeTempFile(t, "manifest.yaml", `devices:
+  - name: "Bedroom Lamp"
+    room: "Back"
+    ip: "192.168.1.10"
+    model: "HS100"
+  - name: "Lamp"
+    room: "Back Bedroom"
+    ip: "192.168.1.11"
+    model: "HS100"
+`)
+	assert.Empty(t, ValidateConfigFiles(manifest, ""))
+}
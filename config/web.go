@@ -0,0 +1,145 @@
+package config
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// for example:
+// HOMEPOWER_LISTEN_ADDRESS=127.0.0.1:9981
+// HOMEPOWER_WEB_CONFIG_FILEPATH=config/exampleWebConfig.yaml
+const ListenAddressVariable = "HOMEPOWER_LISTEN_ADDRESS"
+const WebConfigFilepathVariable = "HOMEPOWER_WEB_CONFIG_FILEPATH"
+
+const defaultListenAddress = ":9981"
+
+// WebConfig follows the layout of the Prometheus web config file (as used by --web.config.file in Prometheus and its
+// exporters), so the same file and tooling can be shared.  BearerTokens is an addition for clients that cannot send
+// basic auth.  The listen address is not part of that file, so only comes from HOMEPOWER_LISTEN_ADDRESS.
+type WebConfig struct {
+	ListenAddress   string            `yaml:"-"`
+	TLSServerConfig *TLSServerConfig  `yaml:"tls_server_config"`
+	BasicAuthUsers  map[string]string `yaml:"basic_auth_users"` // username to bcrypt hash of the password
+	BearerTokens    []string          `yaml:"bearer_tokens"`
+}
+
+type TLSServerConfig struct {
+	CertFile       string `yaml:"cert_file"`
+	KeyFile        string `yaml:"key_file"`
+	ClientAuthType string `yaml:"client_auth_type"`
+	ClientCAFile   string `yaml:"client_ca_file"`
+	MinVersion     string `yaml:"min_version"`
+	MaxVersion     string `yaml:"max_version"`
+}
+
+func (wc *WebConfig) RequiresAuthentication() bool {
+	return len(wc.BasicAuthUsers) > 0 || len(wc.BearerTokens) > 0
+}
+
+func ReadWebConfigFromEnvironment() (*WebConfig, error) {
+	webConfig := &WebConfig{}
+	if webConfigFilepath := os.Getenv(WebConfigFilepathVariable); webConfigFilepath != "" {
+		var err error
+		if webConfig, err = ReadWebConfig(webConfigFilepath); err != nil {
+			return nil, err
+		}
+	}
+	webConfig.ListenAddress = os.Getenv(ListenAddressVariable)
+	if webConfig.ListenAddress == "" {
+		webConfig.ListenAddress = defaultListenAddress
+	}
+	return webConfig, nil
+}
+
+func ReadWebConfig(filename string) (*WebConfig, error) {
+	fileBytes, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not read web config file '%s': %w", filename, err)
+	}
+	webConfig := &WebConfig{}
+	decoder := yaml.NewDecoder(bytes.NewReader(fileBytes))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(webConfig); err != nil {
+		return nil, fmt.Errorf("could not unmarshal web config file yaml '%s': %w", filename, err)
+	}
+	if tlsConfig := webConfig.TLSServerConfig; tlsConfig != nil {
+		if tlsConfig.CertFile == "" || tlsConfig.KeyFile == "" {
+			return nil, errors.New("tls_server_config needs both cert_file and key_file")
+		}
+		// Relative paths are resolved against the web config file, as Prometheus does
+		tlsConfig.CertFile = resolveRelativeTo(filename, tlsConfig.CertFile)
+		tlsConfig.KeyFile = resolveRelativeTo(filename, tlsConfig.KeyFile)
+		tlsConfig.ClientCAFile = resolveRelativeTo(filename, tlsConfig.ClientCAFile)
+		if _, err := tlsConfig.ClientAuth(); err != nil {
+			return nil, err
+		}
+		if _, err := tlsVersion(tlsConfig.MinVersion); err != nil {
+			return nil, err
+		}
+		if _, err := tlsVersion(tlsConfig.MaxVersion); err != nil {
+			return nil, err
+		}
+	}
+	for _, token := range webConfig.BearerTokens {
+		if token == "" {
+			return nil, errors.New("bearer_tokens must not contain empty tokens")
+		}
+	}
+	return webConfig, nil
+}
+
+func resolveRelativeTo(configFilename string, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(configFilename), path)
+}
+
+func (tc *TLSServerConfig) ClientAuth() (tls.ClientAuthType, error) {
+	switch tc.ClientAuthType {
+	case "", "NoClientCert":
+		return tls.NoClientCert, nil
+	case "RequestClientCert":
+		return tls.RequestClientCert, nil
+	case "RequireAnyClientCert", "RequireClientCert":
+		return tls.RequireAnyClientCert, nil
+	case "VerifyClientCertIfGiven":
+		return tls.VerifyClientCertIfGiven, nil
+	case "RequireAndVerifyClientCert":
+		return tls.RequireAndVerifyClientCert, nil
+	default:
+		return tls.NoClientCert, errors.New("unknown client_auth_type " + tc.ClientAuthType)
+	}
+}
+
+func (tc *TLSServerConfig) Versions() (minVersion uint16, maxVersion uint16) {
+	minVersion, _ = tlsVersion(tc.MinVersion)
+	maxVersion, _ = tlsVersion(tc.MaxVersion)
+	if minVersion == 0 {
+		minVersion = tls.VersionTLS12
+	}
+	return minVersion, maxVersion
+}
+
+func tlsVersion(name string) (uint16, error) {
+	switch name {
+	case "":
+		return 0, nil
+	case "TLS10":
+		return tls.VersionTLS10, nil
+	case "TLS11":
+		return tls.VersionTLS11, nil
+	case "TLS12":
+		return tls.VersionTLS12, nil
+	case "TLS13":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, errors.New("unknown TLS version " + name)
+	}
+}
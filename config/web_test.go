@@ -0,0 +1,46 @@
+package config
+
+import (
+	"crypto/tls"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadExampleWebConfig(t *testing.T) {
+	webConfig, err := ReadWebConfig("exampleWebConfig.yaml")
+	assert.NoError(t, err)
+	assert.Nil(t, webConfig.TLSServerConfig)
+	assert.Contains(t, webConfig.BasicAuthUsers, "prometheus")
+	assert.True(t, webConfig.RequiresAuthentication())
+}
+
+func TestReadWebConfigResolvesTlsFilesRelativeToTheConfig(t *testing.T) {
+	file := writeTempFile(t, "web.yaml", `tls_server_config:
+  cert_file: "server.crt"
+  key_file: "/etc/homepower/server.key"
+  min_version: "TLS13"
+`)
+	webConfig, err := ReadWebConfig(file)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(filepath.Dir(file), "server.crt"), webConfig.TLSServerConfig.CertFile)
+	assert.Equal(t, "/etc/homepower/server.key", webConfig.TLSServerConfig.KeyFile)
+	minVersion, _ := webConfig.TLSServerConfig.Versions()
+	assert.Equal(t, uint16(tls.VersionTLS13), minVersion)
+	assert.False(t, webConfig.RequiresAuthentication())
+}
+
+func TestReadWebConfigRejectsMistakes(t *testing.T) {
+	for _, contents := range []string{
+		"basic_auth_user:\n  prometheus: \"hash\"\n",
+		"tls_server_config:\n  cert_file: \"server.crt\"\n",
+		"tls_server_config:\n  cert_file: \"a\"\n  key_file: \"b\"\n  client_auth_type: \"Sometimes\"\n",
+		"tls_server_config:\n  cert_file: \"a\"\n  key_file: \"b\"\n  min_version: \"SSL3\"\n",
+		"bearer_tokens:\n  - \"\"\n",
+		"listenaddress: \"127.0.0.1:9981\"\n",
+	} {
+		_, err := ReadWebConfig(writeTempFile(t, "web.yaml", contents))
+		assert.Error(t, err, contents)
+	}
+}
@@ -1,76 +1,222 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"homepower/types"
 	"log"
 	"os"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
-func ReadConfigAndCredentials() *AppConfig {
-	// for example:
-	// HOMEPOWER_DEVICE_CONFIG_FILEPATH=config/exampleDeviceManifest.yaml
-	// HOMEPOWER_CREDENTIAL_FILEPATH=config/exampleCredentials.yaml
-	deviceConfigFilepath := os.Getenv("HOMEPOWER_DEVICE_CONFIG_FILEPATH")
-	credentialFilepath := os.Getenv("HOMEPOWER_CREDENTIAL_FILEPATH")
-	if deviceConfigFilepath == "" || credentialFilepath == "" {
-		panic("environment variables for config file locations have not been set")
+// for example:
+// HOMEPOWER_DEVICE_CONFIG_FILEPATH=config/exampleDeviceManifest.yaml
+// HOMEPOWER_CREDENTIAL_FILEPATH=config/exampleCredentials.yaml
+const DeviceConfigFilepathVariable = "HOMEPOWER_DEVICE_CONFIG_FILEPATH"
+const CredentialFilepathVariable = "HOMEPOWER_CREDENTIAL_FILEPATH"
+
+// ConfigFilepathsFromEnvironment requires the device manifest to be given, but not the credentials file, as the
+// default Tapo account can come from the environment instead
+func ConfigFilepathsFromEnvironment() (deviceConfigFilepath string, credentialFilepath string, err error) {
+	deviceConfigFilepath = os.Getenv(DeviceConfigFilepathVariable)
+	credentialFilepath = os.Getenv(CredentialFilepathVariable)
+	if deviceConfigFilepath == "" {
+		return "", "", errors.New("environment variable " + DeviceConfigFilepathVariable + " for the device config file location has not been set")
+	}
+	return deviceConfigFilepath, credentialFilepath, nil
+}
+
+// LoadConfigAndCredentials validates and then reads both config files, returning an error rather than panicking so
+// that it is safe to call again while the exporter is running
+func LoadConfigAndCredentials(deviceConfigFilepath string, credentialFilepath string) (*AppConfig, error) {
+	diagnostics := ValidateConfigFiles(deviceConfigFilepath, credentialFilepath)
+	for _, diagnostic := range diagnostics {
+		log.Println(diagnostic.String())
+	}
+	if HasErrors(diagnostics) {
+		return nil, errors.New("config files are not valid, see the errors above")
 	}
 
 	appConfig := &AppConfig{}
-	readDeviceConfig(appConfig, deviceConfigFilepath)
-	readCredentials(appConfig, credentialFilepath)
+	if err := readDeviceConfig(appConfig, deviceConfigFilepath); err != nil {
+		return nil, err
+	}
+	if err := readCredentials(appConfig, credentialFilepath); err != nil {
+		return nil, err
+	}
 	log.Printf("Using device config: %+v\n", appConfig.Devices)
-	return appConfig
+	return appConfig, nil
+}
+
+// ReadDeviceConfig reads only the device manifest, for tools that need to know which devices are configured but will
+// not connect to them
+func ReadDeviceConfig(deviceConfigFilepath string) ([]types.DeviceConfig, error) {
+	appConfig := &AppConfig{}
+	if err := readDeviceConfig(appConfig, deviceConfigFilepath); err != nil {
+		return nil, err
+	}
+	return appConfig.Devices, nil
 }
 
-func readDeviceConfig(appConfig *AppConfig, filepath string) {
+const defaultPollInterval = 10 * time.Second
+const defaultPollJitter = 2 * time.Second
+
+func readDeviceConfig(appConfig *AppConfig, filepath string) error {
 	type deviceFromFile struct {
-		Name   string `yaml:"name"`
-		Room   string `yaml:"room"`
-		Ip     string `yaml:"ip"`
-		Model  string `yaml:"model"`
-		Driver string `yaml:"driver"`
+		Name         string `yaml:"name"`
+		Room         string `yaml:"room"`
+		Ip           string `yaml:"ip"`
+		Model        string `yaml:"model"`
+		Driver       string `yaml:"driver"`
+		PollInterval string `yaml:"poll_interval"`
+		PollJitter   string `yaml:"poll_jitter"`
+		Credentials  string `yaml:"credentials"`
+		FailureMode  string `yaml:"failure_mode"`
+		// only for power strips
+		UseOutletAliases bool `yaml:"use_outlet_aliases"`
+		// only for kasa devices
+		KeepConnectionOpen bool `yaml:"keep_connection_open"`
 	}
 	type devicesConfigFile struct {
-		Devices []deviceFromFile `yaml:"devices"`
+		Credentials  string           `yaml:"credentials"`
+		FailureMode  string           `yaml:"failure_mode"`
+		PollInterval string           `yaml:"poll_interval"`
+		PollJitter   string           `yaml:"poll_jitter"`
+		Devices      []deviceFromFile `yaml:"devices"`
 	}
 	devicesFromYaml := devicesConfigFile{}
-	readConfig(filepath, &devicesFromYaml)
+	if err := readConfig(filepath, &devicesFromYaml); err != nil {
+		return err
+	}
+	globalPollInterval, err := parseDurationOrDefault(devicesFromYaml.PollInterval, defaultPollInterval, "poll_interval")
+	if err != nil {
+		return err
+	}
+	globalPollJitter, err := parseDurationOrDefault(devicesFromYaml.PollJitter, defaultPollJitter, "poll_jitter")
+	if err != nil {
+		return err
+	}
+	globalFailureMode, err := types.FailureModeForName(devicesFromYaml.FailureMode)
+	if err != nil {
+		return err
+	}
 	appConfig.Devices = make([]types.DeviceConfig, 0, len(devicesFromYaml.Devices))
 	for _, device := range devicesFromYaml.Devices {
+		pollInterval, err := parseDurationOrDefault(device.PollInterval, globalPollInterval, "poll_interval for "+device.Ip)
+		if err != nil {
+			return err
+		}
+		if pollInterval == 0 {
+			return errors.New("poll_interval for " + device.Ip + " must be greater than zero")
+		}
+		pollJitter, err := parseDurationOrDefault(device.PollJitter, globalPollJitter, "poll_jitter for "+device.Ip)
+		if err != nil {
+			return err
+		}
+		model, driver, err := resolveModelAndDriver(device.Model, device.Driver, device.Ip)
+		if err != nil {
+			return err
+		}
+		failureMode := globalFailureMode
+		if device.FailureMode != "" {
+			if failureMode, err = types.FailureModeForName(device.FailureMode); err != nil {
+				return fmt.Errorf("invalid failure_mode for %s: %w", device.Ip, err)
+			}
+		}
+		credentials := device.Credentials
+		if credentials == "" {
+			credentials = devicesFromYaml.Credentials
+		}
 		appConfig.Devices = append(appConfig.Devices, types.DeviceConfig{
-			Name:  device.Name,
-			Room:  device.Room,
-			Model: types.DeviceTypeFor(device.Model),
-			Ip:    device.Ip,
+			Name:         device.Name,
+			Room:         device.Room,
+			Model:        model,
+			Driver:       driver,
+			Ip:           device.Ip,
+			PollInterval: pollInterval,
+			PollJitter:   pollJitter,
+			Credentials:  credentials,
+			FailureMode:  failureMode,
+
+			UseOutletAliases:   device.UseOutletAliases,
+			KeepConnectionOpen: device.KeepConnectionOpen,
 		})
 	}
+	return nil
+}
+
+func resolveModelAndDriver(modelName string, driverName string, ip string) (types.DeviceType, types.DeviceDriver, error) {
+	driver, err := types.DriverForName(driverName)
+	if err != nil {
+		return types.UnknownModel, types.Unknown, fmt.Errorf("invalid driver for %s: %w", ip, err)
+	}
+	if modelName == "" {
+		if driver == types.Unknown {
+			return types.UnknownModel, types.Unknown, errors.New("device " + ip + " must specify a model, a driver, or both")
+		}
+		return types.UnknownModel, driver, nil
+	}
+	model, found := types.LookupDeviceType(modelName)
+	if !found {
+		return types.UnknownModel, types.Unknown, errors.New("model name " + modelName + " for " + ip + " does not correspond to a known device type")
+	}
+	if driver == types.Unknown {
+		return model, types.DriverFor(model), nil
+	}
+	if types.DriverFor(model) != driver {
+		return types.UnknownModel, types.Unknown, errors.New("device " + ip + " is configured with driver " + driverName + " but model " + modelName + " is not supported by that driver")
+	}
+	return model, driver, nil
 }
 
-func readCredentials(config *AppConfig, filepath string) {
-	type emailAndPassword struct {
-		Email    string `yaml:"email"`
-		Password string `yaml:"password"`
+func parseDurationOrDefault(value string, defaultValue time.Duration, description string) (time.Duration, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("could not parse %s '%s' as a duration: %w", description, value, err)
 	}
+	if duration < 0 {
+		return 0, fmt.Errorf("%s must not be negative, but was '%s'", description, value)
+	}
+	return duration, nil
+}
+
+func readCredentials(config *AppConfig, filepath string) error {
 	type credentialsFromFile struct {
-		Tapo emailAndPassword `yaml:"tapo"`
+		Tapo         credentialSource            `yaml:"tapo"`
+		TapoAccounts map[string]credentialSource `yaml:"tapo_accounts"`
 	}
 	credentials := credentialsFromFile{}
-	readConfig(filepath, &credentials)
-	config.TapoCredentials.EmailAddress = credentials.Tapo.Email
-	config.TapoCredentials.Password = credentials.Tapo.Password
+	if filepath != "" {
+		if err := readConfig(filepath, &credentials); err != nil {
+			return err
+		}
+	}
+	var err error
+	if config.TapoAccounts.Default, err = credentials.Tapo.withEnvironmentOverrides().resolve(); err != nil {
+		return fmt.Errorf("could not read the default tapo account: %w", err)
+	}
+	config.TapoAccounts.Named = make(map[string]Credentials, len(credentials.TapoAccounts))
+	for name, source := range credentials.TapoAccounts {
+		if config.TapoAccounts.Named[name], err = source.resolve(); err != nil {
+			return fmt.Errorf("could not read tapo account %s: %w", name, err)
+		}
+	}
+	return nil
 }
 
-func readConfig[E any](filename string, into *E) {
+func readConfig[E any](filename string, into *E) error {
 	fileBytes, err := os.ReadFile(filename)
 	if err != nil {
-		panic(fmt.Errorf("could not read config file '%s': %w", filename, err))
+		return fmt.Errorf("could not read config file '%s': %w", filename, err)
 	}
 	err = yaml.Unmarshal(fileBytes, into)
 	if err != nil {
-		panic(fmt.Errorf("could not unmarshal config file yaml '%s': %w", filename, err))
+		return fmt.Errorf("could not unmarshal config file yaml '%s': %w", filename, err)
 	}
+	return nil
 }
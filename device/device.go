@@ -1,22 +1,103 @@
 package device
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"homepower/config"
 	"homepower/device/kasa"
 	"homepower/device/tapo"
 	"homepower/types"
+	"log"
+	"net"
+	"strconv"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-func Factory(deviceConfig types.DeviceConfig, tapoCredentials *config.Credentials, registry prometheus.Registerer) (types.PollableDevice, error) {
-	switch types.DriverFor(deviceConfig.Model) {
+const modelProbeTimeout = 20 * time.Second
+const reachabilityProbeTimeout = 2 * time.Second
+
+// Factory creates the driver for a device whose model is known, or (for Tapo) has been looked for with DetectModel
+func Factory(deviceConfig types.DeviceConfig, tapoAccounts *config.TapoAccounts, registry prometheus.Registerer) (types.PollableDevice, error) {
+	if deviceConfig.Driver == types.Unknown {
+		deviceConfig.Driver = types.DriverFor(deviceConfig.Model)
+	}
+	// Kasa devices only need an account for KLAP, so may be left with an empty default account
+	tapoCredentials, err := tapoAccounts.For(deviceConfig.Credentials)
+	if err != nil {
+		return nil, err
+	}
+	switch deviceConfig.Driver {
 	case types.Kasa:
-		return kasa.NewDevice(&deviceConfig, registry), nil
+		return kasa.NewDevice(tapoCredentials.EmailAddress, tapoCredentials.Password, &deviceConfig, registry), nil
 	case types.Tapo:
-		return tapo.NewDevice(tapoCredentials.EmailAddress, tapoCredentials.Password, &deviceConfig, registry, 80)
+		return tapo.NewDevice(tapoCredentials.EmailAddress, tapoCredentials.Password, &deviceConfig, registry, tapo.Port)
 	default:
 		return nil, errors.New("unknown device type")
 	}
 }
+
+// DetectModel asks a device that the manifest gives only a driver for which model it is.  A Tapo device reporting a
+// model that is not known keeps UnknownModel, as its features are negotiated with it instead.
+func DetectModel(ctx context.Context, deviceConfig types.DeviceConfig, tapoAccounts *config.TapoAccounts) (types.DeviceConfig, error) {
+	tapoCredentials, err := tapoAccounts.For(deviceConfig.Credentials)
+	if err != nil {
+		return deviceConfig, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, modelProbeTimeout)
+	defer cancel()
+
+	var reportedModel string
+	switch deviceConfig.Driver {
+	case types.Kasa:
+		reportedModel, err = kasa.ProbeModel(ctx, tapoCredentials.EmailAddress, tapoCredentials.Password, deviceConfig.Ip)
+	case types.Tapo:
+		reportedModel, err = tapo.ProbeModel(ctx, tapoCredentials.EmailAddress, tapoCredentials.Password, deviceConfig.Ip, tapo.Port)
+	default:
+		return deviceConfig, errors.New("a driver is needed to detect the model of a device")
+	}
+	if err != nil {
+		return deviceConfig, fmt.Errorf("could not detect model: %w", err)
+	}
+
+	detectedModel, found := types.DeviceTypeForReportedModel(reportedModel)
+	if !found && deviceConfig.Driver == types.Tapo {
+		// Tapo devices list their own features, so a model that is not known is polled for whatever it has
+		log.Printf("Detected %s %s (%s) as model %s, which is not known, so its features will be negotiated with it\n", deviceConfig.Room, deviceConfig.Name, deviceConfig.Ip, reportedModel)
+		return deviceConfig, nil
+	}
+	if !found {
+		return deviceConfig, errors.New("device reported model " + reportedModel + " which is not supported")
+	}
+	if types.DriverFor(detectedModel) != deviceConfig.Driver {
+		return deviceConfig, errors.New("device reported model " + reportedModel + " which is not supported by the configured driver")
+	}
+	log.Printf("Detected %s %s (%s) as model %s\n", deviceConfig.Room, deviceConfig.Name, deviceConfig.Ip, reportedModel)
+	deviceConfig.Model = detectedModel
+	return deviceConfig, nil
+}
+
+// ProbeReachable checks whether anything accepts a TCP connection on the device's API port, which is far cheaper than
+// a poll and, for devices using KLAP or securePassthrough, does not start a handshake
+func ProbeReachable(ctx context.Context, deviceConfig types.DeviceConfig) error {
+	var ports []int
+	switch deviceConfig.Driver {
+	case types.Kasa:
+		ports = []int{kasa.Port, kasa.KlapPort}
+	case types.Tapo:
+		ports = []int{tapo.Port}
+	default:
+		return errors.New("unknown device type")
+	}
+	dialer := net.Dialer{Timeout: reachabilityProbeTimeout}
+	var err error
+	for _, port := range ports {
+		var connection net.Conn
+		if connection, err = dialer.DialContext(ctx, "tcp", net.JoinHostPort(deviceConfig.Ip, strconv.Itoa(port))); err == nil {
+			return connection.Close()
+		}
+	}
+	return fmt.Errorf("could not connect to device: %w", err)
+}
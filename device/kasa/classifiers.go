@@ -3,19 +3,45 @@ package kasa
 import "homepower/types"
 
 func isSwitch(config *types.DeviceConfig) bool {
-	return config.Model == types.KasaHS100 || config.Model == types.KasaHS110 || config.Model == types.KasaKP115
+	return config.Model == types.KasaHS100 || config.Model == types.KasaHS110 || config.Model == types.KasaKP115 || isDimmer(config)
+}
+
+// isDimmer is true for wall dimmers, which have a relay like a plug but also a brightness, set via smartlife.iot.dimmer
+func isDimmer(config *types.DeviceConfig) bool {
+	return config.Model == types.KasaHS220 || config.Model == types.KasaKS230
+}
+
+// isStrip is true for power strips, which report a relay per outlet in the children of their sysinfo
+func isStrip(config *types.DeviceConfig) bool {
+	return types.HasOutlets(config.Model)
+}
+
+// hasOutletEMeter is true for power strips that measure each outlet, queried with a child_ids context
+func hasOutletEMeter(config *types.DeviceConfig) bool {
+	return config.Model == types.KasaHS300
 }
 
 func isLight(config *types.DeviceConfig) bool {
-	return config.Model == types.KasaKL50B || config.Model == types.KasaKL110B || config.Model == types.KasaKL130B
+	return config.Model == types.KasaKL50B || config.Model == types.KasaKL110B || config.Model == types.KasaKL130B || isLightStrip(config)
+}
+
+// isLightStrip is true for LED strips, which are lights controlled via smartlife.iot.lightStrip and can run effects
+func isLightStrip(config *types.DeviceConfig) bool {
+	return config.Model == types.KasaKL400 || config.Model == types.KasaKL430
+}
+
+// hasLampDetails is true for bulbs, which describe their lamp (beam angle, wattage, ...) in get_light_details
+func hasLampDetails(config *types.DeviceConfig) bool {
+	return isLight(config) && !isLightStrip(config)
 }
 
+// isLightVariableTemperature is true for lights whose white can be set warmer or cooler; the KL400 strip's cannot
 func isLightVariableTemperature(config *types.DeviceConfig) bool {
-	return config.Model == types.KasaKL130B
+	return config.Model == types.KasaKL130B || config.Model == types.KasaKL430
 }
 
 func isLightColoured(config *types.DeviceConfig) bool {
-	return config.Model == types.KasaKL130B
+	return config.Model == types.KasaKL130B || isLightStrip(config)
 }
 
 func hasPowerMonitoring(config *types.DeviceConfig) bool {
@@ -0,0 +1,263 @@
+package kasa
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"homepower/types"
+	"slices"
+	"strconv"
+)
+
+const systemModule = "system"
+const lightingServiceModule = "smartlife.iot.smartbulb.lightingservice"
+const lightStripModule = "smartlife.iot.lightStrip"
+const dimmerModule = "smartlife.iot.dimmer"
+
+func (dev *Device) SetRelay(ctx context.Context, on bool) error {
+	if !isSwitch(dev.deviceConfig) {
+		return fmt.Errorf("could not switch relay: %w", types.ErrNotSupported)
+	}
+	dev.mutex.Lock()
+	defer dev.mutex.Unlock()
+	if err := dev.sendCommand(ctx, systemModule, "set_relay_state", map[string]any{"state": boolToInt(on)}, nil); err != nil {
+		return fmt.Errorf("could not switch relay: %w", err)
+	}
+	return dev.updateLastReport(func(report *periodicDeviceReport) {
+		if report.smartPlugInfo != nil && report.RelayOn != on {
+			report.RelayOn = on
+			report.OnTime = 0
+		}
+	})
+}
+
+func (dev *Device) SetLed(ctx context.Context, on bool) error {
+	if !isSwitch(dev.deviceConfig) && !isStrip(dev.deviceConfig) {
+		return fmt.Errorf("could not switch LED: %w", types.ErrNotSupported)
+	}
+	dev.mutex.Lock()
+	defer dev.mutex.Unlock()
+	if err := dev.sendCommand(ctx, systemModule, "set_led_off", map[string]any{"off": boolToInt(!on)}, nil); err != nil {
+		return fmt.Errorf("could not switch LED: %w", err)
+	}
+	return dev.updateLastReport(func(report *periodicDeviceReport) {
+		if report.smartPlugInfo != nil {
+			report.smartPlugInfo.LedOn = on
+		}
+		if report.powerStripInfo != nil {
+			report.powerStripInfo.LedOn = on
+		}
+	})
+}
+
+func (dev *Device) SetLightState(ctx context.Context, state types.LightState) error {
+	if isDimmer(dev.deviceConfig) {
+		return dev.setDimmerState(ctx, state)
+	}
+	if !isLight(dev.deviceConfig) {
+		return fmt.Errorf("could not set light state: %w", types.ErrNotSupported)
+	}
+	params, err := transitionLightStateParams(dev.deviceConfig, state)
+	if err != nil {
+		return fmt.Errorf("could not set light state: %w", err)
+	}
+	module, method := lightingServiceModule, "transition_light_state"
+	if isLightStrip(dev.deviceConfig) {
+		module, method = lightStripModule, "set_light_state"
+	}
+	dev.mutex.Lock()
+	defer dev.mutex.Unlock()
+	var reply lightState
+	if err := dev.sendCommand(ctx, module, method, params, &reply); err != nil {
+		return fmt.Errorf("could not set light state: %w", err)
+	}
+	// The reply holds the bulb's new light_state, so there is no need to guess what it has done
+	var decodeErrors types.DecodeErrors
+	defer func() { dev.recordDecodeErrors(decodeErrors) }()
+	return dev.updateLastReport(func(report *periodicDeviceReport) {
+		if reply.OnOff.Present && report.smartBulbInfo != nil {
+			applyLightState(report.smartBulbInfo, reply, module+"."+method, &decodeErrors)
+		}
+	})
+}
+
+// setDimmerState switches a dimmer's relay and sets its level, which it fades to over the transition period if one is
+// given; a dimmer has no colour
+func (dev *Device) setDimmerState(ctx context.Context, state types.LightState) error {
+	if state.Hue != nil || state.Saturation != nil || state.ColourTemperature != nil {
+		return fmt.Errorf("could not set dimmer state: colour: %w", types.ErrNotSupported)
+	}
+	if state.Brightness != nil && (*state.Brightness < 0 || *state.Brightness > 100) {
+		return fmt.Errorf("could not set dimmer state: brightness must be between 0 and 100: %w", types.ErrInvalidValue)
+	}
+	dev.mutex.Lock()
+	defer dev.mutex.Unlock()
+	err := dev.connection.openNewConnection(ctx)
+	defer dev.connection.closeCurrentConnection()
+	if err != nil {
+		return fmt.Errorf("could not set dimmer state: could not create connection: %w", err)
+	}
+	if state.Brightness != nil {
+		if state.TransitionPeriod > 0 {
+			err = dev.callMethod(ctx, dimmerModule, "set_dimmer_transition",
+				map[string]any{"brightness": *state.Brightness, "duration": state.TransitionPeriod.Milliseconds()}, nil)
+		} else {
+			err = dev.callMethod(ctx, dimmerModule, "set_brightness", map[string]any{"brightness": *state.Brightness}, nil)
+		}
+		if err != nil {
+			return fmt.Errorf("could not set dimmer state: %w", err)
+		}
+	}
+	if state.On != nil {
+		if err = dev.callMethod(ctx, systemModule, "set_relay_state", map[string]any{"state": boolToInt(*state.On)}, nil); err != nil {
+			return fmt.Errorf("could not set dimmer state: %w", err)
+		}
+	}
+	return dev.updateLastReport(func(report *periodicDeviceReport) {
+		if report.dimmerInfo != nil && state.Brightness != nil {
+			report.Level = *state.Brightness
+		}
+		if report.smartPlugInfo != nil && state.On != nil && report.RelayOn != *state.On {
+			report.RelayOn = *state.On
+			report.OnTime = 0
+		}
+	})
+}
+
+func transitionLightStateParams(config *types.DeviceConfig, state types.LightState) (map[string]any, error) {
+	params := map[string]any{
+		"ignore_default":    1,
+		"transition_period": state.TransitionPeriod.Milliseconds(),
+	}
+	if state.On != nil {
+		params["on_off"] = boolToInt(*state.On)
+	}
+	if state.Brightness != nil {
+		if *state.Brightness < 0 || *state.Brightness > 100 {
+			return nil, fmt.Errorf("brightness must be between 0 and 100: %w", types.ErrInvalidValue)
+		}
+		params["brightness"] = *state.Brightness
+	}
+	if state.Hue != nil || state.Saturation != nil {
+		if !isLightColoured(config) {
+			return nil, fmt.Errorf("hue and saturation: %w", types.ErrNotSupported)
+		}
+		if state.Hue != nil {
+			if *state.Hue < 0 || *state.Hue > 360 {
+				return nil, fmt.Errorf("hue must be between 0 and 360: %w", types.ErrInvalidValue)
+			}
+			params["hue"] = *state.Hue
+		}
+		if state.Saturation != nil {
+			if *state.Saturation < 0 || *state.Saturation > 100 {
+				return nil, fmt.Errorf("saturation must be between 0 and 100: %w", types.ErrInvalidValue)
+			}
+			params["saturation"] = *state.Saturation
+		}
+		// A bulb stays in white mode, ignoring the hue, for as long as it has a colour temperature
+		params["color_temp"] = 0
+	}
+	if state.ColourTemperature != nil {
+		if !isLightVariableTemperature(config) {
+			return nil, fmt.Errorf("colour temperature: %w", types.ErrNotSupported)
+		}
+		if *state.ColourTemperature < 2500 || *state.ColourTemperature > 9000 {
+			return nil, fmt.Errorf("colour temperature must be between 2500 and 9000: %w", types.ErrInvalidValue)
+		}
+		params["color_temp"] = *state.ColourTemperature
+	}
+	return params, nil
+}
+
+// sendCommand sends one method call on its own connection and decodes its reply, having checked the err_code, into
+// reply unless that is nil.  The caller must hold the device's mutex.
+func (dev *Device) sendCommand(ctx context.Context, module string, method string, params map[string]any, reply any) error {
+	err := dev.connection.openNewConnection(ctx)
+	defer dev.connection.closeCurrentConnection()
+	if err != nil {
+		return fmt.Errorf("could not create connection: %w", err)
+	}
+	return dev.callMethod(ctx, module, method, params, reply)
+}
+
+// errNonZeroErrCode is wrapped by callMethod when the device understood the request but refused it, for example
+// because its model does not have the method
+var errNonZeroErrCode = errors.New("device returned non-zero err_code")
+
+// callMethod sends one method call on the connection that is already open and decodes its reply into reply, unless
+// that is nil
+func (dev *Device) callMethod(ctx context.Context, module string, method string, params map[string]any, reply any) error {
+	request, err := json.Marshal(map[string]map[string]any{module: {method: params}})
+	if err != nil {
+		return fmt.Errorf("could not marshal request: %w", err)
+	}
+	responseJson, err := dev.connection.queryDevice(ctx, string(request))
+	if err != nil {
+		return fmt.Errorf("could not send %s: %w", method, err)
+	}
+	var response map[string]map[string]json.RawMessage
+	if err := json.Unmarshal(responseJson, &response); err != nil {
+		return fmt.Errorf("could not unmarshal %s response: %w", method, err)
+	}
+	data, found := response[module][method]
+	if !found {
+		return errors.New("response did not contain a reply to " + method)
+	}
+	var common methodReply
+	if err := json.Unmarshal(data, &common); err != nil {
+		return fmt.Errorf("could not unmarshal reply to %s: %w", method, err)
+	}
+	if !common.ErrCode.Present || common.ErrCode.Err != nil {
+		return errors.New("reply to " + method + " did not contain an err_code")
+	}
+	if common.ErrCode.Value != 0 {
+		return fmt.Errorf("%s: %w %s (%s)", method, errNonZeroErrCode, strconv.Itoa(common.ErrCode.Value), common.ErrMsg.Value)
+	}
+	if reply != nil {
+		if err := json.Unmarshal(data, reply); err != nil {
+			return fmt.Errorf("could not unmarshal reply to %s: %w", method, err)
+		}
+	}
+	return nil
+}
+
+// updateLastReport applies a change that a command is known to have made to a copy of the last report, and puts the
+// result into the metrics straight away.  Before the first poll there is nothing to update.
+func (dev *Device) updateLastReport(change func(report *periodicDeviceReport)) error {
+	last := dev.lastReport.Load()
+	if last == nil {
+		return nil
+	}
+	report := *last
+	if last.smartPlugInfo != nil {
+		plugInfo := *last.smartPlugInfo
+		report.smartPlugInfo = &plugInfo
+	}
+	if last.smartBulbInfo != nil {
+		bulbInfo := *last.smartBulbInfo
+		report.smartBulbInfo = &bulbInfo
+	}
+	if last.dimmerInfo != nil {
+		dimmerInfo := *last.dimmerInfo
+		report.dimmerInfo = &dimmerInfo
+	}
+	if last.powerStripInfo != nil {
+		stripInfo := *last.powerStripInfo
+		stripInfo.Outlets = slices.Clone(last.Outlets)
+		report.powerStripInfo = &stripInfo
+	}
+	change(&report)
+	if err := dev.metrics.updateMetrics(&report); err != nil {
+		return fmt.Errorf("could not update metrics after command: %w", err)
+	}
+	dev.lastReport.Store(&report)
+	return nil
+}
+
+func boolToInt(value bool) int {
+	if value {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,102 @@
+package kasa
+
+import (
+	"context"
+	"encoding/json"
+	"homepower/types"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// serveLinkie answers each request on the listener with the replies for each of its modules and methods, combined
+// into one as a device does
+func serveLinkie(t *testing.T, listener net.Listener, replies map[string]string) {
+	for {
+		connection, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer connection.Close()
+			for {
+				// Requests may arrive together, so each is read by its length
+				buffer := make([]byte, 4)
+				if _, err := io.ReadFull(connection, buffer); err != nil {
+					return
+				}
+				buffer = append(buffer, make([]byte, expectedLinkiePacketSize(buffer))...)
+				if _, err := io.ReadFull(connection, buffer[4:]); err != nil {
+					return
+				}
+				request, err := unscramble(buffer)
+				assert.NoError(t, err)
+				var parsed map[string]map[string]json.RawMessage
+				assert.NoError(t, json.Unmarshal(request, &parsed))
+				combined := map[string]map[string]json.RawMessage{}
+				for module, methods := range parsed {
+					if module == "context" {
+						continue
+					}
+					for method := range methods {
+						var reply map[string]map[string]json.RawMessage
+						if err := json.Unmarshal([]byte(replies[module+"."+method]), &reply); err != nil {
+							continue
+						}
+						if combined[module] == nil {
+							combined[module] = map[string]json.RawMessage{}
+						}
+						combined[module][method] = reply[module][method]
+					}
+				}
+				response, _ := json.Marshal(combined)
+				_, _ = connection.Write(scramble(response))
+			}
+		}()
+	}
+}
+
+func TestSetRelayUpdatesMetricsStraightAway(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	go serveLinkie(t, listener, map[string]string{
+		"system.get_sysinfo":     `{"system":{"get_sysinfo":{"active_mode":"none","alias":"Kettle","dev_name":"Smart Wi-Fi Plug","deviceId":"8006","hwId":"45E2","sw_ver":"1.5.4","oemId":"3D34","mac":"AA:00:11:BB:22:33","model":"HS100(UK)","rssi":-60,"type":"IOT.SMARTPLUGSWITCH","relay_state":0,"led_off":0,"on_time":0,"updating":0,"err_code":0}}}`,
+		"system.set_relay_state": `{"system":{"set_relay_state":{"err_code":0}}}`,
+		"system.set_led_off":     `{"system":{"set_led_off":{"err_code":0}}}`,
+	})
+
+	registry := prometheus.NewRegistry()
+	device := NewDevice("", "", &types.DeviceConfig{Name: "Kettle", Room: "Kitchen", Model: types.KasaHS100, Ip: "127.0.0.1"}, registry)
+	device.connection = newDeviceConnection("127.0.0.1", uint16(listener.Addr().(*net.TCPAddr).Port))
+
+	assert.NoError(t, device.PollDeviceAndUpdateMetrics(context.Background()))
+	assert.Equal(t, 0.0, testutil.ToFloat64(*device.metrics.deviceTurnedOn))
+
+	assert.NoError(t, device.SetRelay(context.Background(), true))
+	assert.Equal(t, 1.0, testutil.ToFloat64(*device.metrics.deviceTurnedOn))
+	assert.NoError(t, device.SetLed(context.Background(), false))
+	assert.Equal(t, 0.0, testutil.ToFloat64(*device.metrics.ledTurnedOn))
+
+	assert.ErrorIs(t, device.SetLightState(context.Background(), types.LightState{}), types.ErrNotSupported)
+}
+
+func TestTransitionLightStateParams(t *testing.T) {
+	on, hue, temperature := true, 120, 2700
+	params, err := transitionLightStateParams(&types.DeviceConfig{Model: types.KasaKL130B}, types.LightState{On: &on, Hue: &hue})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]any{"ignore_default": 1, "transition_period": int64(0), "on_off": 1, "hue": 120, "color_temp": 0}, params)
+
+	_, err = transitionLightStateParams(&types.DeviceConfig{Model: types.KasaKL110B}, types.LightState{ColourTemperature: &temperature})
+	assert.ErrorIs(t, err, types.ErrNotSupported)
+	params, err = transitionLightStateParams(&types.DeviceConfig{Model: types.KasaKL430}, types.LightState{ColourTemperature: &temperature})
+	assert.NoError(t, err)
+	assert.Equal(t, 2700, params["color_temp"])
+	hue = 400
+	_, err = transitionLightStateParams(&types.DeviceConfig{Model: types.KasaKL130B}, types.LightState{Hue: &hue})
+	assert.ErrorIs(t, err, types.ErrInvalidValue)
+}
@@ -0,0 +1,52 @@
+package kasa
+
+import (
+	"context"
+	"homepower/types"
+	"net"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMissingAndMistypedFieldsAreCountedWithoutFailingThePoll(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	go serveLinkie(t, listener, map[string]string{
+		// relay_state is missing and rssi is a string
+		"system.get_sysinfo":   `{"system":{"get_sysinfo":{"active_mode":"none","alias":"Fridge","dev_name":"Smart Wi-Fi Plug With Energy Monitoring","deviceId":"8006","hwId":"45E2","sw_ver":"1.5.4","oemId":"3D34","mac":"AA:00:11:BB:22:33","model":"HS110(UK)","rssi":"-60","type":"IOT.SMARTPLUGSWITCH","led_off":0,"on_time":30,"updating":0,"err_code":0}}}`,
+		"emeter.get_realtime":  `{"emeter":{"get_realtime":{"voltage_mv":240100,"current_ma":"lots","power_mw":85000,"total_wh":1200,"err_code":0}}}`,
+		"emeter.get_daystat":   `{"emeter":{"get_daystat":{"day_list":[],"err_code":0}}}`,
+		"emeter.get_monthstat": `{"emeter":{"get_monthstat":{"month_list":[],"err_code":0}}}`,
+	})
+
+	device := NewDevice("", "", &types.DeviceConfig{Name: "Fridge", Room: "Kitchen", Model: types.KasaHS110, Ip: "127.0.0.1"}, prometheus.NewRegistry())
+	device.connection = newDeviceConnection("127.0.0.1", uint16(listener.Addr().(*net.TCPAddr).Port))
+
+	assert.NoError(t, device.PollDeviceAndUpdateMetrics(context.Background()))
+	assert.Equal(t, 85000.0, testutil.ToFloat64(*device.metrics.powerMilliWatts))
+	assert.Equal(t, 240100.0, testutil.ToFloat64(*device.metrics.voltageMilliVolts))
+	assert.Equal(t, 30.0, testutil.ToFloat64(*device.metrics.onTime))
+
+	assert.Equal(t, 3, testutil.CollectAndCount(device.metrics.decodeErrors))
+	assert.Equal(t, 1.0, testutil.ToFloat64(device.metrics.decodeErrors.WithLabelValues("system.get_sysinfo.relay_state")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(device.metrics.decodeErrors.WithLabelValues("system.get_sysinfo.rssi")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(device.metrics.decodeErrors.WithLabelValues("emeter.get_realtime.current_ma")))
+}
+
+func TestReplyWithoutErrCodeFailsThePoll(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	go serveLinkie(t, listener, map[string]string{
+		"system.get_sysinfo": `{"system":{"get_sysinfo":{"alias":"Kettle"}}}`,
+	})
+
+	device := NewDevice("", "", &types.DeviceConfig{Name: "Kettle", Room: "Kitchen", Model: types.KasaHS100, Ip: "127.0.0.1"}, prometheus.NewRegistry())
+	device.connection = newDeviceConnection("127.0.0.1", uint16(listener.Addr().(*net.TCPAddr).Port))
+
+	assert.ErrorContains(t, device.PollDeviceAndUpdateMetrics(context.Background()), "did not return an err_code")
+}
@@ -1,30 +1,50 @@
 package kasa
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"homepower/types"
+	"log"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 const sysInfoBody = `{"system":{"get_sysinfo":null}}`
-const eMeterRealTimeQualifiedBody = `{"smartlife.iot.common.emeter":{"get_realtime":{}}}`
-const eMeterRealTimeShortBody = `{"emeter":{"get_realtime":{}}}`
-const lightingServiceLightDetailsBody = `{"smartlife.iot.smartbulb.lightingservice":{"get_light_details":{}}}`
+const eMeterQualifiedModule = "smartlife.iot.common.emeter"
+const eMeterShortModule = "emeter"
 
 type Device struct {
-	deviceConfig *types.DeviceConfig
-	connection   *deviceConnection
-	metrics      *prometheusMetrics
+	deviceConfig  *types.DeviceConfig
+	connection    transport
+	metrics       *prometheusMetrics
+	modelVerified bool
+	lastReport    atomic.Pointer[periodicDeviceReport]
+	protocol      atomic.Pointer[string]
+	// mutex serialises use of the connection and metrics between polls and control requests
+	mutex sync.Mutex
+
+	energyTotals            *energyTotals
+	energyTotalsFetchedAt   time.Time
+	energyTotalsUnsupported bool
+
+	schedule            []ruleEntry
+	scheduleClockOffset time.Duration // how far the device's local clock is ahead of UTC
+	scheduleFetchedAt   time.Time
+	scheduleUnsupported bool
 }
 
-func NewDevice(config *types.DeviceConfig, registry prometheus.Registerer) *Device {
-	connection := newDeviceConnection(config.Ip, 9999)
+// NewDevice creates a device that talks to the Kasa device over the XOR protocol, or over KLAP when the device does not
+// listen for that, in which case the email and password of the account it was set up with are needed
+func NewDevice(email string, password string, config *types.DeviceConfig, registry prometheus.Registerer) *Device {
+	connection := newLazyTransport(email, password, config.Ip, Port, KlapPort)
+	connection.persistent = config.KeepConnectionOpen
 	return &Device{
 		deviceConfig: config,
 		connection:   connection,
@@ -32,31 +52,101 @@ func NewDevice(config *types.DeviceConfig, registry prometheus.Registerer) *Devi
 	}
 }
 
-func (dev *Device) PollDeviceAndUpdateMetrics() error {
-	report, err := dev.extractAllData()
+func (dev *Device) PollDeviceAndUpdateMetrics(ctx context.Context) error {
+	dev.mutex.Lock()
+	defer dev.mutex.Unlock()
+	defer dev.recordProtocol()
+	report, err := dev.extractAllData(ctx)
 	if err != nil {
 		return fmt.Errorf("could not poll device for info: %w", err)
 	}
 	if err := dev.metrics.updateMetrics(report); err != nil {
 		return fmt.Errorf("could not update metrics after device poll: %w", err)
 	}
+	dev.lastReport.Store(report)
+	if !dev.modelVerified {
+		dev.modelVerified = types.WarnIfReportedModelDiffers(dev.deviceConfig, report.ModelName)
+	}
 	return nil
 }
+
+// ProbeModel asks the device at the given IP for its system info and returns the model it reports, e.g. "HS110(UK)"
+func ProbeModel(ctx context.Context, email string, password string, ip string) (string, error) {
+	connection := newLazyTransport(email, password, ip, Port, KlapPort)
+	err := connection.openNewConnection(ctx)
+	defer connection.forgetSession()
+	if err != nil {
+		return "", fmt.Errorf("could not create connection when probing model: %w", err)
+	}
+	deviceInfoJson, err := connection.queryDevice(ctx, sysInfoBody)
+	if err != nil {
+		return "", fmt.Errorf("could not query for device info: %w", err)
+	}
+	var infoJson struct {
+		System struct {
+			SysInfo struct {
+				Model   string `json:"model"`
+				ErrCode int    `json:"err_code"`
+			} `json:"get_sysinfo"`
+		} `json:"system"`
+	}
+	if err := json.Unmarshal(deviceInfoJson, &infoJson); err != nil {
+		return "", fmt.Errorf("could not unmarshal device info json: %w", err)
+	}
+	if infoJson.System.SysInfo.ErrCode != 0 {
+		return "", errors.New("call to fetch system info returned non-zero err_code: " + strconv.Itoa(infoJson.System.SysInfo.ErrCode))
+	}
+	if infoJson.System.SysInfo.Model == "" {
+		return "", errors.New("device did not report a model")
+	}
+	return infoJson.System.SysInfo.Model, nil
+}
 func (dev *Device) ResetMetricsToRogueValues() {
+	dev.mutex.Lock()
+	defer dev.mutex.Unlock()
 	dev.metrics.resetToRogueValues()
 }
 func (dev *Device) ResetDeviceConnection() {
-	dev.connection.closeCurrentConnection()
+	dev.mutex.Lock()
+	defer dev.mutex.Unlock()
+	dev.connection.forgetSession()
 }
 func (dev *Device) CommonMetricLabels() map[string]string {
 	return types.GenerateCommonLabels(dev.deviceConfig)
 }
+func (dev *Device) Model() types.DeviceType {
+	return dev.deviceConfig.Model
+}
+
+// recordProtocol copies the protocol out of the connection, which is only touched while the mutex is held, so that
+// Protocol can be called from elsewhere
+func (dev *Device) recordProtocol() {
+	protocol := dev.connection.protocolName()
+	dev.protocol.Store(&protocol)
+}
+func (dev *Device) Protocol() string {
+	if protocol := dev.protocol.Load(); protocol != nil {
+		return *protocol
+	}
+	return ""
+}
+func (dev *Device) LastStatus() any {
+	if report := dev.lastReport.Load(); report != nil {
+		return report
+	}
+	return nil
+}
 
 type periodicDeviceReport struct {
 	common
 	*smartBulbInfo
 	*smartPlugInfo
 	*energyMeterInfo
+	*energyTotals
+	*powerStripInfo
+	*dimmerInfo
+	*lightStripInfo
+	*scheduleInfo
 }
 
 type common struct {
@@ -81,6 +171,34 @@ type smartPlugInfo struct {
 	Updating bool
 }
 
+type dimmerInfo struct {
+	Level         int // percent
+	FadeOnTime    time.Duration
+	FadeOffTime   time.Duration
+	GentleOnTime  time.Duration
+	GentleOffTime time.Duration
+}
+
+type lightStripInfo struct {
+	Length        int // number of zones
+	EffectEnabled bool
+	EffectName    string // e.g. "Aurora", or empty when no effect has been chosen
+}
+
+type powerStripInfo struct {
+	LedOn    bool
+	Updating bool
+	Outlets  []outletInfo
+}
+
+type outletInfo struct {
+	Id      string // the strip's device id followed by the outlet's two digit index
+	Alias   string // as set in the Kasa app
+	RelayOn bool
+	OnTime  time.Duration
+	*energyMeterInfo
+}
+
 type smartBulbInfo struct {
 	DeviceState                 string
 	IsOn                        bool
@@ -107,217 +225,353 @@ type energyMeterInfo struct {
 	TotalEnergyWattHours int
 }
 
-func eMeterQueryForDevice(model types.DeviceType) (queryBody string) {
+// eMeterModuleForDevice gives the namespace of the emeter methods (get_realtime, get_daystat, ...), which differs
+// between plugs and bulbs
+func eMeterModuleForDevice(model types.DeviceType) string {
 	switch model {
-	case types.KasaHS110, types.KasaKP115:
-		return eMeterRealTimeShortBody
-	case types.KasaKL50B, types.KasaKL110B, types.KasaKL130B:
-		return eMeterRealTimeQualifiedBody
+	case types.KasaHS110, types.KasaKP115, types.KasaHS300:
+		return eMeterShortModule
+	case types.KasaKL50B, types.KasaKL110B, types.KasaKL130B, types.KasaKL400, types.KasaKL430:
+		return eMeterQualifiedModule
 	default:
 		panic("Device has invalid model type for the Kasa driver")
 	}
 }
 
-func (dev *Device) extractAllData() (*periodicDeviceReport, error) {
+// extractAllData polls the device in a single round trip, except that more requests follow, one at a time on the same
+// connection, when the energy totals or the schedule are due to be refreshed, and for each outlet of a power strip
+// with its own eMeter
+func (dev *Device) extractAllData(ctx context.Context) (*periodicDeviceReport, error) {
 	var startTime = time.Now()
-	err := dev.connection.openNewConnection()
+	err := dev.connection.openNewConnection(ctx)
 	defer dev.connection.closeCurrentConnection()
 	if err != nil {
 		return nil, fmt.Errorf("could not create connection when extracting data: %w", err)
 	}
 
-	var deviceInfoJson []byte
-	if deviceInfoJson, err = dev.connection.queryDevice(sysInfoBody); err != nil {
+	var responseJson []byte
+	if responseJson, err = dev.connection.queryDevice(ctx, periodicRequestBody(dev.deviceConfig)); err != nil {
 		return nil, fmt.Errorf("could not query for device info: %w", err)
 	}
 
-	var realTimeJson []byte
 	if supportsEMeter(dev.deviceConfig) {
-		var eMeterRealTimeBody = eMeterQueryForDevice(dev.deviceConfig.Model)
-		if realTimeJson, err = dev.connection.queryDevice(eMeterRealTimeBody); err != nil {
-			return nil, fmt.Errorf("could not query for eMeter info: %w", err)
-		}
+		dev.refreshEnergyTotals(ctx, startTime)
+	}
+	dev.refreshSchedule(ctx, startTime)
+
+	var decodeErrors types.DecodeErrors
+	report, err := buildPeriodicDeviceReport(dev.deviceConfig.Model, responseJson,
+		hasLampDetails(dev.deviceConfig), supportsEMeter(dev.deviceConfig), isDimmer(dev.deviceConfig), hasCountdown(dev.deviceConfig),
+		startTime, &decodeErrors)
+	if err != nil {
+		return report, err
+	}
+	report.energyTotals = dev.energyTotals
+	schedule := dev.scheduleInfoAt(startTime)
+	if report.scheduleInfo != nil {
+		schedule.CountdownRemaining = report.CountdownRemaining
 	}
+	report.scheduleInfo = schedule
 
-	var lampInfoJson []byte
-	if isLight(dev.deviceConfig) {
-		if lampInfoJson, err = dev.connection.queryDevice(lightingServiceLightDetailsBody); err != nil {
-			return nil, fmt.Errorf("could not query for lamp info: %w", err)
+	if hasOutletEMeter(dev.deviceConfig) && report.powerStripInfo != nil {
+		for i := range report.Outlets {
+			outlet := &report.Outlets[i]
+			if outlet.energyMeterInfo, err = dev.queryOutletEMeter(ctx, outlet.Id, &decodeErrors); err != nil {
+				return nil, fmt.Errorf("could not query for eMeter info of outlet %s: %w", outlet.Alias, err)
+			}
 		}
+		report.ScrapeDuration = time.Since(startTime)
 	}
+	dev.recordDecodeErrors(decodeErrors)
+	return report, nil
+}
 
-	return buildPeriodicDeviceReport(dev.deviceConfig.Model, deviceInfoJson,
-		lampInfoJson, isLight(dev.deviceConfig), realTimeJson, supportsEMeter(dev.deviceConfig), startTime)
+// periodicRequestBody asks for everything a poll needs in one request, as the device answers each module it is sent
+// in a single reply
+func periodicRequestBody(config *types.DeviceConfig) string {
+	request := map[string]map[string]any{
+		systemModule: {"get_sysinfo": nil},
+	}
+	if supportsEMeter(config) {
+		request[eMeterModuleForDevice(config.Model)] = map[string]any{"get_realtime": map[string]any{}}
+	}
+	if hasLampDetails(config) {
+		request[lightingServiceModule] = map[string]any{"get_light_details": map[string]any{}}
+	}
+	if isDimmer(config) {
+		request[dimmerModule] = map[string]any{"get_dimmer_parameters": map[string]any{}}
+	}
+	if hasCountdown(config) {
+		request[countdownModule] = map[string]any{"get_rules": map[string]any{}}
+	}
+	body, _ := json.Marshal(request) // cannot fail for maps of strings
+	return string(body)
+}
+
+// recordDecodeErrors logs and counts the fields of a reply that could not be decoded.  Their metrics are reported as
+// zero rather than failing the poll, so that everything else the device said is still exported.
+func (dev *Device) recordDecodeErrors(errs types.DecodeErrors) {
+	if len(errs) == 0 {
+		return
+	}
+	log.Printf("could not decode every field from %s (%s): %v", dev.deviceConfig.Ip, dev.deviceConfig.Name, errs)
+	types.CountDecodeErrors(dev.metrics.decodeErrors, errs)
+}
+
+// queryOutletEMeter reads one outlet's eMeter; without the context, a strip replies with an error rather than a total.
+// A request carries only one context, so each outlet needs a request of its own after the one for the poll.
+func (dev *Device) queryOutletEMeter(ctx context.Context, childId string, errs *types.DecodeErrors) (*energyMeterInfo, error) {
+	module := eMeterModuleForDevice(dev.deviceConfig.Model)
+	request, err := json.Marshal(map[string]any{
+		"context": map[string]any{"child_ids": []string{childId}},
+		module:    map[string]any{"get_realtime": map[string]any{}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal request: %w", err)
+	}
+	realTimeJson, err := dev.connection.queryDevice(ctx, string(request))
+	if err != nil {
+		return nil, err
+	}
+	return parseEMeterRealTime(module, realTimeJson, errs)
 }
 
+// buildPeriodicDeviceReport splits the reply to periodicRequestBody between the parsers for each module, each of which
+// picks out its own part
 func buildPeriodicDeviceReport(
 	model types.DeviceType,
-	deviceInfo []byte,
-	lampInfo []byte, supportsLampInfo bool,
-	realTime []byte, supportsEMeter bool,
-	startTime time.Time) (*periodicDeviceReport, error) {
+	response []byte,
+	supportsLampInfo bool,
+	supportsEMeter bool,
+	isDimmer bool,
+	hasCountdown bool,
+	startTime time.Time,
+	errs *types.DecodeErrors) (*periodicDeviceReport, error) {
 
 	var report = periodicDeviceReport{}
 
-	if err := appendDeviceInfo(model, deviceInfo, &report); err != nil {
+	if err := appendDeviceInfo(model, response, &report, errs); err != nil {
 		return &report, fmt.Errorf("could not merge device info into report: %w", err)
 	}
 	if supportsEMeter {
-		if err := appendEMeterInfo(model, realTime, &report); err != nil {
+		if err := appendEMeterInfo(model, response, &report, errs); err != nil {
 			return &report, fmt.Errorf("could not merge eMeter info into report: %w", err)
 		}
 	}
 	if supportsLampInfo {
-		if err := appendLampInfo(lampInfo, &report); err != nil {
+		if err := appendLampInfo(response, &report, errs); err != nil {
 			return &report, fmt.Errorf("could not merge lamp info into report: %w", err)
 		}
 	}
+	if isDimmer {
+		if err := appendDimmerParameters(response, &report, errs); err != nil {
+			return &report, fmt.Errorf("could not merge dimmer parameters into report: %w", err)
+		}
+	}
+	if hasCountdown {
+		if err := appendCountdown(response, &report, errs); err != nil {
+			return &report, fmt.Errorf("could not merge countdown into report: %w", err)
+		}
+	}
 	report.ScrapeDuration = time.Since(startTime)
 	return &report, nil
 }
 
-func appendDeviceInfo(model types.DeviceType, deviceInfo []byte, report *periodicDeviceReport) error {
-	var infoJson map[string]map[string]map[string]interface{}
+func appendDeviceInfo(model types.DeviceType, deviceInfo []byte, report *periodicDeviceReport, errs *types.DecodeErrors) error {
+	var infoJson sysInfoResponse
 	if err := json.Unmarshal(deviceInfo, &infoJson); err != nil {
 		return fmt.Errorf("could not unmarshal device info json: %w", err)
 	}
-	//var out, _ = json.MarshalIndent(infoJson, "", "  ")
-	//fmt.Print(string(out))
-
-	var data = infoJson["system"]["get_sysinfo"]
-	if int(data["err_code"].(float64)) != 0 {
-		return errors.New("call to fetch system info returned non-zero err_code: " + strconv.Itoa(int(data["err_code"].(float64))))
+	var data = &infoJson.System.GetSysInfo
+	if err := checkErrCode("system info", data.ErrCode); err != nil {
+		return err
 	}
 
+	const path = sysInfoPath + "."
 	report.common = common{
-		ActiveMode:       data["active_mode"].(string),     // e.g. "none"
-		Alias:            data["alias"].(string),           // e.g. "Living Room Ceiling Light"
-		ModelDescription: mapModelDescription(model, data), // e.g. Smart Wi-Fi LED Bulb with Dimmable Light
-		DeviceId:         data["deviceId"].(string),        // e.g. AABB0011CC22DD33EE44FF550011CC33FF55AA77
-		HardwareId:       data["hwId"].(string),            // e.g. 00112233445566778899AA00BB00CC00
-		SoftwareVersion:  data["sw_ver"].(string),          // e.g. 1.5.10 Build 191125 Rel.094314
-		OemId:            data["oemId"].(string),           // e.g. E57A51C2293DD01A3171CD7949972746
-		Mac:              mapMac(model, data),              // e.g. AA0011BB2233
-		ModelName:        data["model"].(string),           // e.g. KL50B(UN)
-		WifiRssi:         int(data["rssi"].(float64)),      // e.g. -58
-		DeviceType:       mapDeviceType(model, data),       // IOT.SMARTPLUGSWITCH or IOT.SMARTBULB
+		ActiveMode:       types.Optional(errs, path+"active_mode", data.ActiveMode, ""), // e.g. "none"; not reported by power strips
+		Alias:            types.Required(errs, path+"alias", data.Alias),                // e.g. "Living Room Ceiling Light"
+		ModelDescription: mapModelDescription(model, data, errs),                        // e.g. Smart Wi-Fi LED Bulb with Dimmable Light
+		DeviceId:         types.Required(errs, path+"deviceId", data.DeviceId),          // e.g. AABB0011CC22DD33EE44FF550011CC33FF55AA77
+		HardwareId:       types.Required(errs, path+"hwId", data.HwId),                  // e.g. 00112233445566778899AA00BB00CC00
+		SoftwareVersion:  types.Required(errs, path+"sw_ver", data.SwVer),               // e.g. 1.5.10 Build 191125 Rel.094314
+		OemId:            types.Required(errs, path+"oemId", data.OemId),                // e.g. E57A51C2293DD01A3171CD7949972746
+		Mac:              mapMac(model, data, errs),                                     // e.g. AA0011BB2233
+		ModelName:        types.Required(errs, path+"model", data.Model),                // e.g. KL50B(UN)
+		WifiRssi:         types.Required(errs, path+"rssi", data.Rssi),                  // e.g. -58
+		DeviceType:       mapDeviceType(model, data, errs),                              // IOT.SMARTPLUGSWITCH or IOT.SMARTBULB
 	}
 
 	switch model {
-	case types.KasaHS100, types.KasaHS110, types.KasaKP115:
+	case types.KasaHS100, types.KasaHS110, types.KasaKP115, types.KasaHS220, types.KasaKS230:
 		report.smartPlugInfo = &smartPlugInfo{
-			RelayOn:  int(data["relay_state"].(float64)) == 1,
-			LedOn:    int(data["led_off"].(float64)) == 0,
-			OnTime:   time.Duration(int64(data["on_time"].(float64))) * time.Second,
-			Updating: int(data["updating"].(float64)) != 0,
+			RelayOn:  types.Required(errs, path+"relay_state", data.RelayState) == 1,
+			LedOn:    types.Required(errs, path+"led_off", data.LedOff) == 0,
+			OnTime:   time.Duration(types.Required(errs, path+"on_time", data.OnTime)) * time.Second,
+			Updating: types.Required(errs, path+"updating", data.Updating) != 0,
+		}
+		if data.Brightness.Present {
+			report.dimmerInfo = &dimmerInfo{Level: types.Required(errs, path+"brightness", data.Brightness)}
 		}
-	case types.KasaKL50B, types.KasaKL110B, types.KasaKL130B:
+	case types.KasaKL50B, types.KasaKL110B, types.KasaKL130B, types.KasaKL400, types.KasaKL430:
 		report.smartBulbInfo = &smartBulbInfo{
-			DeviceState:                 data["dev_state"].(string), // e.g. "normal"
-			IsDimmable:                  int(data["is_dimmable"].(float64)) == 1,
+			DeviceState:                 types.Required(errs, path+"dev_state", data.DevState), // e.g. "normal"
+			IsDimmable:                  types.Required(errs, path+"is_dimmable", data.IsDimmable) == 1,
 			IsOn:                        false,
-			IsColour:                    int(data["is_color"].(float64)) == 1,
-			IsVariableColourTemperature: int(data["is_variable_color_temp"].(float64)) == 1,
+			IsColour:                    types.Required(errs, path+"is_color", data.IsColor) == 1,
+			IsVariableColourTemperature: types.Required(errs, path+"is_variable_color_temp", data.IsVariableColorTemp) == 1,
+		}
+		applyLightState(report.smartBulbInfo, types.Required(errs, path+"light_state", data.LightState), path+"light_state", errs)
+		if data.Length.Present {
+			report.lightStripInfo = &lightStripInfo{Length: types.Required(errs, path+"length", data.Length)}
+			if data.LightingEffectState.Present {
+				effect := types.Required(errs, path+"lighting_effect_state", data.LightingEffectState)
+				report.lightStripInfo.EffectEnabled = types.Required(errs, path+"lighting_effect_state.enable", effect.Enable) == 1
+				report.lightStripInfo.EffectName = types.Optional(errs, path+"lighting_effect_state.name", effect.Name, "")
+			}
+		}
+	case types.KasaHS300, types.KasaKP303, types.KasaKP400, types.KasaKP200:
+		report.powerStripInfo = &powerStripInfo{
+			LedOn:    types.Required(errs, path+"led_off", data.LedOff) == 0,
+			Updating: types.Required(errs, path+"updating", data.Updating) != 0,
 		}
-		var lightState = data["light_state"].(map[string]interface{})
-		report.smartBulbInfo.IsOn = int(lightState["on_off"].(float64)) == 1
-		if report.smartBulbInfo.IsOn {
-			report.smartBulbInfo.Mode = lightState["mode"].(string)
-			report.smartBulbInfo.Hue = int(lightState["hue"].(float64))
-			report.smartBulbInfo.Saturation = int(lightState["saturation"].(float64))
-			report.smartBulbInfo.ColourTemperature = int(lightState["color_temp"].(float64))
-			report.smartBulbInfo.Brightness = int(lightState["brightness"].(float64))
+		// The paths leave out each child's index, so that the metric has one series per field rather than per outlet
+		for _, child := range types.Required(errs, path+"children", data.Children) {
+			report.Outlets = append(report.Outlets, outletInfo{
+				Id:      mapChildId(report.DeviceId, types.Required(errs, path+"children.id", child.Id)),
+				Alias:   types.Required(errs, path+"children.alias", child.Alias),
+				RelayOn: types.Required(errs, path+"children.state", child.State) == 1,
+				OnTime:  time.Duration(types.Required(errs, path+"children.on_time", child.OnTime)) * time.Second,
+			})
 		}
 	}
 	return nil
 }
 
-func mapDeviceType(model types.DeviceType, data map[string]interface{}) string {
+// mapChildId gives the id to put in a child_ids context: most firmware reports the whole id, but some only the
+// outlet's index, e.g. "00"
+func mapChildId(deviceId string, childId string) string {
+	if len(childId) <= 2 {
+		return deviceId + childId
+	}
+	return childId
+}
+
+// applyLightState copies a light_state, as found in the sysinfo and returned by transition_light_state, into the report
+func applyLightState(bulbInfo *smartBulbInfo, lightState lightState, path string, errs *types.DecodeErrors) {
+	bulbInfo.IsOn = types.Required(errs, path+".on_off", lightState.OnOff) == 1
+	bulbInfo.Mode, bulbInfo.Hue, bulbInfo.Saturation, bulbInfo.ColourTemperature, bulbInfo.Brightness = "", 0, 0, 0, 0
+	if bulbInfo.IsOn {
+		bulbInfo.Mode = types.Required(errs, path+".mode", lightState.Mode)
+		bulbInfo.Hue = types.Required(errs, path+".hue", lightState.Hue)
+		bulbInfo.Saturation = types.Required(errs, path+".saturation", lightState.Saturation)
+		bulbInfo.ColourTemperature = types.Required(errs, path+".color_temp", lightState.ColorTemp)
+		bulbInfo.Brightness = types.Required(errs, path+".brightness", lightState.Brightness)
+	}
+}
+
+func mapDeviceType(model types.DeviceType, data *sysInfo, errs *types.DecodeErrors) string {
 	switch model {
 	case types.KasaHS100, types.KasaHS110:
-		return data["type"].(string)
-	case types.KasaKL50B, types.KasaKL110B, types.KasaKL130B, types.KasaKP115:
-		return data["mic_type"].(string)
+		return types.Required(errs, sysInfoPath+".type", data.Type)
+	case types.KasaKL50B, types.KasaKL110B, types.KasaKL130B, types.KasaKP115,
+		types.KasaHS300, types.KasaKP303, types.KasaKP400, types.KasaKP200,
+		types.KasaHS220, types.KasaKS230, types.KasaKL400, types.KasaKL430:
+		return types.Required(errs, sysInfoPath+".mic_type", data.MicType)
 	default:
 		panic("Device has invalid model type for the Kasa driver")
 	}
 }
 
-func mapMac(model types.DeviceType, data map[string]interface{}) string {
+func mapMac(model types.DeviceType, data *sysInfo, errs *types.DecodeErrors) string {
 	switch model {
-	case types.KasaHS100, types.KasaHS110, types.KasaKP115: // e.g. AA:00:11:BB:22:33
-		return strings.ReplaceAll(data["mac"].(string), ":", "")
-	case types.KasaKL50B, types.KasaKL110B, types.KasaKL130B: // e.g. AA0011BB2233
-		return data["mic_mac"].(string)
+	case types.KasaHS100, types.KasaHS110, types.KasaKP115,
+		types.KasaHS300, types.KasaKP303, types.KasaKP400, types.KasaKP200,
+		types.KasaHS220, types.KasaKS230: // e.g. AA:00:11:BB:22:33
+		return strings.ReplaceAll(types.Required(errs, sysInfoPath+".mac", data.Mac), ":", "")
+	case types.KasaKL50B, types.KasaKL110B, types.KasaKL130B, types.KasaKL400, types.KasaKL430: // e.g. AA0011BB2233
+		return types.Required(errs, sysInfoPath+".mic_mac", data.MicMac)
 	default:
 		panic("Device has invalid model type for the Kasa driver")
 	}
 }
 
-func mapModelDescription(model types.DeviceType, data map[string]interface{}) string {
+func mapModelDescription(model types.DeviceType, data *sysInfo, errs *types.DecodeErrors) string {
 	switch model {
-	case types.KasaHS100, types.KasaHS110, types.KasaKP115:
-		return data["dev_name"].(string)
-	case types.KasaKL50B, types.KasaKL110B, types.KasaKL130B:
-		return data["description"].(string)
+	case types.KasaHS100, types.KasaHS110, types.KasaKP115, types.KasaHS220, types.KasaKS230:
+		return types.Required(errs, sysInfoPath+".dev_name", data.DevName)
+	case types.KasaKL50B, types.KasaKL110B, types.KasaKL130B, types.KasaKL400, types.KasaKL430:
+		return types.Required(errs, sysInfoPath+".description", data.Description)
+	case types.KasaHS300, types.KasaKP303, types.KasaKP400, types.KasaKP200:
+		return types.Optional(errs, sysInfoPath+".dev_name", data.DevName, "") // not reported by every strip
 	default:
 		panic("Device has invalid model type for the Kasa driver")
 	}
 }
 
-func appendLampInfo(lampInfo []byte, report *periodicDeviceReport) error {
-	var lampJson map[string]map[string]map[string]interface{}
+func appendLampInfo(lampInfo []byte, report *periodicDeviceReport, errs *types.DecodeErrors) error {
+	var lampJson lightDetailsResponse
 	if err := json.Unmarshal(lampInfo, &lampJson); err != nil {
 		return fmt.Errorf("could not unmarshal lamp info json: %w", err)
 	}
-	var data = lampJson["smartlife.iot.smartbulb.lightingservice"]["get_light_details"]
-	if int(data["err_code"].(float64)) != 0 {
-		return errors.New("call to fetch lamp info data returned non-zero err_code: " + strconv.Itoa(int(data["err_code"].(float64))))
+	var data = &lampJson.LightingService.GetLightDetails
+	if err := checkErrCode("lamp info data", data.ErrCode); err != nil {
+		return err
 	}
 	if report.smartBulbInfo == nil {
 		report.smartBulbInfo = &smartBulbInfo{}
 	}
-	report.smartBulbInfo.LampBeamAngle = int(data["lamp_beam_angle"].(float64))
-	report.smartBulbInfo.MinimumVoltage = int(data["min_voltage"].(float64))
-	report.smartBulbInfo.MaximumVoltage = int(data["max_voltage"].(float64))
-	report.smartBulbInfo.Wattage = int(data["wattage"].(float64))
-	report.smartBulbInfo.IncandescentEquivalent = int(data["incandescent_equivalent"].(float64))
-	report.smartBulbInfo.MaximumLumens = int(data["max_lumens"].(float64))
+	const path = lightDetailsPath + "."
+	report.smartBulbInfo.LampBeamAngle = types.Required(errs, path+"lamp_beam_angle", data.LampBeamAngle)
+	report.smartBulbInfo.MinimumVoltage = types.Required(errs, path+"min_voltage", data.MinVoltage)
+	report.smartBulbInfo.MaximumVoltage = types.Required(errs, path+"max_voltage", data.MaxVoltage)
+	report.smartBulbInfo.Wattage = types.Required(errs, path+"wattage", data.Wattage)
+	report.smartBulbInfo.IncandescentEquivalent = types.Required(errs, path+"incandescent_equivalent", data.IncandescentEquivalent)
+	report.smartBulbInfo.MaximumLumens = types.Required(errs, path+"max_lumens", data.MaxLumens)
 	return nil
 }
 
-func appendEMeterInfo(model types.DeviceType, realTime []byte, report *periodicDeviceReport) error {
-	var eMeterJson map[string]map[string]map[string]interface{}
-	if err := json.Unmarshal(realTime, &eMeterJson); err != nil {
-		return fmt.Errorf("could not unmarshal eMeter info json: %w", err)
+func appendDimmerParameters(dimmerParameters []byte, report *periodicDeviceReport, errs *types.DecodeErrors) error {
+	var dimmerJson dimmerParametersResponse
+	if err := json.Unmarshal(dimmerParameters, &dimmerJson); err != nil {
+		return fmt.Errorf("could not unmarshal dimmer parameters json: %w", err)
 	}
-	//var out, _ = json.MarshalIndent(eMeterJson, "", "  ")
-	//fmt.Print(string(out))
-
-	var data map[string]interface{}
-	switch model {
-	case types.KasaHS110, types.KasaKP115:
-		data = eMeterJson["emeter"]["get_realtime"]
-	case types.KasaKL50B, types.KasaKL110B, types.KasaKL130B:
-		data = eMeterJson["smartlife.iot.common.emeter"]["get_realtime"]
-	default:
-		panic("Device has invalid model type for the Kasa eMeter driver")
+	var data = &dimmerJson.Dimmer.GetDimmerParameters
+	if err := checkErrCode("dimmer parameters", data.ErrCode); err != nil {
+		return err
 	}
-	if int(data["err_code"].(float64)) != 0 {
-		return errors.New("call to fetch eMeter data returned non-zero err_code: " + strconv.Itoa(int(data["err_code"].(float64))))
+	if report.dimmerInfo == nil {
+		report.dimmerInfo = &dimmerInfo{}
 	}
+	const path = dimmerParametersPath + "."
+	report.dimmerInfo.FadeOnTime = time.Duration(types.Required(errs, path+"fadeOnTime", data.FadeOnTime)) * time.Millisecond
+	report.dimmerInfo.FadeOffTime = time.Duration(types.Required(errs, path+"fadeOffTime", data.FadeOffTime)) * time.Millisecond
+	report.dimmerInfo.GentleOnTime = time.Duration(types.Required(errs, path+"gentleOnTime", data.GentleOnTime)) * time.Millisecond
+	report.dimmerInfo.GentleOffTime = time.Duration(types.Required(errs, path+"gentleOffTime", data.GentleOffTime)) * time.Millisecond
+	return nil
+}
 
-	report.energyMeterInfo = &energyMeterInfo{
-		PowerMilliWatts: int(data["power_mw"].(float64)),
-	}
-	if voltage, prs := data["voltage_mv"]; prs {
-		report.energyMeterInfo.VoltageMilliVolts = int(voltage.(float64))
-	}
-	if current, prs := data["current_ma"]; prs {
-		report.energyMeterInfo.CurrentMilliAmps = int(current.(float64))
+func appendEMeterInfo(model types.DeviceType, realTime []byte, report *periodicDeviceReport, errs *types.DecodeErrors) error {
+	var err error
+	report.energyMeterInfo, err = parseEMeterRealTime(eMeterModuleForDevice(model), realTime, errs)
+	return err
+}
+
+func parseEMeterRealTime(module string, realTime []byte, errs *types.DecodeErrors) (*energyMeterInfo, error) {
+	var eMeterJson realTimeResponse
+	if err := json.Unmarshal(realTime, &eMeterJson); err != nil {
+		return nil, fmt.Errorf("could not unmarshal eMeter info json: %w", err)
 	}
-	if totalEnergy, prs := data["total_wh"]; prs {
-		report.energyMeterInfo.TotalEnergyWattHours = int(totalEnergy.(float64))
+	var data = eMeterJson[module].GetRealtime
+	if err := checkErrCode("eMeter data", data.ErrCode); err != nil {
+		return nil, err
 	}
-	return nil
+
+	var path = module + ".get_realtime."
+	return &energyMeterInfo{
+		PowerMilliWatts:      types.Required(errs, path+"power_mw", data.PowerMw),
+		VoltageMilliVolts:    types.Optional(errs, path+"voltage_mv", data.VoltageMv, 0),
+		CurrentMilliAmps:     types.Optional(errs, path+"current_ma", data.CurrentMa, 0),
+		TotalEnergyWattHours: types.Optional(errs, path+"total_wh", data.TotalWh, 0),
+	}, nil
 }
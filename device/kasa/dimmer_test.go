@@ -0,0 +1,38 @@
+package kasa
+
+import (
+	"context"
+	"homepower/types"
+	"net"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDimmerReportsLevelAndFadeSettings(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	go serveLinkie(t, listener, map[string]string{
+		"system.get_sysinfo":                         `{"system":{"get_sysinfo":{"sw_ver":"1.5.8","hw_ver":"1.0","model":"HS220(UK)","deviceId":"8006BB","oemId":"0BA2","hwId":"BB20","rssi":-47,"alias":"Hall Lights","mic_type":"IOT.SMARTPLUGSWITCH","dev_name":"Smart Wi-Fi Dimmer","mac":"AA:00:11:BB:22:44","active_mode":"none","updating":0,"led_off":0,"relay_state":1,"on_time":60,"brightness":35,"err_code":0}}}`,
+		"smartlife.iot.dimmer.get_dimmer_parameters": `{"smartlife.iot.dimmer":{"get_dimmer_parameters":{"minThreshold":11,"fadeOnTime":1000,"fadeOffTime":1500,"gentleOnTime":3000,"gentleOffTime":10000,"rampRate":30,"bulb_type":1,"err_code":0}}}`,
+		"smartlife.iot.dimmer.set_brightness":        `{"smartlife.iot.dimmer":{"set_brightness":{"err_code":0}}}`,
+	})
+
+	device := NewDevice("", "", &types.DeviceConfig{Name: "Lights", Room: "Hall", Model: types.KasaHS220, Ip: "127.0.0.1"}, prometheus.NewRegistry())
+	device.connection = newDeviceConnection("127.0.0.1", uint16(listener.Addr().(*net.TCPAddr).Port))
+
+	assert.NoError(t, device.PollDeviceAndUpdateMetrics(context.Background()))
+	assert.Equal(t, 1.0, testutil.ToFloat64(*device.metrics.deviceTurnedOn))
+	assert.Equal(t, 35.0, testutil.ToFloat64(*device.metrics.dimmerLevel))
+	assert.Equal(t, 1.5, testutil.ToFloat64(*device.metrics.dimmerFadeOffTime))
+	assert.Equal(t, 10.0, testutil.ToFloat64(*device.metrics.dimmerGentleOffTime))
+
+	brightness := 80
+	assert.NoError(t, device.SetLightState(context.Background(), types.LightState{Brightness: &brightness}))
+	assert.Equal(t, 80.0, testutil.ToFloat64(*device.metrics.dimmerLevel))
+	hue := 100
+	assert.ErrorIs(t, device.SetLightState(context.Background(), types.LightState{Hue: &hue}), types.ErrNotSupported)
+}
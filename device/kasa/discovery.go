@@ -0,0 +1,121 @@
+package kasa
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+)
+
+// DiscoveryBroadcastAddress reaches every Kasa device on the local network segment
+const DiscoveryBroadcastAddress = "255.255.255.255:9999"
+
+// discoveryRepeats is how many times the request is broadcast, as UDP on a busy WiFi network is easily lost
+const discoveryRepeats = 3
+
+type DiscoveredDevice struct {
+	Ip       string
+	Model    string // as reported by the device, e.g. "HS110(UK)"
+	Alias    string
+	Mac      string
+	DeviceId string
+}
+
+// Discover broadcasts a sysinfo request to the given address and collects the replies until the context is done.
+// Devices that reply more than once are only listed once; the results are ordered by IP.
+func Discover(ctx context.Context, broadcastAddress string) ([]DiscoveredDevice, error) {
+	destination, err := net.ResolveUDPAddr("udp4", broadcastAddress)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve broadcast address: %w", err)
+	}
+	connection, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not open socket for discovery: %w", err)
+	}
+	defer connection.Close()
+	stopInterrupting := context.AfterFunc(ctx, func() { _ = connection.SetDeadline(time.Now()) })
+	defer stopInterrupting()
+
+	go func() {
+		request := scrambleDatagram([]byte(sysInfoBody))
+		for range discoveryRepeats {
+			_, _ = connection.WriteToUDP(request, destination)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(500 * time.Millisecond):
+			}
+		}
+	}()
+
+	found := map[string]DiscoveredDevice{}
+	buffer := make([]byte, 8192)
+	for {
+		bytesRead, sender, err := connection.ReadFromUDP(buffer)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return nil, fmt.Errorf("could not read discovery reply: %w", err)
+		}
+		if device, err := parseDiscoveryReply(unscrambleDatagram(buffer[:bytesRead])); err == nil {
+			device.Ip = sender.IP.String()
+			found[device.Ip] = device
+		}
+	}
+
+	devices := make([]DiscoveredDevice, 0, len(found))
+	for _, device := range found {
+		devices = append(devices, device)
+	}
+	slices.SortFunc(devices, func(a, b DiscoveredDevice) int {
+		return compareIps(a.Ip, b.Ip)
+	})
+	return devices, nil
+}
+
+func parseDiscoveryReply(reply []byte) (DiscoveredDevice, error) {
+	var infoJson struct {
+		System struct {
+			SysInfo struct {
+				Model    string `json:"model"`
+				Alias    string `json:"alias"`
+				Mac      string `json:"mac"`
+				MicMac   string `json:"mic_mac"`
+				DeviceId string `json:"deviceId"`
+				ErrCode  int    `json:"err_code"`
+			} `json:"get_sysinfo"`
+		} `json:"system"`
+	}
+	if err := json.Unmarshal(reply, &infoJson); err != nil {
+		return DiscoveredDevice{}, fmt.Errorf("could not unmarshal discovery reply: %w", err)
+	}
+	sysInfo := infoJson.System.SysInfo
+	if sysInfo.ErrCode != 0 || sysInfo.Model == "" {
+		return DiscoveredDevice{}, errors.New("discovery reply did not contain system info")
+	}
+	mac := sysInfo.Mac
+	if mac == "" {
+		mac = sysInfo.MicMac
+	}
+	return DiscoveredDevice{
+		Model:    sysInfo.Model,
+		Alias:    sysInfo.Alias,
+		Mac:      strings.ReplaceAll(mac, ":", ""),
+		DeviceId: sysInfo.DeviceId,
+	}, nil
+}
+
+func compareIps(a string, b string) int {
+	aAddress, aErr := netip.ParseAddr(a)
+	bAddress, bErr := netip.ParseAddr(b)
+	if aErr != nil || bErr != nil {
+		return strings.Compare(a, b)
+	}
+	return aAddress.Compare(bAddress)
+}
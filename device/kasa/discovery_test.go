@@ -0,0 +1,47 @@
+package kasa
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiscoverCollectsEachReplyOnce(t *testing.T) {
+	responder, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer responder.Close()
+	go func() {
+		buffer := make([]byte, 2048)
+		for {
+			bytesRead, sender, err := responder.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			assert.Equal(t, sysInfoBody, string(unscrambleDatagram(buffer[:bytesRead])))
+			reply := `{"system":{"get_sysinfo":{"model":"HS110(UK)","alias":"Kettle","mac":"AA:00:11:BB:22:33","deviceId":"8006","err_code":0}}}`
+			_, _ = responder.WriteToUDP(scrambleDatagram([]byte(reply)), sender)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	devices, err := Discover(ctx, responder.LocalAddr().String())
+	assert.NoError(t, err)
+	assert.Equal(t, []DiscoveredDevice{{
+		Ip:       "127.0.0.1",
+		Model:    "HS110(UK)",
+		Alias:    "Kettle",
+		Mac:      "AA0011BB2233",
+		DeviceId: "8006",
+	}}, devices)
+}
+
+func TestScrambleRoundTrips(t *testing.T) {
+	scrambled, err := unscramble(scramble([]byte(sysInfoBody)))
+	assert.NoError(t, err)
+	assert.Equal(t, sysInfoBody, string(scrambled))
+	assert.Equal(t, scramble([]byte(sysInfoBody))[4:], scrambleDatagram([]byte(sysInfoBody)))
+}
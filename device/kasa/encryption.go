@@ -8,31 +8,44 @@ import (
 const initialPad byte = 171
 
 func scramble(b []byte) []byte {
-	var pad = initialPad
 	buffer := make([]byte, 4+len(b))
-
 	writeUInt32ToBufferBigEndian(buffer, uint32(len(b)))
-	for i, ch := range b {
-		pad = pad ^ ch
-		buffer[i+4] = pad
-	}
+	scrambleInto(buffer[4:], b)
 	return buffer
 }
 
 func unscramble(b []byte) ([]byte, error) {
-	var pad = initialPad
-	buffer := make([]byte, len(b)-4)
-
 	expectedSize := expectedLinkiePacketSize(b)
 	if expectedSize != len(b)-4 {
 		return nil, errors.New("unexpected reply size: expected " + strconv.Itoa(expectedSize) +
 			" bytes but received " + strconv.Itoa(len(b)-4) + " bytes")
 	}
-	for i, ch := range b[4:] {
+	return unscrambleDatagram(b[4:]), nil
+}
+
+// scrambleDatagram is scramble without the length prefix, as used over UDP where the datagram carries its own length
+func scrambleDatagram(b []byte) []byte {
+	buffer := make([]byte, len(b))
+	scrambleInto(buffer, b)
+	return buffer
+}
+
+func unscrambleDatagram(b []byte) []byte {
+	var pad = initialPad
+	buffer := make([]byte, len(b))
+	for i, ch := range b {
 		buffer[i] = byte(pad ^ ch)
 		pad = ch
 	}
-	return buffer, nil
+	return buffer
+}
+
+func scrambleInto(buffer []byte, b []byte) {
+	var pad = initialPad
+	for i, ch := range b {
+		pad = pad ^ ch
+		buffer[i] = pad
+	}
 }
 
 func expectedLinkiePacketSize(b []byte) int {
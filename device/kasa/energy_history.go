@@ -0,0 +1,154 @@
+package kasa
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"homepower/types"
+	"log"
+	"math"
+	"slices"
+	"time"
+)
+
+// The daily and monthly totals only change slowly, so they are not fetched on every poll
+const energyTotalsRefreshInterval = time.Minute
+
+type energyTotals struct {
+	TodayEnergyWattHours     int
+	ThisMonthEnergyWattHours int
+}
+
+// refreshEnergyTotals fetches today's and this month's energy when they are due, on the connection opened for the
+// poll.  Failures are logged rather than failing the poll, and a device that refuses the methods is not asked again.
+func (dev *Device) refreshEnergyTotals(ctx context.Context, now time.Time) {
+	if dev.energyTotalsUnsupported || now.Sub(dev.energyTotalsFetchedAt) < energyTotalsRefreshInterval {
+		return
+	}
+	totals, err := dev.fetchEnergyTotals(ctx, now)
+	if err == nil {
+		dev.energyTotals = totals
+		dev.energyTotalsFetchedAt = now
+		return
+	}
+	if errors.Is(err, errNonZeroErrCode) {
+		dev.energyTotalsUnsupported = true
+		log.Printf("%s (%s) does not keep energy history, so it will not be asked again: %v", dev.deviceConfig.Ip, dev.deviceConfig.Name, err)
+	} else if ctx.Err() == nil {
+		log.Printf("could not fetch energy totals for %s (%s): %v", dev.deviceConfig.Ip, dev.deviceConfig.Name, err)
+	}
+}
+
+// fetchEnergyTotals picks today and this month by the device's clock rather than the exporter's, as the device totals
+// each day in its own time zone, and the two disagree around midnight
+func (dev *Device) fetchEnergyTotals(ctx context.Context, now time.Time) (*energyTotals, error) {
+	_, _, clockModule := ruleModules(dev.deviceConfig)
+	var decodeErrors types.DecodeErrors
+	defer func() { dev.recordDecodeErrors(decodeErrors) }()
+	offset, err := dev.clockOffset(ctx, clockModule, now, &decodeErrors)
+	if err != nil {
+		return nil, err
+	}
+	deviceNow := now.UTC().Add(offset)
+
+	module := eMeterModuleForDevice(dev.deviceConfig.Model)
+	days, err := dev.dailyEnergy(ctx, module, deviceNow.Year(), int(deviceNow.Month()))
+	if err != nil {
+		return nil, err
+	}
+	months, err := dev.monthlyEnergy(ctx, module, deviceNow.Year())
+	if err != nil {
+		return nil, err
+	}
+	totals := &energyTotals{}
+	for _, day := range days {
+		if day.Day == deviceNow.Day() {
+			totals.TodayEnergyWattHours = day.EnergyWattHours
+		}
+	}
+	for _, month := range months {
+		if month.Month == int(deviceNow.Month()) {
+			totals.ThisMonthEnergyWattHours = month.EnergyWattHours
+		}
+	}
+	return totals, nil
+}
+
+// EnergyHistory reads the monthly totals that the device holds for the year, and the daily totals for each of those
+// months
+func (dev *Device) EnergyHistory(ctx context.Context, year int) (*types.EnergyHistory, error) {
+	if !supportsEMeter(dev.deviceConfig) {
+		return nil, fmt.Errorf("could not fetch energy history: %w", types.ErrNotSupported)
+	}
+	dev.mutex.Lock()
+	defer dev.mutex.Unlock()
+	err := dev.connection.openNewConnection(ctx)
+	defer dev.connection.closeCurrentConnection()
+	if err != nil {
+		return nil, fmt.Errorf("could not create connection when fetching energy history: %w", err)
+	}
+
+	module := eMeterModuleForDevice(dev.deviceConfig.Model)
+	history := &types.EnergyHistory{}
+	if history.Monthly, err = dev.monthlyEnergy(ctx, module, year); err != nil {
+		return nil, fmt.Errorf("could not fetch energy history: %w", err)
+	}
+	history.Daily = []types.DailyEnergy{}
+	for _, month := range history.Monthly {
+		days, err := dev.dailyEnergy(ctx, module, year, month.Month)
+		if err != nil {
+			return nil, fmt.Errorf("could not fetch energy history: %w", err)
+		}
+		history.Daily = append(history.Daily, days...)
+	}
+	return history, nil
+}
+
+func (dev *Device) dailyEnergy(ctx context.Context, module string, year int, month int) ([]types.DailyEnergy, error) {
+	var reply dayStatReply
+	if err := dev.callMethod(ctx, module, "get_daystat", map[string]any{"year": year, "month": month}, &reply); err != nil {
+		return nil, err
+	}
+	var decodeErrors types.DecodeErrors
+	defer func() { dev.recordDecodeErrors(decodeErrors) }()
+	path := module + ".get_daystat.day_list"
+	days := []types.DailyEnergy{}
+	for _, entry := range types.Required(&decodeErrors, path, reply.DayList) {
+		days = append(days, types.DailyEnergy{
+			Year:            types.Required(&decodeErrors, path+".year", entry.Year),
+			Month:           types.Required(&decodeErrors, path+".month", entry.Month),
+			Day:             types.Required(&decodeErrors, path+".day", entry.Day),
+			EnergyWattHours: energyWattHours(entry, path, &decodeErrors),
+		})
+	}
+	slices.SortFunc(days, func(a, b types.DailyEnergy) int { return a.Day - b.Day })
+	return days, nil
+}
+
+func (dev *Device) monthlyEnergy(ctx context.Context, module string, year int) ([]types.MonthlyEnergy, error) {
+	var reply monthStatReply
+	if err := dev.callMethod(ctx, module, "get_monthstat", map[string]any{"year": year}, &reply); err != nil {
+		return nil, err
+	}
+	var decodeErrors types.DecodeErrors
+	defer func() { dev.recordDecodeErrors(decodeErrors) }()
+	path := module + ".get_monthstat.month_list"
+	months := []types.MonthlyEnergy{}
+	for _, entry := range types.Required(&decodeErrors, path, reply.MonthList) {
+		months = append(months, types.MonthlyEnergy{
+			Year:            types.Required(&decodeErrors, path+".year", entry.Year),
+			Month:           types.Required(&decodeErrors, path+".month", entry.Month),
+			EnergyWattHours: energyWattHours(entry, path, &decodeErrors),
+		})
+	}
+	slices.SortFunc(months, func(a, b types.MonthlyEnergy) int { return a.Month - b.Month })
+	return months, nil
+}
+
+// energyWattHours reads energy_wh, as sent by newer firmware, or falls back to energy in kWh from older HS110 firmware
+func energyWattHours(entry energyStat, path string, errs *types.DecodeErrors) int {
+	if entry.EnergyWh.Present {
+		return types.Required(errs, path+".energy_wh", entry.EnergyWh)
+	}
+	return int(math.Round(types.Required(errs, path+".energy", entry.Energy) * 1000))
+}
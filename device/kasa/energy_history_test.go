@@ -0,0 +1,64 @@
+package kasa
+
+import (
+	"context"
+	"homepower/types"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnergyHistoryReadsBothEnergyUnits(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	go serveLinkie(t, listener, map[string]string{
+		"emeter.get_monthstat": `{"emeter":{"get_monthstat":{"month_list":[{"year":2024,"month":2,"energy":1.2345},{"year":2024,"month":1,"energy_wh":3210}],"err_code":0}}}`,
+		"emeter.get_daystat":   `{"emeter":{"get_daystat":{"day_list":[{"year":2024,"month":2,"day":2,"energy_wh":45},{"year":2024,"month":2,"day":1,"energy":0.1}],"err_code":0}}}`,
+	})
+
+	device := NewDevice("", "", &types.DeviceConfig{Name: "Fridge", Room: "Kitchen", Model: types.KasaHS110, Ip: "127.0.0.1"}, prometheus.NewRegistry())
+	device.connection = newDeviceConnection("127.0.0.1", uint16(listener.Addr().(*net.TCPAddr).Port))
+
+	history, err := device.EnergyHistory(context.Background(), 2024)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.MonthlyEnergy{
+		{Year: 2024, Month: 1, EnergyWattHours: 3210},
+		{Year: 2024, Month: 2, EnergyWattHours: 1235},
+	}, history.Monthly)
+	// The fake device gives the same days whichever month is asked for
+	assert.Len(t, history.Daily, 4)
+	assert.Equal(t, types.DailyEnergy{Year: 2024, Month: 2, Day: 1, EnergyWattHours: 100}, history.Daily[0])
+	assert.Equal(t, types.DailyEnergy{Year: 2024, Month: 2, Day: 2, EnergyWattHours: 45}, history.Daily[1])
+}
+
+func TestEnergyHistoryIsNotSupportedWithoutEMeter(t *testing.T) {
+	device := NewDevice("", "", &types.DeviceConfig{Name: "Kettle", Room: "Kitchen", Model: types.KasaHS100, Ip: "127.0.0.1"}, prometheus.NewRegistry())
+	_, err := device.EnergyHistory(context.Background(), 2024)
+	assert.ErrorIs(t, err, types.ErrNotSupported)
+}
+
+func TestEnergyTotalsArePickedByTheDevicesClock(t *testing.T) {
+	// It is still January for the exporter, but the device's clock is ten hours ahead and already in February
+	now := time.Date(2024, 1, 31, 23, 30, 0, 0, time.UTC)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	go serveLinkie(t, listener, map[string]string{
+		"time.get_time":        `{"time":{"get_time":{"year":2024,"month":2,"mday":1,"hour":9,"min":30,"sec":0,"err_code":0}}}`,
+		"emeter.get_monthstat": `{"emeter":{"get_monthstat":{"month_list":[{"year":2024,"month":1,"energy_wh":3210},{"year":2024,"month":2,"energy_wh":45}],"err_code":0}}}`,
+		"emeter.get_daystat":   `{"emeter":{"get_daystat":{"day_list":[{"year":2024,"month":2,"day":1,"energy_wh":45}],"err_code":0}}}`,
+	})
+
+	device := NewDevice("", "", &types.DeviceConfig{Name: "Fridge", Room: "Kitchen", Model: types.KasaHS110, Ip: "127.0.0.1"}, prometheus.NewRegistry())
+	device.connection = newDeviceConnection("127.0.0.1", uint16(listener.Addr().(*net.TCPAddr).Port))
+	assert.NoError(t, device.connection.openNewConnection(context.Background()))
+	defer device.connection.closeCurrentConnection()
+
+	totals, err := device.fetchEnergyTotals(context.Background(), now)
+	assert.NoError(t, err)
+	assert.Equal(t, &energyTotals{TodayEnergyWattHours: 45, ThisMonthEnergyWattHours: 45}, totals)
+}
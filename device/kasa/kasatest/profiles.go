@@ -0,0 +1,35 @@
+package kasatest
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+)
+
+// Models are the devices that have a profile, which are based on the replies in device/kasa/examples.txt.  The KP115
+// is not among those, so its profile is the HS110's in the newer plug's sysinfo.
+var Models = []string{"HS100", "HS110", "KP115", "KL50B", "KL110B", "KL130B"}
+
+//go:embed profiles/*.json
+var profiles embed.FS
+
+// Profile holds the reply to each method of each module that a device knows, keyed by module then method
+type Profile map[string]map[string]map[string]any
+
+// LoadProfile reads the profile of one of the Models; each call returns a fresh copy, so a server can change its state
+// without affecting any other
+func LoadProfile(model string) (Profile, error) {
+	data, err := profiles.ReadFile("profiles/" + model + ".json")
+	if err != nil {
+		return nil, fmt.Errorf("could not find profile for %s: %w", model, err)
+	}
+	var profile Profile
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return nil, fmt.Errorf("could not parse profile for %s: %w", model, err)
+	}
+	return profile, nil
+}
+
+func (p Profile) sysInfo() map[string]any {
+	return p["system"]["get_sysinfo"]
+}
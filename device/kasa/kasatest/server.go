@@ -0,0 +1,294 @@
+// Package kasatest provides a simulated Kasa device that speaks the Linkie protocol over TCP, for testing the kasa
+// package and for running the exporter without real devices
+package kasatest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"sync"
+	"time"
+)
+
+// Fault is something the simulator can do wrong, as devices do on a poor network or with unexpected firmware
+type Fault int
+
+const (
+	NoFault         Fault = iota
+	TruncatedHeader       // the reply's length header is cut short and the connection closed
+	SplitPackets          // the reply is padded to more than 2048 bytes and written a piece at a time
+	ErrorCode             // every method replies with a non-zero err_code
+)
+
+var faultNames = map[Fault]string{
+	NoFault:         "none",
+	TruncatedHeader: "truncated-header",
+	SplitPackets:    "split-packets",
+	ErrorCode:       "error-code",
+}
+
+func (f Fault) String() string {
+	return faultNames[f]
+}
+
+// ParseFault finds the fault with the given name, as printed by String
+func ParseFault(name string) (Fault, error) {
+	for fault, faultName := range faultNames {
+		if faultName == name {
+			return fault, nil
+		}
+	}
+	return NoFault, errors.New("unknown fault: " + name)
+}
+
+const (
+	initialPad byte = 171
+	// A real device writes anything longer than this in more than one packet
+	splitPacketSize  = 2048
+	splitChunkSize   = 1024
+	splitChunkPause  = 10 * time.Millisecond
+	maxRequestSize   = 64 * 1024
+	faultErrorCode   = -1
+	faultErrorReason = "simulated fault"
+)
+
+// Server answers Linkie requests from a profile, keeping track of the relay, LED and light state it is asked to set
+type Server struct {
+	listener net.Listener
+
+	mutex       sync.Mutex
+	profile     Profile
+	fault       Fault
+	connections map[net.Conn]struct{}
+	waitGroup   sync.WaitGroup
+}
+
+// Listen starts serving the profile on the address, e.g. 127.0.0.1:0 for any free port
+func Listen(address string, profile Profile) (*Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("could not listen on %s: %w", address, err)
+	}
+	server := &Server{listener: listener, profile: profile, connections: map[net.Conn]struct{}{}}
+	server.waitGroup.Add(1)
+	go server.acceptConnections()
+	return server, nil
+}
+
+func (s *Server) Addr() *net.TCPAddr {
+	return s.listener.Addr().(*net.TCPAddr)
+}
+
+func (s *Server) Port() uint16 {
+	return uint16(s.Addr().Port)
+}
+
+// SetFault changes how every reply from now on is sent, including those on connections that are already open
+func (s *Server) SetFault(fault Fault) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.fault = fault
+}
+
+// Close stops listening and drops every open connection
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.mutex.Lock()
+	for connection := range s.connections {
+		_ = connection.Close()
+	}
+	s.mutex.Unlock()
+	s.waitGroup.Wait()
+	return err
+}
+
+func (s *Server) acceptConnections() {
+	defer s.waitGroup.Done()
+	for {
+		connection, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mutex.Lock()
+		s.connections[connection] = struct{}{}
+		s.mutex.Unlock()
+		s.waitGroup.Add(1)
+		go s.serveConnection(connection)
+	}
+}
+
+// serveConnection answers requests until the client hangs up, as a device does for a client that keeps its
+// connection open
+func (s *Server) serveConnection(connection net.Conn) {
+	defer s.waitGroup.Done()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.connections, connection)
+		s.mutex.Unlock()
+		_ = connection.Close()
+	}()
+	for {
+		request, err := readRequest(connection)
+		if err != nil {
+			return
+		}
+		s.mutex.Lock()
+		fault := s.fault
+		reply, err := json.Marshal(s.reply(request, fault))
+		s.mutex.Unlock()
+		if err != nil || writeReply(connection, reply, fault) != nil {
+			return
+		}
+	}
+}
+
+func readRequest(connection net.Conn) (map[string]map[string]json.RawMessage, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(connection, header); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header)
+	if size > maxRequestSize {
+		return nil, fmt.Errorf("request of %d bytes is too long", size)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(connection, body); err != nil {
+		return nil, err
+	}
+	var request map[string]map[string]json.RawMessage
+	if err := json.Unmarshal(unscramble(body), &request); err != nil {
+		return nil, fmt.Errorf("could not parse request: %w", err)
+	}
+	return request, nil
+}
+
+func writeReply(connection net.Conn, reply []byte, fault Fault) error {
+	switch fault {
+	case TruncatedHeader:
+		_, _ = connection.Write(scramble(reply)[:2])
+		return errors.New("header truncated")
+	case SplitPackets:
+		// Trailing whitespace leaves the JSON as it was
+		if len(reply) <= splitPacketSize {
+			reply = append(reply, bytes.Repeat([]byte(" "), splitPacketSize+1-len(reply))...)
+		}
+		scrambled := scramble(reply)
+		for start := 0; start < len(scrambled); start += splitChunkSize {
+			if start > 0 {
+				time.Sleep(splitChunkPause)
+			}
+			if _, err := connection.Write(scrambled[start:min(start+splitChunkSize, len(scrambled))]); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		_, err := connection.Write(scramble(reply))
+		return err
+	}
+}
+
+// reply combines the reply to each method of each module into one, as a device does
+func (s *Server) reply(request map[string]map[string]json.RawMessage, fault Fault) map[string]map[string]any {
+	combined := map[string]map[string]any{}
+	for module, methods := range request {
+		if module == "context" {
+			continue
+		}
+		combined[module] = map[string]any{}
+		for method, params := range methods {
+			if fault == ErrorCode {
+				combined[module][method] = map[string]any{"err_code": faultErrorCode, "err_msg": faultErrorReason}
+				continue
+			}
+			var decodedParams map[string]any
+			_ = json.Unmarshal(params, &decodedParams)
+			combined[module][method] = s.callMethod(module, method, decodedParams)
+		}
+	}
+	return combined
+}
+
+func (s *Server) callMethod(module string, method string, params map[string]any) map[string]any {
+	methods, found := s.profile[module]
+	if !found {
+		return map[string]any{"err_code": -1, "err_msg": "module not support"}
+	}
+	switch method {
+	case "get_time":
+		// The simulated device's clock is set to UTC
+		now := time.Now().UTC()
+		return map[string]any{"year": now.Year(), "month": int(now.Month()), "mday": now.Day(),
+			"hour": now.Hour(), "min": now.Minute(), "sec": now.Second(), "err_code": 0}
+	case "set_relay_state":
+		s.profile.sysInfo()["relay_state"] = params["state"]
+		s.profile.sysInfo()["on_time"] = 0
+		return map[string]any{"err_code": 0}
+	case "set_led_off":
+		s.profile.sysInfo()["led_off"] = params["off"]
+		return map[string]any{"err_code": 0}
+	case "transition_light_state":
+		reply := maps.Clone(s.transitionLightState(params))
+		reply["err_code"] = 0
+		return reply
+	}
+	if reply, found := methods[method]; found {
+		return reply
+	}
+	return map[string]any{"err_code": -2, "err_msg": "member not support"}
+}
+
+// transitionLightState changes the bulb's light state; a bulb that is off keeps the state it will come back on in
+// under dft_on_state
+func (s *Server) transitionLightState(params map[string]any) map[string]any {
+	current, _ := s.profile.sysInfo()["light_state"].(map[string]any)
+	state, found := current["dft_on_state"].(map[string]any)
+	if found {
+		state = maps.Clone(state)
+	} else {
+		state = maps.Clone(current)
+		delete(state, "on_off")
+	}
+	onOff := current["on_off"]
+	for key, value := range params {
+		switch key {
+		case "on_off":
+			onOff = value
+		case "mode", "hue", "saturation", "color_temp", "brightness":
+			state[key] = value
+		}
+	}
+	next := map[string]any{"on_off": onOff, "dft_on_state": state}
+	if number, _ := onOff.(float64); number == 1 {
+		next = state
+		next["on_off"] = onOff
+	}
+	s.profile.sysInfo()["light_state"] = next
+	return next
+}
+
+func scramble(b []byte) []byte {
+	buffer := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(buffer, uint32(len(b)))
+	var pad = initialPad
+	for i, ch := range b {
+		pad = pad ^ ch
+		buffer[4+i] = pad
+	}
+	return buffer
+}
+
+func unscramble(b []byte) []byte {
+	var pad = initialPad
+	buffer := make([]byte, len(b))
+	for i, ch := range b {
+		buffer[i] = pad ^ ch
+		pad = ch
+	}
+	return buffer
+}
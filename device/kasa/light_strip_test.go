@@ -0,0 +1,40 @@
+package kasa
+
+import (
+	"context"
+	"homepower/types"
+	"net"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLightStripReportsLengthAndEffect(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	go serveLinkie(t, listener, map[string]string{
+		"system.get_sysinfo":                        `{"system":{"get_sysinfo":{"sw_ver":"1.0.10","hw_ver":"1.0","model":"KL430(UN)","description":"Kasa Smart Light Strip, Multicolor","alias":"Shelf","mic_type":"IOT.SMARTBULB","dev_state":"normal","mic_mac":"AA0011BB2255","deviceId":"8012CC","oemId":"F8C1","hwId":"CC43","is_factory":false,"disco_ver":"1.0","ctrl_protocols":{"name":"Linkie","version":"1.0"},"active_mode":"none","is_dimmable":1,"is_color":1,"is_variable_color_temp":1,"light_state":{"on_off":1,"mode":"normal","hue":0,"saturation":0,"color_temp":2700,"brightness":60},"length":16,"lighting_effect_state":{"enable":1,"name":"Aurora","brightness":100,"custom":0,"id":"xqUxDhbAhNLqulcuRMyPBmVGyTOyEMEu"},"rssi":-55,"err_code":0}}}`,
+		"smartlife.iot.common.emeter.get_realtime":  `{"smartlife.iot.common.emeter":{"get_realtime":{"power_mw":6500,"total_wh":12,"err_code":0}}}`,
+		"smartlife.iot.common.emeter.get_daystat":   `{"smartlife.iot.common.emeter":{"get_daystat":{"day_list":[],"err_code":0}}}`,
+		"smartlife.iot.common.emeter.get_monthstat": `{"smartlife.iot.common.emeter":{"get_monthstat":{"month_list":[],"err_code":0}}}`,
+	})
+
+	registry := prometheus.NewRegistry()
+	device := NewDevice("", "", &types.DeviceConfig{Name: "Shelf", Room: "Study", Model: types.KasaKL430, Ip: "127.0.0.1"}, registry)
+	device.connection = newDeviceConnection("127.0.0.1", uint16(listener.Addr().(*net.TCPAddr).Port))
+
+	assert.NoError(t, device.PollDeviceAndUpdateMetrics(context.Background()))
+	assert.Equal(t, 60.0, testutil.ToFloat64(*device.metrics.brightness))
+	assert.Equal(t, 16.0, testutil.ToFloat64(*device.metrics.lightStripLength))
+	assert.Equal(t, 2700.0, testutil.ToFloat64(*device.metrics.colourTemperature))
+	assert.Equal(t, 6500.0, testutil.ToFloat64(*device.metrics.powerMilliWatts))
+	assert.Equal(t, 1, testutil.CollectAndCount(registry, "kasa_light_strip_effect"))
+	report := device.LastStatus().(*periodicDeviceReport)
+	assert.Equal(t, "Aurora", report.EffectName)
+
+	device.ResetMetricsToRogueValues()
+	assert.Equal(t, 0, testutil.CollectAndCount(registry, "kasa_light_strip_effect"))
+}
@@ -1,39 +1,71 @@
 package kasa
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"strconv"
 	"time"
 )
 
+// Port is where every Kasa device listens for Linkie requests
+const Port = 9999
+
+// maxLinkieResponseSize bounds what is read from a device that sends a nonsense length; a batched poll of a power
+// strip returns only a few KB
+const maxLinkieResponseSize = 64 * 1024
+
 type deviceConnection struct {
 	address      string
 	dialer       *net.Dialer
 	connection   net.Conn
 	writeTimeout time.Duration
 	readTimeout  time.Duration
+	// persistent keeps the connection open between polls rather than dialling for each one, with TCP keepalive to
+	// notice when the device has gone away
+	persistent bool
+	// reused is set while the connection is one kept from an earlier poll, which the device may since have dropped
+	reused bool
 }
 
 func newDeviceConnection(ip string, port uint16) *deviceConnection {
 	return &deviceConnection{
-		address:      ip + ":" + strconv.Itoa(int(port)),
-		dialer:       &net.Dialer{Timeout: 1 * time.Second},
+		address: ip + ":" + strconv.Itoa(int(port)),
+		dialer: &net.Dialer{
+			Timeout:         1 * time.Second,
+			KeepAliveConfig: net.KeepAliveConfig{Enable: true, Idle: 15 * time.Second, Interval: 5 * time.Second, Count: 3},
+		},
 		connection:   nil,
 		writeTimeout: 1 * time.Second,
 		readTimeout:  2 * time.Second,
 	}
 }
 
+// closeCurrentConnection ends the use of the connection for this poll, which only closes it if it is not persistent
 func (dc *deviceConnection) closeCurrentConnection() {
+	if !dc.persistent {
+		dc.disconnect()
+	}
+}
+func (dc *deviceConnection) disconnect() {
 	if dc.connection != nil {
 		_ = dc.connection.Close()
 		dc.connection = nil
 	}
+	dc.reused = false
+}
+func (dc *deviceConnection) openNewConnection(ctx context.Context) error {
+	if dc.persistent && dc.connection != nil {
+		dc.reused = true
+		return nil
+	}
+	return dc.dial(ctx)
 }
-func (dc *deviceConnection) openNewConnection() error {
-	dc.closeCurrentConnection()
-	connection, err := dc.dialer.Dial("tcp", dc.address)
+func (dc *deviceConnection) dial(ctx context.Context) error {
+	dc.disconnect()
+	connection, err := dc.dialer.DialContext(ctx, "tcp", dc.address)
 	if err != nil {
 		return fmt.Errorf("could not dial address: %w", err)
 	}
@@ -41,7 +73,33 @@ func (dc *deviceConnection) openNewConnection() error {
 	return nil
 }
 
-func (dc *deviceConnection) queryDevice(request string) ([]byte, error) {
+// queryDevice sends the request and reads the reply.  After a failure the connection cannot be trusted to be in step
+// with the device, so it is closed; a kept connection that fails is first retried once on a fresh one.
+func (dc *deviceConnection) queryDevice(ctx context.Context, request string) ([]byte, error) {
+	response, err := dc.exchange(ctx, request)
+	if err != nil && dc.reused && ctx.Err() == nil {
+		if err = dc.dial(ctx); err == nil {
+			response, err = dc.exchange(ctx, request)
+		}
+	}
+	if err != nil {
+		dc.disconnect()
+	}
+	return response, err
+}
+
+func (dc *deviceConnection) exchange(ctx context.Context, request string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if dc.connection == nil {
+		return nil, errors.New("no connection is open")
+	}
+	// Expiring the deadlines immediately unblocks any in-flight read or write once the context is cancelled
+	connection := dc.connection
+	stopInterrupting := context.AfterFunc(ctx, func() { _ = connection.SetDeadline(time.Now()) })
+	defer stopInterrupting()
+
 	if err := dc.connection.SetWriteDeadline(time.Now().Add(dc.writeTimeout)); err != nil {
 		return nil, fmt.Errorf("could not set write timeout: %w", err)
 	}
@@ -60,24 +118,20 @@ func (dc *deviceConnection) queryDevice(request string) ([]byte, error) {
 	}
 }
 
+// _readLinkieResponse reads exactly one length-prefixed reply, so that nothing is left over to confuse the next
+// request on a persistent connection
 func (dc *deviceConnection) _readLinkieResponse() ([]byte, error) {
-	buffer := make([]byte, 2048)
-
-	bytesRead, err := dc.connection.Read(buffer)
-	buffer = buffer[:bytesRead]
-	if err != nil || bytesRead < 8 {
-		return nil, fmt.Errorf("could not read first response packet: %w", err)
+	buffer := make([]byte, 4)
+	if _, err := io.ReadFull(dc.connection, buffer); err != nil {
+		return nil, fmt.Errorf("could not read response length: %w", err)
 	}
 	expectedSize := expectedLinkiePacketSize(buffer)
-
-	for len(buffer) < expectedSize && len(buffer) <= 8192 {
-		tmpBuffer := make([]byte, 2048)
-		if bytesRead, err := dc.connection.Read(tmpBuffer); err == nil {
-			tmpBuffer = tmpBuffer[:bytesRead]
-			buffer = append(buffer, tmpBuffer...)
-		} else {
-			return nil, fmt.Errorf("could not read subsequent response packet: %w", err)
-		}
+	if expectedSize > maxLinkieResponseSize {
+		return nil, errors.New("response length of " + strconv.Itoa(expectedSize) + " bytes is too long")
+	}
+	buffer = append(buffer, make([]byte, expectedSize)...)
+	if _, err := io.ReadFull(dc.connection, buffer[4:]); err != nil {
+		return nil, fmt.Errorf("could not read response body: %w", err)
 	}
 	return buffer, nil
 }
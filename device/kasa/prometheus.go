@@ -4,12 +4,16 @@ import (
 	"fmt"
 	"homepower/types"
 	"strconv"
+	"strings"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 type prometheusMetrics struct {
 	isSwitch                       bool
+	isStrip                        bool
+	isDimmer                       bool
+	isLightStrip                   bool
 	isLight                        bool
 	isVariableTemperature          bool
 	isColoured                     bool
@@ -22,10 +26,26 @@ type prometheusMetrics struct {
 	updateActiveMode func(status *periodicDeviceReport) error
 	wifiRssi         *prometheus.Gauge
 	deviceTurnedOn   *prometheus.Gauge
+	decodeErrors     *prometheus.CounterVec
 
-	ledTurnedOn *prometheus.Gauge // only for switches
+	updateNextAction    func(status *periodicDeviceReport) error
+	nextActionTimestamp *prometheus.Gauge
+	countdownRemaining  *prometheus.Gauge // only for switches
+
+	ledTurnedOn *prometheus.Gauge // only for switches and strips
 	onTime      *prometheus.Gauge // only for switches
-	isUpdating  *prometheus.Gauge // only for switches
+	isUpdating  *prometheus.Gauge // only for switches and strips
+
+	outlets *outletMetrics // only for strips
+
+	dimmerLevel         *prometheus.Gauge // only for dimmers
+	dimmerFadeOnTime    *prometheus.Gauge // only for dimmers
+	dimmerFadeOffTime   *prometheus.Gauge // only for dimmers
+	dimmerGentleOnTime  *prometheus.Gauge // only for dimmers
+	dimmerGentleOffTime *prometheus.Gauge // only for dimmers
+
+	lightStripLength       *prometheus.Gauge                        // only for light strips
+	updateLightStripEffect func(status *periodicDeviceReport) error // only for light strips
 
 	updateLightMode   func(status *periodicDeviceReport) error // only for lights
 	brightness        *prometheus.Gauge                        // only for lights
@@ -37,12 +57,17 @@ type prometheusMetrics struct {
 	voltageMilliVolts *prometheus.Gauge // HS110 only
 	currentMilliAmps  *prometheus.Gauge // HS110 only
 	totalWattHours    *prometheus.Gauge // HS110, KL50, and maybe KL130
+	todayWattHours    *prometheus.Gauge // every device with an eMeter, from get_daystat
+	monthWattHours    *prometheus.Gauge // every device with an eMeter, from get_monthstat
 }
 
 func registerMetrics(registry prometheus.Registerer, config *types.DeviceConfig) *prometheusMetrics {
 	commonLabels := types.GenerateCommonLabels(config)
 	metrics := prometheusMetrics{
 		isSwitch:                       isSwitch(config),
+		isStrip:                        isStrip(config),
+		isDimmer:                       isDimmer(config),
+		isLightStrip:                   isLightStrip(config),
 		isLight:                        isLight(config),
 		isVariableTemperature:          isLightVariableTemperature(config),
 		isColoured:                     isLightColoured(config),
@@ -51,19 +76,45 @@ func registerMetrics(registry prometheus.Registerer, config *types.DeviceConfig)
 		hasCurrentAndVoltageMonitoring: hasCurrentAndVoltageMonitoring(config),
 		commonLabels:                   commonLabels,
 
-		wifiRssi:         types.NewGauge(registry, commonLabels, "kasa", "wifi_rssi_db"),
-		deviceTurnedOn:   types.NewGauge(registry, commonLabels, "kasa", "device_turned_on_bool"),
-		updateInfoMetric: registerInfoMetricUpdater(registry, commonLabels, isLight(config)),
+		wifiRssi:     types.NewGauge(registry, commonLabels, "kasa", "wifi_rssi_db"),
+		decodeErrors: types.NewDecodeErrorCounter(registry, commonLabels),
+		updateNextAction: registerModeMetricUpdater(registry, commonLabels, "next_action", "action",
+			func(report *periodicDeviceReport) string {
+				if report.scheduleInfo == nil {
+					return "none"
+				}
+				return report.NextAction
+			}),
+		nextActionTimestamp: types.NewGauge(registry, commonLabels, "kasa", "next_action_timestamp_seconds"),
+		updateInfoMetric:    registerInfoMetricUpdater(registry, commonLabels, isLight(config)),
 		updateActiveMode: registerModeMetricUpdater(registry, commonLabels, "active_mode", "mode",
 			func(report *periodicDeviceReport) string {
 				return report.ActiveMode
 			}),
 	}
-	if metrics.isSwitch {
+	if metrics.isStrip {
+		// a strip has no relay of its own, only one per outlet
+		metrics.outlets = registerOutletMetrics(registry, config)
+	} else {
+		metrics.deviceTurnedOn = types.NewGauge(registry, commonLabels, "kasa", "device_turned_on_bool")
+	}
+	if hasCountdown(config) {
+		metrics.countdownRemaining = types.NewGauge(registry, commonLabels, "kasa", "countdown_remaining_seconds")
+	}
+	if metrics.isSwitch || metrics.isStrip {
 		metrics.ledTurnedOn = types.NewGauge(registry, commonLabels, "kasa", "led_turned_on_bool")
-		metrics.onTime = types.NewGauge(registry, commonLabels, "kasa", "switched_on_time_seconds")
 		metrics.isUpdating = types.NewGauge(registry, commonLabels, "kasa", "is_updating_bool")
 	}
+	if metrics.isSwitch {
+		metrics.onTime = types.NewGauge(registry, commonLabels, "kasa", "switched_on_time_seconds")
+	}
+	if metrics.isDimmer {
+		metrics.dimmerLevel = types.NewGauge(registry, commonLabels, "kasa", "dimmer_brightness_percent")
+		metrics.dimmerFadeOnTime = types.NewGauge(registry, commonLabels, "kasa", "dimmer_fade_on_time_seconds")
+		metrics.dimmerFadeOffTime = types.NewGauge(registry, commonLabels, "kasa", "dimmer_fade_off_time_seconds")
+		metrics.dimmerGentleOnTime = types.NewGauge(registry, commonLabels, "kasa", "dimmer_gentle_on_time_seconds")
+		metrics.dimmerGentleOffTime = types.NewGauge(registry, commonLabels, "kasa", "dimmer_gentle_off_time_seconds")
+	}
 	if metrics.isLight {
 		metrics.brightness = types.NewGauge(registry, commonLabels, "kasa", "bulb_brightness_percent")
 		metrics.updateLightMode = registerModeMetricUpdater(registry, commonLabels, "bulb_mode", "mode",
@@ -78,12 +129,26 @@ func registerMetrics(registry prometheus.Registerer, config *types.DeviceConfig)
 			metrics.saturation = types.NewGauge(registry, commonLabels, "kasa", "bulb_saturation_percent")
 		}
 	}
+	if metrics.isLightStrip {
+		metrics.lightStripLength = types.NewGauge(registry, commonLabels, "kasa", "light_strip_length_zones")
+		metrics.updateLightStripEffect = registerModeMetricUpdater(registry, commonLabels, "light_strip_effect", "effect",
+			func(report *periodicDeviceReport) string {
+				if report.lightStripInfo == nil || !report.EffectEnabled {
+					return "none"
+				}
+				return report.EffectName
+			})
+	}
 	if metrics.hasPowerMonitoring {
 		metrics.powerMilliWatts = types.NewGauge(registry, commonLabels, "kasa", "em_power_mw")
 	}
 	if metrics.hasTotalEnergyMonitoring {
 		metrics.totalWattHours = types.NewGauge(registry, commonLabels, "kasa", "em_total_energy_wh")
 	}
+	if supportsEMeter(config) {
+		metrics.todayWattHours = types.NewGauge(registry, commonLabels, "kasa", "em_today_energy_wh")
+		metrics.monthWattHours = types.NewGauge(registry, commonLabels, "kasa", "em_this_month_energy_wh")
+	}
 	if metrics.hasCurrentAndVoltageMonitoring {
 		metrics.currentMilliAmps = types.NewGauge(registry, commonLabels, "kasa", "em_current_ma")
 		metrics.voltageMilliVolts = types.NewGauge(registry, commonLabels, "kasa", "em_voltage_mv")
@@ -99,9 +164,24 @@ func (metrics *prometheusMetrics) updateMetrics(status *periodicDeviceReport) er
 		types.SetFromInt(metrics.wifiRssi, status.WifiRssi)
 		if metrics.isSwitch && status.smartPlugInfo != nil {
 			types.SetFromBool(metrics.deviceTurnedOn, status.RelayOn)
-			types.SetFromBool(metrics.ledTurnedOn, status.LedOn)
+			types.SetFromBool(metrics.ledTurnedOn, status.smartPlugInfo.LedOn)
 			types.SetFromDurationAsSeconds(metrics.onTime, status.OnTime)
-			types.SetFromBool(metrics.isUpdating, status.Updating)
+			types.SetFromBool(metrics.isUpdating, status.smartPlugInfo.Updating)
+		}
+		if metrics.isDimmer && status.dimmerInfo != nil {
+			types.SetFromInt(metrics.dimmerLevel, status.Level)
+			types.SetFromDurationAsSeconds(metrics.dimmerFadeOnTime, status.FadeOnTime)
+			types.SetFromDurationAsSeconds(metrics.dimmerFadeOffTime, status.FadeOffTime)
+			types.SetFromDurationAsSeconds(metrics.dimmerGentleOnTime, status.GentleOnTime)
+			types.SetFromDurationAsSeconds(metrics.dimmerGentleOffTime, status.GentleOffTime)
+		}
+		if metrics.isLightStrip && status.lightStripInfo != nil {
+			types.SetFromInt(metrics.lightStripLength, status.Length)
+		}
+		if metrics.isStrip && status.powerStripInfo != nil {
+			types.SetFromBool(metrics.ledTurnedOn, status.powerStripInfo.LedOn)
+			types.SetFromBool(metrics.isUpdating, status.powerStripInfo.Updating)
+			metrics.outlets.update(status.Outlets)
 		}
 		if metrics.isLight && status.smartBulbInfo != nil {
 			types.SetFromBool(metrics.deviceTurnedOn, status.IsOn)
@@ -124,6 +204,17 @@ func (metrics *prometheusMetrics) updateMetrics(status *periodicDeviceReport) er
 			types.SetFromInt(metrics.currentMilliAmps, status.CurrentMilliAmps)
 			types.SetFromInt(metrics.voltageMilliVolts, status.VoltageMilliVolts)
 		}
+		if status.energyTotals != nil {
+			types.SetFromInt(metrics.todayWattHours, status.TodayEnergyWattHours)
+			types.SetFromInt(metrics.monthWattHours, status.ThisMonthEnergyWattHours)
+		}
+		if status.scheduleInfo != nil {
+			types.SetFromTimeAsUnixSeconds(metrics.nextActionTimestamp, status.NextActionAt)
+			types.SetFromDurationAsSeconds(metrics.countdownRemaining, status.CountdownRemaining)
+		}
+		if err := metrics.updateNextAction(status); err != nil {
+			return fmt.Errorf("could not update next action metric: %w", err)
+		}
 		if err := metrics.updateInfoMetric(status); err != nil {
 			return fmt.Errorf("could not update info metric: %w", err)
 		}
@@ -135,6 +226,11 @@ func (metrics *prometheusMetrics) updateMetrics(status *periodicDeviceReport) er
 				return fmt.Errorf("could not update light mode metric: %w", err)
 			}
 		}
+		if metrics.updateLightStripEffect != nil {
+			if err := metrics.updateLightStripEffect(status); err != nil {
+				return fmt.Errorf("could not update light strip effect metric: %w", err)
+			}
+		}
 	}
 	return nil
 }
@@ -142,9 +238,13 @@ func (metrics *prometheusMetrics) updateMetrics(status *periodicDeviceReport) er
 func (metrics *prometheusMetrics) resetToRogueValues() {
 	_ = metrics.updateInfoMetric(nil)
 	_ = metrics.updateActiveMode(nil)
+	_ = metrics.updateNextAction(nil)
 	if metrics.updateLightMode != nil {
 		_ = metrics.updateLightMode(nil)
 	}
+	if metrics.updateLightStripEffect != nil {
+		_ = metrics.updateLightStripEffect(nil)
+	}
 	types.SetIfPresent(metrics.wifiRssi, +1.0) // nb: positive rogue value
 	types.SetIfPresent(metrics.deviceTurnedOn, -1.0)
 	types.SetIfPresent(metrics.ledTurnedOn, -1.0)
@@ -158,6 +258,19 @@ func (metrics *prometheusMetrics) resetToRogueValues() {
 	types.SetIfPresent(metrics.voltageMilliVolts, -1.0)
 	types.SetIfPresent(metrics.currentMilliAmps, -1.0)
 	types.SetIfPresent(metrics.totalWattHours, -1.0)
+	types.SetIfPresent(metrics.todayWattHours, -1.0)
+	types.SetIfPresent(metrics.monthWattHours, -1.0)
+	types.SetIfPresent(metrics.dimmerLevel, -1.0)
+	types.SetIfPresent(metrics.dimmerFadeOnTime, -1.0)
+	types.SetIfPresent(metrics.dimmerFadeOffTime, -1.0)
+	types.SetIfPresent(metrics.dimmerGentleOnTime, -1.0)
+	types.SetIfPresent(metrics.dimmerGentleOffTime, -1.0)
+	types.SetIfPresent(metrics.lightStripLength, -1.0)
+	types.SetIfPresent(metrics.nextActionTimestamp, -1.0)
+	types.SetIfPresent(metrics.countdownRemaining, -1.0)
+	if metrics.outlets != nil {
+		metrics.outlets.resetToRogueValues()
+	}
 }
 
 func registerInfoMetricUpdater(registry prometheus.Registerer, commonLabels prometheus.Labels, isLight bool) func(status *periodicDeviceReport) error {
@@ -227,3 +340,97 @@ func registerModeMetricUpdater(registry prometheus.Registerer, commonLabels prom
 		return nil
 	}
 }
+
+// outletMetrics holds a series per outlet of a power strip.  The outlet's name labels are not constant, so that they
+// can be taken from the alias set in the Kasa app when the manifest asks for it.
+type outletMetrics struct {
+	config *types.DeviceConfig
+
+	turnedOn          *prometheus.GaugeVec
+	onTime            *prometheus.GaugeVec
+	powerMilliWatts   *prometheus.GaugeVec // HS300 only
+	voltageMilliVolts *prometheus.GaugeVec // HS300 only
+	currentMilliAmps  *prometheus.GaugeVec // HS300 only
+	totalWattHours    *prometheus.GaugeVec // HS300 only
+
+	// lastLabels are the outlets seen in the last successful poll, which are kept while the strip cannot be reached
+	lastLabels []prometheus.Labels
+}
+
+var outletLabelNames = []string{"dev_name", "dev_full_name", "child_id", "outlet_alias"}
+
+func registerOutletMetrics(registry prometheus.Registerer, config *types.DeviceConfig) *outletMetrics {
+	constLabels := types.GenerateCommonLabels(config)
+	delete(constLabels, "dev_name")
+	delete(constLabels, "dev_full_name")
+	metrics := outletMetrics{
+		config:   config,
+		turnedOn: types.NewGaugeVec(registry, constLabels, "kasa", "outlet_turned_on_bool", outletLabelNames),
+		onTime:   types.NewGaugeVec(registry, constLabels, "kasa", "outlet_switched_on_time_seconds", outletLabelNames),
+	}
+	if hasOutletEMeter(config) {
+		metrics.powerMilliWatts = types.NewGaugeVec(registry, constLabels, "kasa", "outlet_em_power_mw", outletLabelNames)
+		metrics.voltageMilliVolts = types.NewGaugeVec(registry, constLabels, "kasa", "outlet_em_voltage_mv", outletLabelNames)
+		metrics.currentMilliAmps = types.NewGaugeVec(registry, constLabels, "kasa", "outlet_em_current_ma", outletLabelNames)
+		metrics.totalWattHours = types.NewGaugeVec(registry, constLabels, "kasa", "outlet_em_total_energy_wh", outletLabelNames)
+	}
+	return &metrics
+}
+
+func (metrics *outletMetrics) labelsFor(outlet *outletInfo) prometheus.Labels {
+	name := metrics.config.Name
+	if metrics.config.UseOutletAliases && outlet.Alias != "" {
+		name = outlet.Alias
+	}
+	return prometheus.Labels{
+		"dev_name":      name,
+		"dev_full_name": strings.TrimSpace(metrics.config.Room + " " + name),
+		"child_id":      outlet.Id,
+		"outlet_alias":  outlet.Alias,
+	}
+}
+
+func (metrics *outletMetrics) allVecs() []*prometheus.GaugeVec {
+	return []*prometheus.GaugeVec{metrics.turnedOn, metrics.onTime,
+		metrics.powerMilliWatts, metrics.voltageMilliVolts, metrics.currentMilliAmps, metrics.totalWattHours}
+}
+
+// update replaces every outlet's series, as outlets may have been renamed since the last poll
+func (metrics *outletMetrics) update(outlets []outletInfo) {
+	for _, vec := range metrics.allVecs() {
+		if vec != nil {
+			vec.Reset()
+		}
+	}
+	metrics.lastLabels = make([]prometheus.Labels, 0, len(outlets))
+	for i := range outlets {
+		outlet := &outlets[i]
+		labels := metrics.labelsFor(outlet)
+		metrics.lastLabels = append(metrics.lastLabels, labels)
+		metrics.turnedOn.With(labels).Set(boolToFloat(outlet.RelayOn))
+		metrics.onTime.With(labels).Set(outlet.OnTime.Seconds())
+		if metrics.powerMilliWatts != nil && outlet.energyMeterInfo != nil {
+			metrics.powerMilliWatts.With(labels).Set(float64(outlet.PowerMilliWatts))
+			metrics.voltageMilliVolts.With(labels).Set(float64(outlet.VoltageMilliVolts))
+			metrics.currentMilliAmps.With(labels).Set(float64(outlet.CurrentMilliAmps))
+			metrics.totalWattHours.With(labels).Set(float64(outlet.TotalEnergyWattHours))
+		}
+	}
+}
+
+func (metrics *outletMetrics) resetToRogueValues() {
+	for _, labels := range metrics.lastLabels {
+		for _, vec := range metrics.allVecs() {
+			if vec != nil {
+				vec.With(labels).Set(-1.0)
+			}
+		}
+	}
+}
+
+func boolToFloat(value bool) float64 {
+	if value {
+		return 1.0
+	}
+	return 0.0
+}
@@ -0,0 +1,200 @@
+package kasa
+
+import (
+	"errors"
+	"homepower/types"
+	"strconv"
+)
+
+// The replies to each module's methods.  Which fields are present varies between models and firmware, so all of them
+// are types.Field: the parsers say which they need, and one that is missing or has changed type only loses its own
+// metric.
+
+const sysInfoPath = "system.get_sysinfo"
+
+type sysInfoResponse struct {
+	System struct {
+		GetSysInfo sysInfo `json:"get_sysinfo"`
+	} `json:"system"`
+}
+
+type sysInfo struct {
+	ErrCode     types.Field[int]    `json:"err_code"`
+	ActiveMode  types.Field[string] `json:"active_mode"`
+	Alias       types.Field[string] `json:"alias"`
+	DevName     types.Field[string] `json:"dev_name"`    // plugs and switches
+	Description types.Field[string] `json:"description"` // bulbs
+	DeviceId    types.Field[string] `json:"deviceId"`
+	HwId        types.Field[string] `json:"hwId"`
+	SwVer       types.Field[string] `json:"sw_ver"`
+	OemId       types.Field[string] `json:"oemId"`
+	Mac         types.Field[string] `json:"mac"`     // plugs and switches
+	MicMac      types.Field[string] `json:"mic_mac"` // bulbs
+	Model       types.Field[string] `json:"model"`
+	Rssi        types.Field[int]    `json:"rssi"`
+	Type        types.Field[string] `json:"type"`     // older plugs
+	MicType     types.Field[string] `json:"mic_type"` // everything else
+
+	RelayState types.Field[int]   `json:"relay_state"`
+	LedOff     types.Field[int]   `json:"led_off"`
+	OnTime     types.Field[int64] `json:"on_time"`
+	Updating   types.Field[int]   `json:"updating"`
+	Brightness types.Field[int]   `json:"brightness"` // dimmers
+
+	DevState            types.Field[string]              `json:"dev_state"`
+	IsDimmable          types.Field[int]                 `json:"is_dimmable"`
+	IsColor             types.Field[int]                 `json:"is_color"`
+	IsVariableColorTemp types.Field[int]                 `json:"is_variable_color_temp"`
+	LightState          types.Field[lightState]          `json:"light_state"`
+	Length              types.Field[int]                 `json:"length"` // light strips
+	LightingEffectState types.Field[lightingEffectState] `json:"lighting_effect_state"`
+
+	Children types.Field[[]childInfo] `json:"children"` // power strips
+}
+
+// lightState is found in a bulb's sysinfo and in the reply to transition_light_state; when the bulb is off, only
+// on_off is given
+type lightState struct {
+	OnOff      types.Field[int]    `json:"on_off"`
+	Mode       types.Field[string] `json:"mode"`
+	Hue        types.Field[int]    `json:"hue"`
+	Saturation types.Field[int]    `json:"saturation"`
+	ColorTemp  types.Field[int]    `json:"color_temp"`
+	Brightness types.Field[int]    `json:"brightness"`
+}
+
+type lightingEffectState struct {
+	Enable types.Field[int]    `json:"enable"`
+	Name   types.Field[string] `json:"name"`
+}
+
+type childInfo struct {
+	Id     types.Field[string] `json:"id"`
+	Alias  types.Field[string] `json:"alias"`
+	State  types.Field[int]    `json:"state"`
+	OnTime types.Field[int64]  `json:"on_time"`
+}
+
+const lightDetailsPath = "smartlife.iot.smartbulb.lightingservice.get_light_details"
+
+type lightDetailsResponse struct {
+	LightingService struct {
+		GetLightDetails struct {
+			ErrCode                types.Field[int] `json:"err_code"`
+			LampBeamAngle          types.Field[int] `json:"lamp_beam_angle"`
+			MinVoltage             types.Field[int] `json:"min_voltage"`
+			MaxVoltage             types.Field[int] `json:"max_voltage"`
+			Wattage                types.Field[int] `json:"wattage"`
+			IncandescentEquivalent types.Field[int] `json:"incandescent_equivalent"`
+			MaxLumens              types.Field[int] `json:"max_lumens"`
+		} `json:"get_light_details"`
+	} `json:"smartlife.iot.smartbulb.lightingservice"`
+}
+
+const dimmerParametersPath = "smartlife.iot.dimmer.get_dimmer_parameters"
+
+type dimmerParametersResponse struct {
+	Dimmer struct {
+		GetDimmerParameters struct {
+			ErrCode       types.Field[int]   `json:"err_code"`
+			FadeOnTime    types.Field[int64] `json:"fadeOnTime"` // all in milliseconds
+			FadeOffTime   types.Field[int64] `json:"fadeOffTime"`
+			GentleOnTime  types.Field[int64] `json:"gentleOnTime"`
+			GentleOffTime types.Field[int64] `json:"gentleOffTime"`
+		} `json:"get_dimmer_parameters"`
+	} `json:"smartlife.iot.dimmer"`
+}
+
+// realTimeResponse is keyed by the eMeter module, which differs between plugs and bulbs
+type realTimeResponse map[string]struct {
+	GetRealtime struct {
+		ErrCode   types.Field[int] `json:"err_code"`
+		PowerMw   types.Field[int] `json:"power_mw"`
+		VoltageMv types.Field[int] `json:"voltage_mv"`
+		CurrentMa types.Field[int] `json:"current_ma"`
+		TotalWh   types.Field[int] `json:"total_wh"`
+	} `json:"get_realtime"`
+}
+
+// methodReply holds what every method's reply has in common
+type methodReply struct {
+	ErrCode types.Field[int]    `json:"err_code"`
+	ErrMsg  types.Field[string] `json:"err_msg"`
+}
+
+type energyStat struct {
+	Year     types.Field[int]     `json:"year"`
+	Month    types.Field[int]     `json:"month"`
+	Day      types.Field[int]     `json:"day"`
+	EnergyWh types.Field[int]     `json:"energy_wh"` // newer firmware
+	Energy   types.Field[float64] `json:"energy"`    // older HS110 firmware, in kWh
+}
+
+type dayStatReply struct {
+	DayList types.Field[[]energyStat] `json:"day_list"`
+}
+
+type monthStatReply struct {
+	MonthList types.Field[[]energyStat] `json:"month_list"`
+}
+
+// ruleEntry covers the rules of the schedule, anti_theft and count_down modules, which share most of their fields
+type ruleEntry struct {
+	Id     types.Field[string] `json:"id"`
+	Name   types.Field[string] `json:"name"`
+	Enable types.Field[int]    `json:"enable"`
+	Wday   types.Field[[]int]  `json:"wday"` // 1 for each day it runs on, from Sunday
+	Repeat types.Field[int]    `json:"repeat"`
+	Year   types.Field[int]    `json:"year"` // the day a rule that does not repeat runs on
+	Month  types.Field[int]    `json:"month"`
+	Day    types.Field[int]    `json:"day"`
+
+	StimeOpt types.Field[int] `json:"stime_opt"` // 0 for a time of day, 1 for sunrise or 2 for sunset, -1 for none
+	Smin     types.Field[int] `json:"smin"`      // minutes after midnight
+	Soffset  types.Field[int] `json:"soffset"`
+	Sact     types.Field[int] `json:"sact"` // 1 to switch on, 0 to switch off, -1 for nothing
+	EtimeOpt types.Field[int] `json:"etime_opt"`
+	Emin     types.Field[int] `json:"emin"`
+	Eoffset  types.Field[int] `json:"eoffset"`
+	Eact     types.Field[int] `json:"eact"`
+
+	Delay  types.Field[int] `json:"delay"` // count_down only, in seconds
+	Act    types.Field[int] `json:"act"`
+	Remain types.Field[int] `json:"remain"`
+}
+
+type ruleListReply struct {
+	RuleList types.Field[[]ruleEntry] `json:"rule_list"`
+}
+
+// countdownResponse is the count_down module's part of the reply to a poll
+type countdownResponse struct {
+	Countdown struct {
+		GetRules struct {
+			methodReply
+			ruleListReply
+		} `json:"get_rules"`
+	} `json:"count_down"`
+}
+
+// clockReply gives the device's local time, in whatever time zone it was set up with
+type clockReply struct {
+	Year  types.Field[int] `json:"year"`
+	Month types.Field[int] `json:"month"`
+	Mday  types.Field[int] `json:"mday"`
+	Hour  types.Field[int] `json:"hour"`
+	Min   types.Field[int] `json:"min"`
+	Sec   types.Field[int] `json:"sec"`
+}
+
+// checkErrCode fails the whole reply when its err_code is missing or non-zero, since then none of the rest can be
+// trusted
+func checkErrCode(what string, errCode types.Field[int]) error {
+	if !errCode.Present || errCode.Err != nil {
+		return errors.New("call to fetch " + what + " did not return an err_code")
+	}
+	if errCode.Value != 0 {
+		return errors.New("call to fetch " + what + " returned non-zero err_code: " + strconv.Itoa(errCode.Value))
+	}
+	return nil
+}
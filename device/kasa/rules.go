@@ -0,0 +1,279 @@
+package kasa
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"homepower/types"
+	"log"
+	"time"
+)
+
+const countdownModule = "count_down"
+
+// The schedule only changes when someone edits it in the app, so it is not fetched on every poll
+const scheduleRefreshInterval = time.Minute
+
+var weekdayNames = [7]string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+type scheduleInfo struct {
+	NextAction         string    // "on" or "off", or "none" when nothing is scheduled
+	NextActionAt       time.Time // zero when nothing is scheduled
+	CountdownRemaining time.Duration
+}
+
+// ruleModules gives the namespaces of the schedule, away mode and clock methods, which bulbs qualify as they do the
+// eMeter's
+func ruleModules(config *types.DeviceConfig) (schedule string, antiTheft string, clock string) {
+	if isLight(config) {
+		return "smartlife.iot.common.schedule", "smartlife.iot.common.anti_theft", "smartlife.iot.common.timesetting"
+	}
+	return "schedule", "anti_theft", "time"
+}
+
+// hasCountdown is true for devices with a single relay that can be switched after a delay; a strip has a countdown
+// per outlet, and bulbs have none
+func hasCountdown(config *types.DeviceConfig) bool {
+	return isSwitch(config)
+}
+
+// refreshSchedule fetches the schedule and the device's clock when they are due, on the connection opened for the poll.
+// Failures are logged rather than failing the poll, and a device that refuses the methods is not asked again.
+func (dev *Device) refreshSchedule(ctx context.Context, now time.Time) {
+	if dev.scheduleUnsupported || now.Sub(dev.scheduleFetchedAt) < scheduleRefreshInterval {
+		return
+	}
+	scheduleModule, _, clockModule := ruleModules(dev.deviceConfig)
+	var decodeErrors types.DecodeErrors
+	defer func() { dev.recordDecodeErrors(decodeErrors) }()
+	rules, err := dev.ruleList(ctx, scheduleModule)
+	if err == nil {
+		var offset time.Duration
+		if offset, err = dev.clockOffset(ctx, clockModule, now, &decodeErrors); err == nil {
+			dev.schedule = rules
+			dev.scheduleClockOffset = offset
+			dev.scheduleFetchedAt = now
+			return
+		}
+	}
+	if errors.Is(err, errNonZeroErrCode) {
+		dev.scheduleUnsupported = true
+		log.Printf("%s (%s) does not keep a schedule, so it will not be asked again: %v", dev.deviceConfig.Ip, dev.deviceConfig.Name, err)
+	} else if ctx.Err() == nil {
+		log.Printf("could not fetch schedule for %s (%s): %v", dev.deviceConfig.Ip, dev.deviceConfig.Name, err)
+	}
+}
+
+// scheduleInfoAt works out what the schedule does next, from the rules last fetched
+func (dev *Device) scheduleInfoAt(now time.Time) *scheduleInfo {
+	info := &scheduleInfo{NextAction: "none"}
+	deviceNow := now.UTC().Add(dev.scheduleClockOffset)
+	if at, turnOn, found := nextScheduledAction(dev.schedule, deviceNow); found {
+		info.NextAction = onOrOff(turnOn)
+		info.NextActionAt = at.Add(-dev.scheduleClockOffset).In(now.Location())
+	}
+	return info
+}
+
+// clockOffset reads the device's clock, which keeps local time without saying which time zone that is, and returns how
+// far it is ahead of UTC
+func (dev *Device) clockOffset(ctx context.Context, module string, now time.Time, errs *types.DecodeErrors) (time.Duration, error) {
+	var reply clockReply
+	if err := dev.callMethod(ctx, module, "get_time", map[string]any{}, &reply); err != nil {
+		return 0, err
+	}
+	path := module + ".get_time."
+	deviceNow := time.Date(
+		types.Required(errs, path+"year", reply.Year),
+		time.Month(types.Required(errs, path+"month", reply.Month)),
+		types.Required(errs, path+"mday", reply.Mday),
+		types.Required(errs, path+"hour", reply.Hour),
+		types.Required(errs, path+"min", reply.Min),
+		types.Required(errs, path+"sec", reply.Sec),
+		0, time.UTC)
+	return deviceNow.Sub(now.UTC()).Round(time.Second), nil
+}
+
+func (dev *Device) ruleList(ctx context.Context, module string) ([]ruleEntry, error) {
+	var reply ruleListReply
+	if err := dev.callMethod(ctx, module, "get_rules", map[string]any{}, &reply); err != nil {
+		return nil, err
+	}
+	var decodeErrors types.DecodeErrors
+	defer func() { dev.recordDecodeErrors(decodeErrors) }()
+	return types.Required(&decodeErrors, module+".get_rules.rule_list", reply.RuleList), nil
+}
+
+// nextScheduledAction finds the first time after deviceNow, in the device's local time, at which an enabled rule
+// switches the device.  A rule that follows the sunrise or sunset is taken to run at its smin, which is the time that
+// the app works out for it.
+func nextScheduledAction(rules []ruleEntry, deviceNow time.Time) (time.Time, bool, bool) {
+	var next time.Time
+	var nextTurnsOn, found bool
+	midnight := time.Date(deviceNow.Year(), deviceNow.Month(), deviceNow.Day(), 0, 0, 0, 0, time.UTC)
+	for _, rule := range rules {
+		if rule.Enable.Value != 1 {
+			continue
+		}
+		for _, event := range []struct{ timeOpt, minutes, action types.Field[int] }{
+			{rule.StimeOpt, rule.Smin, rule.Sact},
+			{rule.EtimeOpt, rule.Emin, rule.Eact},
+		} {
+			if event.timeOpt.Value < 0 || (event.action.Value != 0 && event.action.Value != 1) {
+				continue
+			}
+			offset := time.Duration(event.minutes.Value) * time.Minute
+			var candidates []time.Time
+			if rule.Repeat.Value == 1 {
+				for days := range 8 {
+					day := midnight.AddDate(0, 0, days)
+					if wday := rule.Wday.Value; len(wday) == 7 && wday[day.Weekday()] == 1 {
+						candidates = append(candidates, day.Add(offset))
+					}
+				}
+			} else {
+				candidates = append(candidates, time.Date(rule.Year.Value, time.Month(rule.Month.Value), rule.Day.Value, 0, 0, 0, 0, time.UTC).Add(offset))
+			}
+			for _, candidate := range candidates {
+				if candidate.After(deviceNow) {
+					if !found || candidate.Before(next) {
+						next, nextTurnsOn, found = candidate, event.action.Value == 1, true
+					}
+					break
+				}
+			}
+		}
+	}
+	return next, nextTurnsOn, found
+}
+
+func appendCountdown(response []byte, report *periodicDeviceReport, errs *types.DecodeErrors) error {
+	var countdownJson countdownResponse
+	if err := json.Unmarshal(response, &countdownJson); err != nil {
+		return fmt.Errorf("could not unmarshal countdown json: %w", err)
+	}
+	if report.scheduleInfo == nil {
+		report.scheduleInfo = &scheduleInfo{NextAction: "none"}
+	}
+	var data = &countdownJson.Countdown.GetRules
+	if data.ErrCode.Value != 0 {
+		return nil // firmware without countdowns refuses the method, which means none is running
+	}
+	path := countdownModule + ".get_rules.rule_list"
+	for _, rule := range types.Optional(errs, path, data.RuleList, nil) {
+		enabled := types.Required(errs, path+".enable", rule.Enable) == 1
+		remaining := time.Duration(types.Optional(errs, path+".remain", rule.Remain, 0)) * time.Second
+		if enabled && remaining > report.CountdownRemaining {
+			report.CountdownRemaining = remaining
+		}
+	}
+	return nil
+}
+
+// Rules reads every schedule, countdown and away mode rule that has been set up on the device
+func (dev *Device) Rules(ctx context.Context) (*types.DeviceRules, error) {
+	dev.mutex.Lock()
+	defer dev.mutex.Unlock()
+	err := dev.connection.openNewConnection(ctx)
+	defer dev.connection.closeCurrentConnection()
+	if err != nil {
+		return nil, fmt.Errorf("could not create connection when fetching rules: %w", err)
+	}
+
+	var decodeErrors types.DecodeErrors
+	defer func() { dev.recordDecodeErrors(decodeErrors) }()
+	scheduleModule, antiTheftModule, _ := ruleModules(dev.deviceConfig)
+	rules := &types.DeviceRules{Schedules: []types.Rule{}, Countdowns: []types.Rule{}, AwayMode: []types.Rule{}}
+	type ruleKind struct {
+		module string
+		into   *[]types.Rule
+	}
+	modules := []ruleKind{{scheduleModule, &rules.Schedules}, {antiTheftModule, &rules.AwayMode}}
+	if hasCountdown(dev.deviceConfig) {
+		modules = append(modules, ruleKind{countdownModule, &rules.Countdowns})
+	}
+	supported := false
+	for _, kind := range modules {
+		entries, err := dev.ruleList(ctx, kind.module)
+		if errors.Is(err, errNonZeroErrCode) {
+			continue // this kind of rule is not kept by the device
+		} else if err != nil {
+			return nil, fmt.Errorf("could not fetch rules: %w", err)
+		}
+		supported = true
+		path := kind.module + ".get_rules.rule_list"
+		for _, entry := range entries {
+			*kind.into = append(*kind.into, ruleFromEntry(entry, path, &decodeErrors))
+		}
+	}
+	if !supported {
+		return nil, fmt.Errorf("could not fetch rules: %w", types.ErrNotSupported)
+	}
+	return rules, nil
+}
+
+func ruleFromEntry(entry ruleEntry, path string, errs *types.DecodeErrors) types.Rule {
+	rule := types.Rule{
+		Id:      types.Required(errs, path+".id", entry.Id),
+		Name:    types.Optional(errs, path+".name", entry.Name, ""),
+		Enabled: types.Required(errs, path+".enable", entry.Enable) == 1,
+	}
+	if entry.Delay.Present || entry.Act.Present {
+		rule.Action = actionName(types.Optional(errs, path+".act", entry.Act, -1))
+		rule.DelaySeconds = types.Optional(errs, path+".delay", entry.Delay, 0)
+		rule.RemainingSeconds = types.Optional(errs, path+".remain", entry.Remain, 0)
+		return rule
+	}
+	if types.Optional(errs, path+".repeat", entry.Repeat, 0) == 1 {
+		for day, runs := range types.Optional(errs, path+".wday", entry.Wday, nil) {
+			if runs == 1 && day < len(weekdayNames) {
+				rule.Days = append(rule.Days, weekdayNames[day])
+			}
+		}
+	} else if entry.Year.Present {
+		rule.Date = fmt.Sprintf("%04d-%02d-%02d", types.Optional(errs, path+".year", entry.Year, 0),
+			types.Optional(errs, path+".month", entry.Month, 0), types.Optional(errs, path+".day", entry.Day, 0))
+	}
+	rule.Start = ruleEvent(entry.StimeOpt, entry.Smin, entry.Soffset, entry.Sact, path+".s", errs)
+	rule.End = ruleEvent(entry.EtimeOpt, entry.Emin, entry.Eoffset, entry.Eact, path+".e", errs)
+	return rule
+}
+
+// ruleEvent describes the start or end of a rule, whose fields are named with an s or e in front
+func ruleEvent(timeOpt, minutes, offset, action types.Field[int], prefix string, errs *types.DecodeErrors) *types.RuleEvent {
+	option := types.Optional(errs, prefix+"time_opt", timeOpt, -1)
+	if option < 0 {
+		return nil
+	}
+	afterMidnight := types.Optional(errs, prefix+"min", minutes, 0)
+	event := &types.RuleEvent{
+		Time:   fmt.Sprintf("%02d:%02d", afterMidnight/60, afterMidnight%60),
+		Action: actionName(types.Optional(errs, prefix+"act", action, -1)),
+	}
+	switch option {
+	case 1:
+		event.Relative = "sunrise"
+	case 2:
+		event.Relative = "sunset"
+	}
+	if event.Relative != "" {
+		event.OffsetMinutes = types.Optional(errs, prefix+"offset", offset, 0)
+	}
+	return event
+}
+
+func actionName(action int) string {
+	switch action {
+	case 0:
+		return "off"
+	case 1:
+		return "on"
+	default:
+		return ""
+	}
+}
+
+func onOrOff(on bool) string {
+	return actionName(boolToInt(on))
+}
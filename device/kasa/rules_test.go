@@ -0,0 +1,78 @@
+package kasa
+
+import (
+	"context"
+	"encoding/json"
+	"homepower/types"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNextScheduledActionIsTheEarliestEnabledStartOrEnd(t *testing.T) {
+	var reply ruleListReply
+	assert.NoError(t, json.Unmarshal([]byte(`{"rule_list":[
+		{"id":"A","enable":1,"repeat":1,"wday":[0,1,0,0,0,0,0],"stime_opt":0,"smin":480,"sact":1,"etime_opt":-1,"emin":0,"eact":-1},
+		{"id":"B","enable":1,"repeat":1,"wday":[0,0,0,1,0,0,0],"stime_opt":0,"smin":540,"sact":0,"etime_opt":0,"emin":1200,"eact":1},
+		{"id":"C","enable":0,"repeat":1,"wday":[1,1,1,1,1,1,1],"stime_opt":0,"smin":630,"sact":0,"etime_opt":-1,"emin":0,"eact":-1},
+		{"id":"D","enable":1,"repeat":0,"year":2024,"month":2,"day":7,"stime_opt":0,"smin":600,"sact":0,"etime_opt":-1,"emin":0,"eact":-1}
+	]}`), &reply))
+
+	wednesdayMorning := time.Date(2024, 2, 7, 10, 0, 0, 0, time.UTC)
+	at, turnsOn, found := nextScheduledAction(reply.RuleList.Value, wednesdayMorning)
+	assert.True(t, found)
+	assert.True(t, turnsOn)
+	assert.Equal(t, time.Date(2024, 2, 7, 20, 0, 0, 0, time.UTC), at)
+
+	// After B has ended, A's Monday start is next
+	at, turnsOn, found = nextScheduledAction(reply.RuleList.Value, wednesdayMorning.Add(11*time.Hour))
+	assert.True(t, found)
+	assert.True(t, turnsOn)
+	assert.Equal(t, time.Date(2024, 2, 12, 8, 0, 0, 0, time.UTC), at)
+
+	_, _, found = nextScheduledAction(nil, wednesdayMorning)
+	assert.False(t, found)
+}
+
+func TestSchedulesAndCountdownsAreExportedAndListed(t *testing.T) {
+	// The device's clock is an hour ahead of UTC, and its one rule switches it on every day at the next whole hour
+	deviceNow := time.Now().UTC().Add(time.Hour)
+	nextHour := (deviceNow.Hour() + 1) % 24
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	go serveLinkie(t, listener, map[string]string{
+		"system.get_sysinfo":   `{"system":{"get_sysinfo":{"active_mode":"count_down","alias":"Heater","dev_name":"Smart Wi-Fi Plug","deviceId":"8006","hwId":"45E2","sw_ver":"1.5.4","oemId":"3D34","mac":"AA:00:11:BB:22:33","model":"HS100(UK)","rssi":-60,"type":"IOT.SMARTPLUGSWITCH","relay_state":1,"led_off":0,"on_time":30,"updating":0,"err_code":0}}}`,
+		"count_down.get_rules": `{"count_down":{"get_rules":{"rule_list":[{"id":"CD1","name":"add timer","enable":1,"delay":1800,"act":0,"remain":1234}],"err_code":0}}}`,
+		"schedule.get_rules":   `{"schedule":{"get_rules":{"rule_list":[{"id":"S1","name":"Morning","enable":1,"wday":[1,1,1,1,1,1,1],"stime_opt":0,"smin":` + strconv.Itoa(nextHour*60) + `,"sact":1,"etime_opt":-1,"emin":0,"eact":-1,"repeat":1}],"version":2,"enable":1,"err_code":0}}}`,
+		"time.get_time":        `{"time":{"get_time":{"year":` + strconv.Itoa(deviceNow.Year()) + `,"month":` + strconv.Itoa(int(deviceNow.Month())) + `,"mday":` + strconv.Itoa(deviceNow.Day()) + `,"hour":` + strconv.Itoa(deviceNow.Hour()) + `,"min":` + strconv.Itoa(deviceNow.Minute()) + `,"sec":` + strconv.Itoa(deviceNow.Second()) + `,"err_code":0}}}`,
+		"anti_theft.get_rules": `{"anti_theft":{"get_rules":{"err_code":-2,"err_msg":"member not support"}}}`,
+	})
+
+	device := NewDevice("", "", &types.DeviceConfig{Name: "Heater", Room: "Study", Model: types.KasaHS100, Ip: "127.0.0.1"}, prometheus.NewRegistry())
+	device.connection = newDeviceConnection("127.0.0.1", uint16(listener.Addr().(*net.TCPAddr).Port))
+
+	assert.NoError(t, device.PollDeviceAndUpdateMetrics(context.Background()))
+	assert.Equal(t, 1234.0, testutil.ToFloat64(*device.metrics.countdownRemaining))
+	nextAction := time.Unix(int64(testutil.ToFloat64(*device.metrics.nextActionTimestamp)), 0)
+	assert.Equal(t, 0, nextAction.Minute())
+	assert.WithinDuration(t, time.Now().Add(30*time.Minute), nextAction, 31*time.Minute)
+	assert.Equal(t, "on", device.lastReport.Load().NextAction)
+
+	rules, err := device.Rules(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, &types.DeviceRules{
+		Schedules: []types.Rule{{
+			Id: "S1", Name: "Morning", Enabled: true,
+			Days:  []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"},
+			Start: &types.RuleEvent{Time: time.Date(0, 1, 1, nextHour, 0, 0, 0, time.UTC).Format("15:04"), Action: "on"},
+		}},
+		Countdowns: []types.Rule{{Id: "CD1", Name: "add timer", Enabled: true, Action: "off", DelaySeconds: 1800, RemainingSeconds: 1234}},
+		AwayMode:   []types.Rule{},
+	}, rules)
+}
@@ -0,0 +1,112 @@
+package kasa
+
+import (
+	"context"
+	"flag"
+	"homepower/device/kasa/kasatest"
+	"homepower/types"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden metrics in testdata from the simulator")
+
+var simulatedModels = map[string]types.DeviceType{
+	"HS100":  types.KasaHS100,
+	"HS110":  types.KasaHS110,
+	"KP115":  types.KasaKP115,
+	"KL50B":  types.KasaKL50B,
+	"KL110B": types.KasaKL110B,
+	"KL130B": types.KasaKL130B,
+}
+
+// simulate starts a simulator for the model, and a device that talks to it and registers its metrics in the registry
+func simulate(t *testing.T, model string, registry prometheus.Registerer) (*Device, *kasatest.Server) {
+	profile, err := kasatest.LoadProfile(model)
+	assert.NoError(t, err)
+	server, err := kasatest.Listen("127.0.0.1:0", profile)
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = server.Close() })
+
+	device := NewDevice("", "", &types.DeviceConfig{Name: "Simulated " + model, Room: "Lab", Model: simulatedModels[model], Ip: "127.0.0.1"}, registry)
+	device.connection = newDeviceConnection("127.0.0.1", server.Port())
+	return device, server
+}
+
+func TestMetricsOfEachSimulatedModelMatchTheGoldenFiles(t *testing.T) {
+	for _, model := range kasatest.Models {
+		t.Run(model, func(t *testing.T) {
+			registry := prometheus.NewRegistry()
+			device, _ := simulate(t, model, registry)
+			assert.NoError(t, device.PollDeviceAndUpdateMetrics(context.Background()))
+
+			golden := filepath.Join("testdata", model+".prom")
+			if *updateGolden {
+				writeGolden(t, registry, golden)
+			}
+			expected, err := os.Open(golden)
+			assert.NoError(t, err)
+			defer expected.Close()
+			assert.NoError(t, testutil.GatherAndCompare(registry, expected))
+		})
+	}
+}
+
+func writeGolden(t *testing.T, registry *prometheus.Registry, path string) {
+	families, err := registry.Gather()
+	assert.NoError(t, err)
+	file, err := os.Create(path)
+	assert.NoError(t, err)
+	defer file.Close()
+	encoder := expfmt.NewEncoder(file, expfmt.NewFormat(expfmt.TypeTextPlain))
+	for _, family := range families {
+		assert.NoError(t, encoder.Encode(family))
+	}
+}
+
+func TestFaultsFromTheSimulator(t *testing.T) {
+	for _, test := range []struct {
+		fault         kasatest.Fault
+		expectedError string
+	}{
+		{kasatest.TruncatedHeader, "could not read response length"},
+		{kasatest.SplitPackets, ""},
+		{kasatest.ErrorCode, "returned non-zero err_code: -1"},
+	} {
+		t.Run(test.fault.String(), func(t *testing.T) {
+			device, server := simulate(t, "HS110", prometheus.NewRegistry())
+			server.SetFault(test.fault)
+
+			err := device.PollDeviceAndUpdateMetrics(context.Background())
+			if test.expectedError == "" {
+				assert.NoError(t, err)
+				assert.Equal(t, 23387.0, testutil.ToFloat64(*device.metrics.powerMilliWatts))
+			} else {
+				assert.ErrorContains(t, err, test.expectedError)
+			}
+
+			// The device recovers once the fault clears
+			server.SetFault(kasatest.NoFault)
+			assert.NoError(t, device.PollDeviceAndUpdateMetrics(context.Background()))
+		})
+	}
+}
+
+func TestSimulatorKeepsTheStateItIsSet(t *testing.T) {
+	plug, _ := simulate(t, "HS100", prometheus.NewRegistry())
+	assert.NoError(t, plug.SetRelay(context.Background(), true))
+	assert.NoError(t, plug.PollDeviceAndUpdateMetrics(context.Background()))
+	assert.Equal(t, 1.0, testutil.ToFloat64(*plug.metrics.deviceTurnedOn))
+
+	bulb, _ := simulate(t, "KL130B", prometheus.NewRegistry())
+	off := false
+	assert.NoError(t, bulb.SetLightState(context.Background(), types.LightState{On: &off}))
+	assert.NoError(t, bulb.PollDeviceAndUpdateMetrics(context.Background()))
+	assert.Equal(t, 0.0, testutil.ToFloat64(*bulb.metrics.deviceTurnedOn))
+}
@@ -0,0 +1,58 @@
+package kasa
+
+import (
+	"context"
+	"homepower/types"
+	"net"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+const hs300SysInfo = `{"system":{"get_sysinfo":{"sw_ver":"1.0.6 Build 200821 Rel.090909","hw_ver":"1.0","model":"HS300(UK)","deviceId":"8006AA","oemId":"5C9E","hwId":"34C4","rssi":-52,"alias":"Desk Strip","status":"new","mic_type":"IOT.SMARTPLUGSWITCH","feature":"TIM:ENE","mac":"AA:00:11:BB:22:33","updating":0,"led_off":1,"children":[{"id":"8006AA00","state":1,"alias":"Monitor","on_time":120,"next_action":{"type":-1}},{"id":"01","state":0,"alias":"Lamp","on_time":0,"next_action":{"type":-1}}],"child_num":2,"err_code":0}}}`
+
+func TestPowerStripHasMetricsPerOutlet(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	go serveLinkie(t, listener, map[string]string{
+		"system.get_sysinfo":  hs300SysInfo,
+		"emeter.get_realtime": `{"emeter":{"get_realtime":{"voltage_mv":240100,"current_ma":150,"power_mw":30500,"total_wh":1200,"err_code":0}}}`,
+	})
+
+	registry := prometheus.NewRegistry()
+	config := &types.DeviceConfig{Name: "Strip", Room: "Office", Model: types.KasaHS300, Ip: "127.0.0.1", UseOutletAliases: true}
+	device := NewDevice("", "", config, registry)
+	device.connection = newDeviceConnection("127.0.0.1", uint16(listener.Addr().(*net.TCPAddr).Port))
+
+	assert.NoError(t, device.PollDeviceAndUpdateMetrics(context.Background()))
+	report := device.LastStatus().(*periodicDeviceReport)
+	assert.Equal(t, "8006AA01", report.Outlets[1].Id)
+	assert.Equal(t, 0.0, testutil.ToFloat64(*device.metrics.ledTurnedOn))
+
+	monitor := prometheus.Labels{"dev_name": "Monitor", "dev_full_name": "Office Monitor", "child_id": "8006AA00", "outlet_alias": "Monitor"}
+	lamp := prometheus.Labels{"dev_name": "Lamp", "dev_full_name": "Office Lamp", "child_id": "8006AA01", "outlet_alias": "Lamp"}
+	assert.Equal(t, 1.0, testutil.ToFloat64(device.metrics.outlets.turnedOn.With(monitor)))
+	assert.Equal(t, 120.0, testutil.ToFloat64(device.metrics.outlets.onTime.With(monitor)))
+	assert.Equal(t, 0.0, testutil.ToFloat64(device.metrics.outlets.turnedOn.With(lamp)))
+	assert.Equal(t, 30500.0, testutil.ToFloat64(device.metrics.outlets.powerMilliWatts.With(lamp)))
+	assert.Equal(t, 240100.0, testutil.ToFloat64(device.metrics.outlets.voltageMilliVolts.With(lamp)))
+
+	// Each outlet's eMeter is asked for after the reply to the rest of the poll, one request at a time
+	assert.NoError(t, device.PollDeviceAndUpdateMetrics(context.Background()))
+	assert.Equal(t, 30500.0, testutil.ToFloat64(device.metrics.outlets.powerMilliWatts.With(monitor)))
+
+	device.ResetMetricsToRogueValues()
+	assert.Equal(t, -1.0, testutil.ToFloat64(device.metrics.outlets.turnedOn.With(monitor)))
+	assert.Equal(t, 2, testutil.CollectAndCount(registry, "kasa_outlet_turned_on_bool"))
+}
+
+func TestOutletsAreNamedFromTheManifestByDefault(t *testing.T) {
+	config := &types.DeviceConfig{Name: "Strip", Room: "Office", Model: types.KasaKP303, Ip: "127.0.0.1"}
+	metrics := registerOutletMetrics(prometheus.NewRegistry(), config)
+	assert.Nil(t, metrics.powerMilliWatts)
+	assert.Equal(t, prometheus.Labels{"dev_name": "Strip", "dev_full_name": "Office Strip", "child_id": "8006AA00", "outlet_alias": "Monitor"},
+		metrics.labelsFor(&outletInfo{Id: "8006AA00", Alias: "Monitor"}))
+}
@@ -0,0 +1,165 @@
+package kasa
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"homepower/device/klap"
+)
+
+// KlapPort is where newer Kasa hardware and firmware, which no longer listen on Port, serve KLAP
+const KlapPort = 80
+
+// transport carries Linkie requests to the device and brings back the replies, either over the original XOR
+// obfuscated TCP protocol or wrapped in KLAP
+type transport interface {
+	openNewConnection(ctx context.Context) error
+	// closeCurrentConnection is called when a poll or command has finished with the connection, which a persistent
+	// one keeps open for the next
+	closeCurrentConnection()
+	queryDevice(ctx context.Context, request string) ([]byte, error)
+	// forgetSession drops anything kept between polls, after a failure
+	forgetSession()
+	protocolName() string
+}
+
+func (dc *deviceConnection) forgetSession() {
+	dc.disconnect()
+}
+func (dc *deviceConnection) protocolName() string {
+	return "Linkie" // as the devices name it in their ctrl_protocols
+}
+
+// klapTransport sends the same requests over KLAP.  The HTTP client keeps its own connection and session between
+// polls, so there is nothing to open or close for each one.
+type klapTransport struct {
+	connection *klap.Connection
+}
+
+func (t *klapTransport) openNewConnection(context.Context) error {
+	return nil
+}
+func (t *klapTransport) closeCurrentConnection() {}
+func (t *klapTransport) queryDevice(ctx context.Context, request string) ([]byte, error) {
+	return t.connection.Request(ctx, []byte(request))
+}
+func (t *klapTransport) forgetSession() {
+	t.connection.ForgetKeysAndSession()
+}
+func (t *klapTransport) protocolName() string {
+	return "KLAP"
+}
+
+// lazyTransport chooses a transport the first time a connection is opened, as tapo's lazyDeviceConnection does:
+// the XOR protocol if the device answers a get_sysinfo with it, and otherwise KLAP with the account's credentials.
+// Some newer devices accept connections on the XOR port but never answer, so a connection alone is not enough.  The choice is
+// made again after a failure, in case a firmware update has changed it.
+type lazyTransport struct {
+	email      string
+	password   string
+	ip         string
+	linkiePort uint16
+	klapPort   uint16
+	persistent bool // whether to keep a Linkie connection open between polls
+	delegate   transport
+}
+
+func newLazyTransport(email, password, ip string, linkiePort uint16, klapPort uint16) *lazyTransport {
+	return &lazyTransport{
+		email:      email,
+		password:   password,
+		ip:         ip,
+		linkiePort: linkiePort,
+		klapPort:   klapPort,
+	}
+}
+
+func (t *lazyTransport) openNewConnection(ctx context.Context) error {
+	if t.delegate == nil {
+		return t.choose(ctx)
+	}
+	return t.delegate.openNewConnection(ctx)
+}
+func (t *lazyTransport) closeCurrentConnection() {
+	if t.delegate != nil {
+		t.delegate.closeCurrentConnection()
+	}
+}
+func (t *lazyTransport) queryDevice(ctx context.Context, request string) ([]byte, error) {
+	if t.delegate == nil {
+		return nil, errors.New("no connection has been opened")
+	}
+	return t.delegate.queryDevice(ctx, request)
+}
+func (t *lazyTransport) forgetSession() {
+	if t.delegate != nil {
+		t.delegate.forgetSession()
+		t.delegate = nil
+	}
+}
+func (t *lazyTransport) protocolName() string {
+	if t.delegate == nil {
+		return ""
+	}
+	return t.delegate.protocolName()
+}
+
+func (t *lazyTransport) choose(ctx context.Context) error {
+	linkie := newDeviceConnection(t.ip, t.linkiePort)
+	linkie.persistent = t.persistent
+	linkieErr := linkie.openNewConnection(ctx)
+	if linkieErr == nil {
+		if linkieErr = answersSysInfo(ctx, linkie); linkieErr == nil {
+			// The device may close the connection after answering, so it is treated as kept and redialled if need be
+			linkie.reused = true
+			t.delegate = linkie
+			return nil
+		}
+		linkie.disconnect()
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	if t.email == "" && t.password == "" {
+		return fmt.Errorf("no account is configured to try KLAP instead: %w", linkieErr)
+	}
+
+	// Most Kasa firmware hashes the credentials as KLAP v1 does, but the newest does as Tapo devices do
+	var klapErr error
+	for _, version := range []klap.Version{klap.V1, klap.V2} {
+		connection, err := klap.NewConnection(t.email, t.password, t.ip, t.klapPort, version)
+		if err != nil {
+			return fmt.Errorf("could not initialise klap connection: %w", err)
+		}
+		if klapErr = connection.Handshake(ctx); klapErr == nil {
+			t.delegate = &klapTransport{connection: connection}
+			return nil
+		}
+		connection.ForgetKeysAndSession()
+		if !errors.Is(klapErr, klap.ErrCredentialsRejected) {
+			break
+		}
+	}
+	return fmt.Errorf("could not connect with either Linkie (%w) or KLAP (%w)", linkieErr, klapErr)
+}
+
+// answersSysInfo checks that the device replies to get_sysinfo over the connection just opened
+func answersSysInfo(ctx context.Context, linkie *deviceConnection) error {
+	response, err := linkie.queryDevice(ctx, sysInfoBody)
+	if err != nil {
+		return err
+	}
+	var reply struct {
+		System struct {
+			SysInfo json.RawMessage `json:"get_sysinfo"`
+		} `json:"system"`
+	}
+	if err := json.Unmarshal(response, &reply); err != nil {
+		return fmt.Errorf("could not unmarshal reply to get_sysinfo: %w", err)
+	}
+	if len(reply.System.SysInfo) == 0 {
+		return errors.New("device did not answer get_sysinfo")
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package kasa
+
+import (
+	"context"
+	"homepower/device/klap"
+	"homepower/device/klap/klaptest"
+	"homepower/types"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func closedPort(t *testing.T) uint16 {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	port := uint16(listener.Addr().(*net.TCPAddr).Port)
+	assert.NoError(t, listener.Close())
+	return port
+}
+
+func TestFallsBackToKlapWhenTheXorPortIsClosed(t *testing.T) {
+	for _, version := range []klap.Version{klap.V1, klap.V2} {
+		server := &klaptest.Server{Version: version, Username: "kasa@example.com", Password: "hunter2", Handler: func(request []byte) []byte {
+			return []byte(`{"system":{"get_sysinfo":{"active_mode":"none","alias":"Kettle","dev_name":"Smart Wi-Fi Plug","deviceId":"8006","hwId":"45E2","sw_ver":"1.0.5","oemId":"3D34","mac":"AA:00:11:BB:22:33","model":"HS100(UK)","rssi":-60,"type":"IOT.SMARTPLUGSWITCH","relay_state":1,"led_off":0,"on_time":30,"updating":0,"err_code":0}}}`)
+		}}
+		testServer, klapPort := klaptest.Start(t, server)
+
+		device := NewDevice(server.Username, server.Password, &types.DeviceConfig{Name: "Kettle", Room: "Kitchen", Model: types.KasaHS100, Ip: "127.0.0.1"}, prometheus.NewRegistry())
+		device.connection = newLazyTransport(server.Username, server.Password, "127.0.0.1", closedPort(t), klapPort)
+		assert.Equal(t, "", device.Protocol())
+
+		assert.NoError(t, device.PollDeviceAndUpdateMetrics(context.Background()))
+		assert.Equal(t, "KLAP", device.Protocol())
+		assert.Equal(t, 1.0, testutil.ToFloat64(*device.metrics.deviceTurnedOn))
+		testServer.Close()
+	}
+}
+
+func TestFallsBackToKlapWhenTheXorPortNeverAnswers(t *testing.T) {
+	server := &klaptest.Server{Version: klap.V2, Username: "kasa@example.com", Password: "hunter2", Handler: func(request []byte) []byte {
+		return []byte(`{"system":{"get_sysinfo":{"active_mode":"none","alias":"Kettle","dev_name":"Smart Wi-Fi Plug","deviceId":"8006","hwId":"45E2","sw_ver":"1.0.5","oemId":"3D34","mac":"AA:00:11:BB:22:33","model":"HS100(UK)","rssi":-60,"type":"IOT.SMARTPLUGSWITCH","relay_state":1,"led_off":0,"on_time":30,"updating":0,"err_code":0}}}`)
+	}}
+	testServer, klapPort := klaptest.Start(t, server)
+	defer testServer.Close()
+
+	// Accepts connections on the XOR port, as some newer firmware does, but never replies on them
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			connection, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer connection.Close()
+		}
+	}()
+
+	device := NewDevice(server.Username, server.Password, &types.DeviceConfig{Name: "Kettle", Room: "Kitchen", Model: types.KasaHS100, Ip: "127.0.0.1"}, prometheus.NewRegistry())
+	device.connection = newLazyTransport(server.Username, server.Password, "127.0.0.1", uint16(listener.Addr().(*net.TCPAddr).Port), klapPort)
+	assert.NoError(t, device.PollDeviceAndUpdateMetrics(context.Background()))
+	assert.Equal(t, "KLAP", device.Protocol())
+	assert.Equal(t, 1.0, testutil.ToFloat64(*device.metrics.deviceTurnedOn))
+}
+
+func TestNeedsAnAccountToFallBackToKlap(t *testing.T) {
+	transport := newLazyTransport("", "", "127.0.0.1", closedPort(t), closedPort(t))
+	assert.ErrorContains(t, transport.openNewConnection(context.Background()), "no account is configured")
+	assert.Equal(t, "", transport.protocolName())
+}
+
+// countingListener counts the connections that it accepts
+type countingListener struct {
+	net.Listener
+	accepted atomic.Int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	connection, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+	}
+	return connection, err
+}
+
+func TestKeptConnectionIsReusedAndRedialledWhenDropped(t *testing.T) {
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	listener := &countingListener{Listener: tcpListener}
+	defer listener.Close()
+	go serveLinkie(t, listener, map[string]string{
+		"system.get_sysinfo":                                        `{"system":{"get_sysinfo":{"sw_ver":"1.1.0","hw_ver":"2.0","model":"KL130B(UN)","description":"Smart Wi-Fi LED Bulb with Color Changing","alias":"Pendant","mic_type":"IOT.SMARTBULB","dev_state":"normal","mic_mac":"AA0011BB2233","deviceId":"8012","oemId":"D556","hwId":"111E","is_dimmable":1,"is_color":1,"is_variable_color_temp":1,"light_state":{"on_off":1,"mode":"normal","hue":0,"saturation":0,"color_temp":2700,"brightness":40},"rssi":-52,"active_mode":"none","err_code":0}}}`,
+		"smartlife.iot.common.emeter.get_realtime":                  `{"smartlife.iot.common.emeter":{"get_realtime":{"power_mw":7500,"total_wh":123,"err_code":0}}}`,
+		"smartlife.iot.common.emeter.get_daystat":                   `{"smartlife.iot.common.emeter":{"get_daystat":{"day_list":[],"err_code":0}}}`,
+		"smartlife.iot.common.emeter.get_monthstat":                 `{"smartlife.iot.common.emeter":{"get_monthstat":{"month_list":[],"err_code":0}}}`,
+		"smartlife.iot.smartbulb.lightingservice.get_light_details": `{"smartlife.iot.smartbulb.lightingservice":{"get_light_details":{"lamp_beam_angle":150,"min_voltage":110,"max_voltage":120,"wattage":10,"incandescent_equivalent":60,"max_lumens":800,"color_rendering_index":80,"err_code":0}}}`,
+	})
+
+	config := &types.DeviceConfig{Name: "Pendant", Room: "Snug", Model: types.KasaKL130B, Ip: "127.0.0.1", KeepConnectionOpen: true}
+	device := NewDevice("", "", config, prometheus.NewRegistry())
+	device.connection = newLazyTransport("", "", "127.0.0.1", uint16(tcpListener.Addr().(*net.TCPAddr).Port), closedPort(t))
+	device.connection.(*lazyTransport).persistent = true
+
+	// Each poll asks for the sysinfo, realtime and light details together
+	assert.NoError(t, device.PollDeviceAndUpdateMetrics(context.Background()))
+	assert.NoError(t, device.PollDeviceAndUpdateMetrics(context.Background()))
+	assert.Equal(t, int32(1), listener.accepted.Load())
+	assert.Equal(t, 7500.0, testutil.ToFloat64(*device.metrics.powerMilliWatts))
+	assert.Equal(t, 40.0, testutil.ToFloat64(*device.metrics.brightness))
+	assert.Equal(t, 800, device.lastReport.Load().MaximumLumens)
+
+	// As if the device had dropped the connection while idle
+	_ = device.connection.(*lazyTransport).delegate.(*deviceConnection).connection.Close()
+	assert.NoError(t, device.PollDeviceAndUpdateMetrics(context.Background()))
+	assert.Equal(t, int32(2), listener.accepted.Load())
+}
@@ -1,4 +1,4 @@
-package tapo
+package klap
 
 import (
 	"bytes"
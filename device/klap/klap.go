@@ -0,0 +1,271 @@
+// Package klap is the transport that newer Kasa and Tapo firmware speak over HTTP: a two step handshake proves that
+// both sides know the account's credentials, after which each request is AES encrypted and signed.  The requests
+// themselves are opaque here, as Kasa devices send the same JSON over KLAP as they do over port 9999, while Tapo
+// devices send their own method calls.
+package klap
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	V1 = iota + 1 // Kasa: md5 credentials, and a handshake that does not repeat the seeds
+	V2            // Tapo: sha1 credentials hashed together with both seeds
+)
+
+// Version decides how the credentials are hashed during the handshake; the encryption afterward is the same
+type Version int
+
+// ErrCredentialsRejected is returned by Handshake when the device was set up with a different account
+var ErrCredentialsRejected = errors.New("handshake 1 response hash did not match expected credentials")
+
+type addresses struct {
+	ip      string // x.x.x.x
+	baseUrl string // http://x.x.x.x:80
+	url     *url.URL
+}
+
+type Connection struct {
+	email     string // Hashed email of the account that originally set up the device
+	password  string // Isn't it weird how the email is hashed and the password isn't
+	version   Version
+	addresses addresses
+	client    *http.Client // A long-lived HTTP client that also retains the HTTP session state (e.g. cookies)
+
+	localSeed  []byte
+	remoteSeed []byte
+	authHash   []byte
+	encryption *encryptionContext
+}
+
+//goland:noinspection HttpUrlsUsage
+func NewConnection(email, password, deviceIp string, port uint16, version Version) (*Connection, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create new cookie jar whilst initialising %s: %w", deviceIp, err)
+	}
+	tr := &http.Transport{
+		DisableKeepAlives:      false,
+		DisableCompression:     false,
+		MaxIdleConnsPerHost:    1,
+		MaxConnsPerHost:        1,
+		IdleConnTimeout:        5 * time.Minute,
+		ResponseHeaderTimeout:  5 * time.Second,
+		MaxResponseHeaderBytes: 4096,
+		ForceAttemptHTTP2:      false,
+	}
+	baseUrl := "http://" + deviceIp + ":" + strconv.FormatUint(uint64(port), 10)
+	parsedUrl, err := url.Parse(baseUrl + "/app/request")
+	if err != nil {
+		return nil, fmt.Errorf("could not parse '%s' as a URL object: %w", baseUrl, err)
+	}
+	return &Connection{
+		email:    email,
+		password: password,
+		version:  version,
+		addresses: addresses{
+			ip:      deviceIp,
+			baseUrl: baseUrl,
+			url:     parsedUrl,
+		},
+		client: &http.Client{
+			Transport: tr,
+			Jar:       jar,
+			Timeout:   10 * time.Second,
+		},
+	}, nil
+}
+
+func (dc *Connection) applyHeadersTo(request *http.Request) {
+	request.Header.Set("Referer", dc.addresses.baseUrl)
+	request.Header.Set("requestByApp", "true")
+	request.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	request.Header.Set("Accept", "application/json")
+	request.Header.Set("Connection", "Keep-Alive")
+	request.Header.Set("Host", dc.addresses.ip)
+	request.Header.Set("User-Agent", "okhttp/3.12.13")
+}
+
+// AuthHash is what both sides derive from the account's credentials, and is never itself sent
+func AuthHash(version Version, email, password string) []byte {
+	if version == V1 {
+		userHash := md5.Sum([]byte(email))
+		passHash := md5.Sum([]byte(password))
+		authHash := md5.Sum(append(userHash[:], passHash[:]...))
+		return authHash[:]
+	}
+	userHash := sha1.Sum([]byte(email))
+	passHash := sha1.Sum([]byte(password))
+	authHash := sha256.Sum256(append(userHash[:], passHash[:]...))
+	return authHash[:]
+}
+
+// Handshake1Hash is what the device returns after its seed in the first handshake, to prove it knows the credentials
+func Handshake1Hash(version Version, localSeed, remoteSeed, authHash []byte) []byte {
+	var hash [32]byte
+	if version == V1 {
+		hash = sha256.Sum256(append(bytes.Clone(localSeed), authHash...))
+	} else {
+		hash = sha256.Sum256(append(append(bytes.Clone(localSeed), remoteSeed...), authHash...))
+	}
+	return hash[:]
+}
+
+// Handshake2Hash is what the client sends in the second handshake, to prove it knows the credentials in turn
+func Handshake2Hash(version Version, localSeed, remoteSeed, authHash []byte) []byte {
+	var hash [32]byte
+	if version == V1 {
+		hash = sha256.Sum256(append(bytes.Clone(remoteSeed), authHash...))
+	} else {
+		hash = sha256.Sum256(append(append(bytes.Clone(remoteSeed), localSeed...), authHash...))
+	}
+	return hash[:]
+}
+
+func (dc *Connection) Handshake(ctx context.Context) error {
+	dc.localSeed = make([]byte, 16)
+	if _, err := rand.Read(dc.localSeed); err != nil {
+		return err
+	}
+	request1, err := http.NewRequestWithContext(ctx, http.MethodPost, dc.addresses.baseUrl+"/app/handshake1", bytes.NewReader(dc.localSeed))
+	if err != nil {
+		return err
+	}
+	dc.applyHeadersTo(request1)
+
+	handshakeResponse, err := dc.exchangeExpect200(request1)
+	if err != nil {
+		return err
+	}
+	if len(handshakeResponse) != 48 {
+		return fmt.Errorf("expected handshake 1 response to be 48 byte but got %d", len(handshakeResponse))
+	}
+	dc.remoteSeed = handshakeResponse[0:16]
+	dc.authHash = AuthHash(dc.version, dc.email, dc.password)
+	if !bytes.Equal(Handshake1Hash(dc.version, dc.localSeed, dc.remoteSeed, dc.authHash), handshakeResponse[16:]) {
+		return ErrCredentialsRejected
+	}
+	if err := sleepWithContext(ctx, 250*time.Millisecond); err != nil {
+		return err
+	}
+
+	payload := Handshake2Hash(dc.version, dc.localSeed, dc.remoteSeed, dc.authHash)
+	request2, err := http.NewRequestWithContext(ctx, http.MethodPost, dc.addresses.baseUrl+"/app/handshake2", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	_, err = dc.exchangeExpect200(request2)
+	if err != nil {
+		return err
+	}
+
+	localRemoteAuthBuffer := append(append(bytes.Clone(dc.localSeed), dc.remoteSeed...), dc.authHash...)
+	dc.encryption, err = setupEncryption(localRemoteAuthBuffer)
+	if err != nil {
+		return err
+	}
+	if err := sleepWithContext(ctx, 500*time.Millisecond); err != nil {
+		return err
+	}
+	fmt.Printf("KLAP Handshake Complete for %s\n", dc.addresses.ip)
+	return nil
+}
+
+func sleepWithContext(ctx context.Context, duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (dc *Connection) HasExchangedKeys() bool {
+	return dc.hasValidSessionCookie() && dc.localSeed != nil && len(dc.localSeed) > 0
+}
+
+func (dc *Connection) exchangeExpect200(request *http.Request) ([]byte, error) {
+	response, err := dc.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(response.Body)
+	if response.StatusCode != 200 {
+		return nil, errors.New("expected status code 200, got " + strconv.Itoa(response.StatusCode))
+	}
+	responseBody, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	return responseBody, nil
+}
+
+func (dc *Connection) hasValidSessionCookie() bool {
+	for _, cookie := range dc.client.Jar.Cookies(dc.addresses.url) {
+		if cookie.Name == "TP_SESSIONID" {
+			if cookie.Expires.Year() < 1601 { // has no expiry
+				return true
+			}
+			return cookie.Expires.After(time.Now())
+		}
+	}
+	return false
+}
+
+func (dc *Connection) ForgetKeysAndSession() {
+	dc.client.CloseIdleConnections()
+	dc.client.Jar.SetCookies(dc.addresses.url, []*http.Cookie{{
+		Name:   "TP_SESSIONID",
+		MaxAge: -1,
+	}})
+	dc.localSeed = nil
+	dc.remoteSeed = nil
+	dc.authHash = nil
+}
+
+// Request sends one encrypted request and returns the decrypted response, doing the handshake first if there is no
+// session.  Any failure forgets the session, so that the next request starts again with a fresh handshake.
+func (dc *Connection) Request(ctx context.Context, payload []byte) ([]byte, error) {
+	if !dc.HasExchangedKeys() {
+		log.Println("Not logged in, will log in before making api request")
+		if err := dc.Handshake(ctx); err != nil {
+			dc.ForgetKeysAndSession()
+			return nil, fmt.Errorf("could not log in before making API call: %w", err)
+		}
+	}
+
+	encryptedPayload := dc.encryption.Encrypt(payload)
+	request, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		dc.addresses.baseUrl+"/app/request?seq="+strconv.Itoa(int(dc.encryption.sequenceNumber)),
+		bytes.NewReader(encryptedPayload))
+	if err != nil {
+		return nil, err
+	}
+	dc.applyHeadersTo(request)
+	response, err := dc.exchangeExpect200(request)
+	if err != nil {
+		dc.ForgetKeysAndSession()
+		return nil, err
+	}
+	return dc.encryption.Decrypt(response)
+}
@@ -0,0 +1,67 @@
+package klap_test
+
+import (
+	"context"
+	"homepower/device/klap"
+	"homepower/device/klap/klaptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func echo(request []byte) []byte {
+	return request
+}
+
+func TestKlapLogin(t *testing.T) {
+	for _, version := range []klap.Version{klap.V1, klap.V2} {
+		server := &klaptest.Server{Version: version, Username: "test@example.com", Password: "test_password", Handler: echo}
+		testServer, port := klaptest.Start(t, server)
+		defer testServer.Close()
+
+		dc, err := klap.NewConnection(server.Username, server.Password, "127.0.0.1", port, version)
+		assert.NoError(t, err)
+		assert.Equal(t, false, dc.HasExchangedKeys())
+
+		err = dc.Handshake(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, true, dc.HasExchangedKeys())
+
+		for _, request := range []string{`{"system":{"get_sysinfo":null}}`, `{"method":"get_device_info"}`} {
+			response, err := dc.Request(context.Background(), []byte(request))
+			assert.NoError(t, err)
+			assert.Equal(t, request, string(response))
+		}
+	}
+}
+
+func TestKlapLoginRejectsTheWrongVersionOrCredentials(t *testing.T) {
+	server := &klaptest.Server{Version: klap.V1, Username: "test@example.com", Password: "test_password", Handler: echo}
+	testServer, port := klaptest.Start(t, server)
+	defer testServer.Close()
+
+	dc, err := klap.NewConnection(server.Username, server.Password, "127.0.0.1", port, klap.V2)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, dc.Handshake(context.Background()), klap.ErrCredentialsRejected)
+
+	dc, err = klap.NewConnection(server.Username, "wrong_password", "127.0.0.1", port, klap.V1)
+	assert.NoError(t, err)
+	_, err = dc.Request(context.Background(), []byte("{}"))
+	assert.ErrorIs(t, err, klap.ErrCredentialsRejected)
+	assert.Equal(t, false, dc.HasExchangedKeys())
+}
+
+func TestKlapLoginAbortsWhenCancelled(t *testing.T) {
+	server := &klaptest.Server{Version: klap.V2, Username: "test@example.com", Password: "test_password", Handler: echo}
+	testServer, port := klaptest.Start(t, server)
+	defer testServer.Close()
+
+	dc, err := klap.NewConnection(server.Username, server.Password, "127.0.0.1", port, klap.V2)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = dc.Handshake(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, false, dc.HasExchangedKeys())
+}
@@ -0,0 +1,174 @@
+// Package klaptest provides a fake device that speaks KLAP, for testing the drivers that use the klap package
+package klaptest
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"homepower/device/klap"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mergermarket/go-pkcs7"
+)
+
+type Server struct {
+	Version  klap.Version
+	Username string
+	Password string
+	// Handler answers each decrypted request; its reply is encrypted before it is sent
+	Handler func(request []byte) []byte
+
+	t        *testing.T
+	authHash []byte
+	mutex    sync.Mutex
+	sessions map[string]*encryption
+	pending  map[string][]byte // the auth buffer of each session that has done the first handshake but not the second
+}
+
+// Start serves the handshake and request endpoints on a local port, which it returns
+func Start(t *testing.T, server *Server) (*httptest.Server, uint16) {
+	server.t = t
+	server.authHash = klap.AuthHash(server.Version, server.Username, server.Password)
+	server.sessions = map[string]*encryption{}
+	server.pending = map[string][]byte{}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /app/handshake1", server.handshake1)
+	mux.HandleFunc("POST /app/handshake2", server.handshake2)
+	mux.HandleFunc("POST /app/request", server.handleRequest)
+	testServer := httptest.NewServer(mux)
+	port, err := strconv.Atoi(testServer.URL[strings.LastIndex(testServer.URL, ":")+1:])
+	if err != nil {
+		t.Fatalf("could not find port of test server: %v", err)
+	}
+	return testServer, uint16(port)
+}
+
+func (s *Server) handshake1(writer http.ResponseWriter, request *http.Request) {
+	clientSeed, err := io.ReadAll(request.Body)
+	if err != nil || len(clientSeed) != 16 {
+		http.Error(writer, "expected a 16 byte seed", http.StatusBadRequest)
+		return
+	}
+	serverSeed := make([]byte, 16)
+	_, _ = rand.Read(serverSeed)
+	sessionId := base64.StdEncoding.EncodeToString(serverSeed)
+
+	s.mutex.Lock()
+	s.pending[sessionId] = append(append(bytes.Clone(clientSeed), serverSeed...), s.authHash...)
+	s.mutex.Unlock()
+
+	http.SetCookie(writer, &http.Cookie{Name: "TP_SESSIONID", Value: sessionId, Expires: time.Now().Add(24 * time.Hour)})
+	_, _ = writer.Write(append(bytes.Clone(serverSeed), klap.Handshake1Hash(s.Version, clientSeed, serverSeed, s.authHash)...))
+}
+
+func (s *Server) handshake2(writer http.ResponseWriter, request *http.Request) {
+	sessionId := sessionIdFrom(request)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	buffer, found := s.pending[sessionId]
+	challenge, err := io.ReadAll(request.Body)
+	if !found || err != nil {
+		http.Error(writer, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	clientSeed, serverSeed := buffer[0:16], buffer[16:32]
+	if !bytes.Equal(challenge, klap.Handshake2Hash(s.Version, clientSeed, serverSeed, s.authHash)) {
+		http.Error(writer, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	delete(s.pending, sessionId)
+	s.sessions[sessionId] = newEncryption(buffer)
+	_, _ = writer.Write([]byte{1})
+}
+
+func (s *Server) handleRequest(writer http.ResponseWriter, request *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	session, found := s.sessions[sessionIdFrom(request)]
+	if !found {
+		http.Error(writer, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	requestBytes, err := io.ReadAll(request.Body)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	clearText, err := session.decrypt(requestBytes)
+	if err != nil {
+		s.t.Errorf("could not decrypt request: %v", err)
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	_, _ = writer.Write(session.encrypt(s.Handler(clearText)))
+}
+
+func sessionIdFrom(request *http.Request) string {
+	if cookie, err := request.Cookie("TP_SESSIONID"); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// encryption is the device's side of the session, written separately from the client's so that each checks the other
+type encryption struct {
+	block          cipher.Block
+	iv             []byte
+	signature      []byte
+	sequenceNumber int32
+}
+
+func newEncryption(localRemoteAuthBuffer []byte) *encryption {
+	keyHash := sha256.Sum256(append([]byte("lsk"), localRemoteAuthBuffer...))
+	ivHash := sha256.Sum256(append([]byte("iv"), localRemoteAuthBuffer...))
+	sigHash := sha256.Sum256(append([]byte("ldk"), localRemoteAuthBuffer...))
+	block, _ := aes.NewCipher(keyHash[:16])
+	return &encryption{
+		block:          block,
+		iv:             ivHash[:12],
+		signature:      sigHash[:28],
+		sequenceNumber: int32(binary.BigEndian.Uint32(ivHash[sha256.Size-4:])),
+	}
+}
+
+func (e *encryption) ivAndSignature(cipherText []byte) ([]byte, []byte) {
+	iv := binary.BigEndian.AppendUint32(bytes.Clone(e.iv), uint32(e.sequenceNumber))
+	signature := sha256.Sum256(append(binary.BigEndian.AppendUint32(bytes.Clone(e.signature), uint32(e.sequenceNumber)), cipherText...))
+	return iv, signature[:]
+}
+
+func (e *encryption) decrypt(data []byte) ([]byte, error) {
+	e.sequenceNumber++
+	if len(data) < 48 || (len(data)-32)%aes.BlockSize != 0 {
+		return nil, errors.New("request is not a whole number of blocks after its signature")
+	}
+	iv, signature := e.ivAndSignature(data[32:])
+	if !bytes.Equal(signature, data[:32]) {
+		return nil, errors.New("request has a bad signature")
+	}
+	clearText := make([]byte, len(data)-32)
+	cipher.NewCBCDecrypter(e.block, iv).CryptBlocks(clearText, data[32:])
+	return pkcs7.Unpad(clearText, aes.BlockSize)
+}
+
+func (e *encryption) encrypt(data []byte) []byte {
+	padded, _ := pkcs7.Pad(data, aes.BlockSize)
+	cipherText := make([]byte, len(padded))
+	iv, _ := e.ivAndSignature(nil)
+	cipher.NewCBCEncrypter(e.block, iv).CryptBlocks(cipherText, padded)
+	_, signature := e.ivAndSignature(cipherText)
+	return append(signature, cipherText...)
+}
@@ -0,0 +1,135 @@
+package tapo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Power strips expose each socket, and hubs each sensor, as a child device with its own device id, which can only be
+// listed through the parent and called through control_child
+
+type methodCall struct {
+	Method string `json:"method"`
+	Params any    `json:"params,omitempty"`
+}
+
+type childDeviceListParams struct {
+	StartIndex int `json:"start_index"`
+}
+
+// controlChildParams wraps the method in a multipleRequest, which is the only form of request that sockets accept
+func controlChildParams(childId string, method string) any {
+	return struct {
+		DeviceId    string     `json:"device_id"`
+		RequestData methodCall `json:"requestData"`
+	}{
+		DeviceId: childId,
+		RequestData: methodCall{
+			Method: "multipleRequest",
+			Params: struct {
+				Requests []methodCall `json:"requests"`
+			}{Requests: []methodCall{{Method: method}}},
+		},
+	}
+}
+
+// unwrapControlChildResult finds the result of the one request that control_child carried to the socket
+func unwrapControlChildResult(result map[string]interface{}) (map[string]interface{}, error) {
+	responseData, isMap := result["responseData"].(map[string]interface{})
+	if !isMap {
+		return nil, errors.New("control_child response has no responseData")
+	}
+	if errorCode := intFrom(responseData["error_code"]); errorCode != 0 {
+		return nil, errors.New("non-zero error code returned by multipleRequest: " + strconv.Itoa(errorCode))
+	}
+	multipleResult, _ := responseData["result"].(map[string]interface{})
+	responses, _ := multipleResult["responses"].([]interface{})
+	if len(responses) != 1 {
+		return nil, errors.New("expected one response from multipleRequest but got " + strconv.Itoa(len(responses)))
+	}
+	response, _ := responses[0].(map[string]interface{})
+	if errorCode := intFrom(response["error_code"]); errorCode != 0 {
+		return nil, errors.New("non-zero error code returned by child: " + strconv.Itoa(errorCode))
+	}
+	childResult, isMap := response["result"].(map[string]interface{})
+	if !isMap {
+		return nil, errors.New("child's response has no result")
+	}
+	return childResult, nil
+}
+
+type powerStripInfo struct {
+	Outlets []outletInfo
+}
+
+type outletInfo struct {
+	Id       string
+	Nickname string
+	Position int
+	RelayOn  bool
+	OnTime   time.Duration
+	*energyMeterInfo
+}
+
+// listChildren fetches every child of the device, a page at a time
+func (dev *Device) listChildren(ctx context.Context) ([]map[string]interface{}, error) {
+	return listAllPages(ctx, dev.connection.GetChildDeviceList, "child_device_list")
+}
+
+// listAllPages fetches every entry of a list that the device gives a page at a time, along with the sum of its entries
+func listAllPages(ctx context.Context, getPage func(ctx context.Context, startIndex int) (map[string]interface{}, error), listName string) ([]map[string]interface{}, error) {
+	var entries []map[string]interface{}
+	for {
+		page, err := getPage(ctx, len(entries))
+		if err != nil {
+			return nil, fmt.Errorf("could not make API call while fetching %s: %w", listName, err)
+		}
+		pageOfEntries, _ := page[listName].([]interface{})
+		for _, entry := range pageOfEntries {
+			if entryInfo, isMap := entry.(map[string]interface{}); isMap {
+				entries = append(entries, entryInfo)
+			}
+		}
+		if len(pageOfEntries) == 0 || len(entries) >= intFrom(page["sum"]) {
+			return entries, nil
+		}
+	}
+}
+
+// populateOutlets lists the strip's sockets, then reads each one's energy usage where it has its own meter
+func (dev *Device) populateOutlets(ctx context.Context, status *deviceStatus) error {
+	children, err := dev.listChildren(ctx)
+	if err != nil {
+		return err
+	}
+	strip := &powerStripInfo{}
+	for _, childInfo := range children {
+		strip.Outlets = append(strip.Outlets, outletInfo{
+			Id:       stringFrom(childInfo["device_id"]),
+			Nickname: decodeNickname(stringFrom(childInfo["nickname"])),
+			Position: intFrom(childInfo["position"]),
+			RelayOn:  childInfo["device_on"] == true,
+			OnTime:   time.Duration(intFrom(childInfo["on_time"])) * time.Second,
+		})
+	}
+	if dev.features.hasOutletEnergyMonitoring {
+		for i := range strip.Outlets {
+			outlet := &strip.Outlets[i]
+			responseResult, err := dev.connection.ControlChild(ctx, outlet.Id, "get_energy_usage")
+			if err != nil {
+				return fmt.Errorf("could not make API call while fetching energy usage of socket %s: %w", outlet.Nickname, err)
+			}
+			outlet.energyMeterInfo = energyMeterInfoFrom(responseResult)
+		}
+	}
+	status.powerStripInfo = strip
+	return nil
+}
+
+func stringFrom(value interface{}) string {
+	text, _ := value.(string)
+	return text
+}
@@ -0,0 +1,159 @@
+package tapo
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"homepower/types"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestP304MSocketsAreListedAPageAtATimeWithTheirOwnLabels(t *testing.T) {
+	server := &klapServer{
+		t:        t,
+		username: "test@example.com",
+		password: "test_password",
+		handler:  handleKlapP304M,
+	}
+	testServer, port := createKlapServer(t, server)
+	defer testServer.Close()
+
+	device, err := NewDevice(server.username, server.password, &types.DeviceConfig{
+		Name:  "Desk Strip",
+		Room:  "Office",
+		Model: types.TapoP304M,
+		Ip:    "127.0.0.1",
+	}, prometheus.NewRegistry(), port)
+	assert.NoError(t, err)
+
+	assert.NoError(t, device.PollDeviceAndUpdateMetrics(context.Background()))
+	// The strip has no relay of its own, only its sockets do
+	assert.Nil(t, device.metrics.deviceTurnedOn)
+	outlets := device.metrics.outlets
+	assert.Equal(t, 4, testutil.CollectAndCount(outlets.turnedOn))
+	monitor := prometheus.Labels{"dev_name": "Monitor", "dev_full_name": "Office Monitor", "child_id": "80220001", "outlet_alias": "Monitor"}
+	assert.Equal(t, 1.0, testutil.ToFloat64(outlets.turnedOn.With(monitor)))
+	assert.Equal(t, 3600.0, testutil.ToFloat64(outlets.onTime.With(monitor)))
+	assert.Equal(t, 21500.0, testutil.ToFloat64(outlets.powerMilliWatts.With(monitor)))
+	assert.Equal(t, 120.0, testutil.ToFloat64(outlets.todayEnergyWattHours.With(monitor)))
+	unnamed := prometheus.Labels{"dev_name": "Desk Strip 4", "dev_full_name": "Office Desk Strip 4", "child_id": "80220004", "outlet_alias": ""}
+	assert.Equal(t, 0.0, testutil.ToFloat64(outlets.turnedOn.With(unnamed)))
+
+	device.ResetMetricsToRogueValues()
+	assert.Equal(t, -1.0, testutil.ToFloat64(outlets.turnedOn.With(monitor)))
+}
+
+func TestControlChildResultIsUnwrapped(t *testing.T) {
+	var result map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(`{"responseData":{"result":{"responses":[{"method":"get_energy_usage","result":{"current_power":5},"error_code":0}]},"error_code":0}}`), &result))
+	childResult, err := unwrapControlChildResult(result)
+	assert.NoError(t, err)
+	assert.Equal(t, 5.0, childResult["current_power"])
+
+	assert.NoError(t, json.Unmarshal([]byte(`{"responseData":{"result":{"responses":[{"method":"get_energy_usage","error_code":-1001}]},"error_code":0}}`), &result))
+	_, err = unwrapControlChildResult(result)
+	assert.ErrorContains(t, err, "non-zero error code returned by child: -1001")
+}
+
+var p304MSockets = []map[string]any{
+	p304MSocket("80220001", "Monitor", 1, true, 3600),
+	p304MSocket("80220002", "Desk Lamp", 2, false, 0),
+	p304MSocket("80220003", "Speakers", 3, true, 60),
+	p304MSocket("80220004", "", 4, false, 0),
+}
+
+func p304MSocket(id string, nickname string, position int, on bool, onTime int) map[string]any {
+	return map[string]any{
+		"device_id":   id,
+		"nickname":    base64.StdEncoding.EncodeToString([]byte(nickname)),
+		"position":    position,
+		"slot_number": 4,
+		"device_on":   on,
+		"on_time":     onTime,
+		"model":       "P304M",
+		"type":        "SMART.TAPOPLUG",
+	}
+}
+
+func handleKlapP304M(t *testing.T, method string, params any) ([]byte, error) {
+	t.Logf("Method: %s, Params: %s", method, params)
+	reply := func(result any) ([]byte, error) {
+		return json.Marshal(struct {
+			ErrorCode int `json:"error_code"`
+			Result    any `json:"result"`
+		}{ErrorCode: 0, Result: result})
+	}
+	switch method {
+	case "get_device_info":
+		return reply(map[string]any{
+			"device_id":    "80220000",
+			"fw_ver":       "1.0.5 Build 240105 Rel.141436",
+			"hw_ver":       "1.0",
+			"type":         "SMART.TAPOPLUG",
+			"model":        "P304M",
+			"mac":          "AA-BB-CC-11-22-33",
+			"hw_id":        "999888777666555444333222111000AA",
+			"oem_id":       "A3B2C1A3B2C1A3B2C1A3B2C1A3B2C1A3",
+			"nickname":     "RGVzayBTdHJpcA==", // base64 for "Desk Strip"
+			"rssi":         -50,
+			"signal_level": 2,
+		})
+	case "get_child_device_list":
+		// Two sockets a page, as the real strip gives ten
+		var listParams childDeviceListParams
+		assert.NoError(t, json.Unmarshal(params.(json.RawMessage), &listParams))
+		end := min(listParams.StartIndex+2, len(p304MSockets))
+		return reply(map[string]any{
+			"child_device_list": p304MSockets[listParams.StartIndex:end],
+			"start_index":       listParams.StartIndex,
+			"sum":               len(p304MSockets),
+		})
+	case "control_child":
+		var controlParams struct {
+			DeviceId    string `json:"device_id"`
+			RequestData struct {
+				Method string `json:"method"`
+				Params struct {
+					Requests []methodCall `json:"requests"`
+				} `json:"params"`
+			} `json:"requestData"`
+		}
+		assert.NoError(t, json.Unmarshal(params.(json.RawMessage), &controlParams))
+		assert.Equal(t, "multipleRequest", controlParams.RequestData.Method)
+		assert.Equal(t, "get_energy_usage", controlParams.RequestData.Params.Requests[0].Method)
+		power := 0
+		if controlParams.DeviceId == "80220001" {
+			power = 21500
+		}
+		return reply(map[string]any{
+			"responseData": map[string]any{
+				"error_code": 0,
+				"result": map[string]any{
+					"responses": []any{map[string]any{
+						"method":     "get_energy_usage",
+						"error_code": 0,
+						"result":     map[string]any{"current_power": power, "today_energy": 120, "month_energy": 3400},
+					}},
+				},
+			},
+		})
+	case "component_nego":
+		return componentNegoReply(append(plugComponents, "child_device", "control_child")...)
+	case "get_child_device_component_list":
+		children := []map[string]any{}
+		for _, socket := range p304MSockets {
+			children = append(children, map[string]any{
+				"device_id":      socket["device_id"],
+				"component_list": componentList(append(plugComponents, "energy_monitoring")...),
+			})
+		}
+		return reply(map[string]any{"child_component_list": children, "start_index": 0, "sum": len(children)})
+	default:
+		return nil, errors.New("method not known: " + method)
+	}
+}
@@ -2,14 +2,46 @@ package tapo
 
 import "homepower/types"
 
+// These decide the features of each known model, for firmware that cannot list its components through component_nego
+
 func isSwitch(config *types.DeviceConfig) bool {
 	return config.Model == types.TapoP100 || config.Model == types.TapoP110
 }
 
 func isLight(config *types.DeviceConfig) bool {
-	return config.Model == types.TapoL900
+	switch config.Model {
+	case types.TapoL900, types.TapoL510, types.TapoL530, types.TapoL535, types.TapoL630:
+		return true
+	default:
+		return false
+	}
+}
+
+// hasColour is true for lights with a hue and saturation; the L510 is only dimmable
+func hasColour(config *types.DeviceConfig) bool {
+	return isLight(config) && config.Model != types.TapoL510
+}
+
+// hasColourTemperature is true for lights with a colour temperature, which every known model with a colour has.  Whether
+// it can actually be changed is only known from the color_temp_range that the bulb reports.
+func hasColourTemperature(config *types.DeviceConfig) bool {
+	return hasColour(config)
 }
 
 func hasEnergyMonitoring(config *types.DeviceConfig) bool {
 	return config.Model == types.TapoP110
 }
+
+// hasOutlets is true for power strips, whose sockets are each a child device
+func hasOutlets(config *types.DeviceConfig) bool {
+	return config.Model == types.TapoP300 || config.Model == types.TapoP304M
+}
+
+func hasOutletEnergyMonitoring(config *types.DeviceConfig) bool {
+	return config.Model == types.TapoP304M
+}
+
+// isHub is true for hubs, whose children are battery-powered sensors and radiator valves
+func isHub(config *types.DeviceConfig) bool {
+	return config.Model == types.TapoH100
+}
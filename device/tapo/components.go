@@ -0,0 +1,116 @@
+package tapo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"homepower/types"
+	"log"
+)
+
+// Firmware lists the components it has in answer to component_nego, each with the version of its API, e.g.
+//   {"component_list":[{"id":"device","ver_code":2},{"id":"energy_monitoring","ver_code":2},{"id":"countdown","ver_code":1}]}
+// A power strip lists each socket's components through get_child_device_component_list, a page at a time:
+//   {"child_component_list":[{"device_id":"8022...","component_list":[...]}],"start_index":0,"sum":4}
+// Firmware too old to know component_nego answers it with error -1, so its features are taken from the model instead.
+
+// features decides which metrics are registered and which methods are called on each poll
+type features struct {
+	isSwitch                  bool
+	isLight                   bool
+	hasColour                 bool
+	hasColourTemperature      bool
+	hasEnergyMonitoring       bool
+	hasOutlets                bool
+	hasOutletEnergyMonitoring bool
+	isHub                     bool
+}
+
+// featuresForModel is used for firmware that cannot list its components
+func featuresForModel(config *types.DeviceConfig) features {
+	return features{
+		isSwitch:                  isSwitch(config),
+		isLight:                   isLight(config),
+		hasColour:                 hasColour(config),
+		hasColourTemperature:      hasColourTemperature(config),
+		hasEnergyMonitoring:       hasEnergyMonitoring(config),
+		hasOutlets:                hasOutlets(config),
+		hasOutletEnergyMonitoring: hasOutletEnergyMonitoring(config),
+		isHub:                     isHub(config),
+	}
+}
+
+// featuresFromComponents works out the features from the components and the device's type, e.g. SMART.TAPOPLUG.  A
+// strip's own energy meter, if it lists one, only sums those of its sockets, so is left to them.
+func featuresFromComponents(components map[string]int, deviceType string) features {
+	has := func(component string) bool { _, found := components[component]; return found }
+	found := features{
+		isLight:              has("brightness"),
+		hasColour:            has("color"),
+		hasColourTemperature: has("color_temperature"),
+		isHub:                deviceType == "SMART.TAPOHUB",
+	}
+	found.hasOutlets = has("child_device") && !found.isHub
+	found.isSwitch = deviceType == "SMART.TAPOPLUG" && !found.hasOutlets && !found.isLight
+	found.hasEnergyMonitoring = has("energy_monitoring") && !found.hasOutlets
+	return found
+}
+
+// firmwareIdentity tells whether the features negotiated before still hold: a firmware update can add components, and
+// the device's address can be given to another device
+type firmwareIdentity struct {
+	deviceId        string
+	firmwareVersion string
+}
+
+func identityOf(status *deviceStatus) firmwareIdentity {
+	return firmwareIdentity{deviceId: status.DeviceId, firmwareVersion: status.FirmwareVersion}
+}
+
+// negotiateFeatures asks the device for its components and registers the metrics of any features not seen before
+func (dev *Device) negotiateFeatures(ctx context.Context, status *deviceStatus) error {
+	responseResult, err := dev.connection.GetComponents(ctx)
+	var negotiated features
+	if errors.Is(err, errNonZeroErrorCode) {
+		log.Printf("%s (%s) cannot list its components, so its features are taken from its model: %v", dev.deviceConfig.Ip, dev.deviceConfig.Name, err)
+		negotiated = featuresForModel(dev.deviceConfig)
+	} else if err != nil {
+		return fmt.Errorf("could not make API call while negotiating components: %w", err)
+	} else {
+		negotiated = featuresFromComponents(componentsFrom(responseResult), status.DeviceType)
+		if negotiated.hasOutlets {
+			if negotiated.hasOutletEnergyMonitoring, err = dev.anyChildHasComponent(ctx, "energy_monitoring"); err != nil {
+				return err
+			}
+		}
+	}
+	dev.features = &negotiated
+	dev.negotiatedFor = identityOf(status)
+	dev.metrics.registerFeatures(negotiated)
+	return nil
+}
+
+func (dev *Device) anyChildHasComponent(ctx context.Context, component string) (bool, error) {
+	children, err := listAllPages(ctx, dev.connection.GetChildDeviceComponentList, "child_component_list")
+	if err != nil {
+		return false, err
+	}
+	for _, child := range children {
+		if _, found := componentsFrom(child)[component]; found {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// componentsFrom gives the version of each component in the component_list
+func componentsFrom(responseResult map[string]interface{}) map[string]int {
+	components := map[string]int{}
+	list, _ := responseResult["component_list"].([]interface{})
+	for _, entry := range list {
+		if component, isMap := entry.(map[string]interface{}); isMap {
+			components[stringFrom(component["id"])] = intFrom(component["ver_code"])
+		}
+	}
+	return components
+}
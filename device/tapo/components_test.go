@@ -0,0 +1,131 @@
+package tapo
+
+import (
+	"context"
+	"encoding/json"
+	"homepower/types"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFeaturesComeFromComponentsAndTheDeviceType(t *testing.T) {
+	components := func(ids ...string) map[string]int {
+		found := map[string]int{}
+		for _, id := range ids {
+			found[id] = 1
+		}
+		return found
+	}
+	assert.Equal(t, features{isSwitch: true}, featuresFromComponents(components("device", "countdown"), "SMART.TAPOPLUG"))
+	assert.Equal(t, features{isSwitch: true, hasEnergyMonitoring: true}, featuresFromComponents(components("energy_monitoring"), "SMART.TAPOPLUG"))
+	assert.Equal(t, features{isLight: true}, featuresFromComponents(components("brightness"), "SMART.TAPOBULB"))
+	assert.Equal(t, features{isLight: true, hasColour: true}, featuresFromComponents(components("brightness", "color", "light_strip"), "SMART.TAPOBULB"))
+	// A tunable white bulb has a colour temperature without a colour
+	assert.Equal(t, features{isLight: true, hasColourTemperature: true}, featuresFromComponents(components("brightness", "color_temperature"), "SMART.TAPOBULB"))
+	assert.Equal(t, features{hasOutlets: true}, featuresFromComponents(components("child_device", "energy_monitoring"), "SMART.TAPOPLUG"))
+	assert.Equal(t, features{isHub: true}, featuresFromComponents(components("child_device", "alarm"), "SMART.TAPOHUB"))
+}
+
+func TestComponentsAreNegotiatedAgainOnlyWhenTheFirmwareChangesForAModelThatIsNotKnown(t *testing.T) {
+	components := plugComponents
+	firmwareVersion := "1.3.1 Build 240621 Rel.162048"
+	negotiations := 0
+	server := &klapServer{
+		t:        t,
+		username: "test@example.com",
+		password: "test_password",
+		handler: func(t *testing.T, method string, params any) ([]byte, error) {
+			switch method {
+			case "get_device_info":
+				// A P110 by any other name, as the P115 is not a known model
+				response, err := handleKlapP110August2024(t, method, params)
+				assert.NoError(t, err)
+				var reply struct {
+					Result map[string]any `json:"result"`
+				}
+				assert.NoError(t, json.Unmarshal(response, &reply))
+				reply.Result["model"] = "P115"
+				reply.Result["fw_ver"] = firmwareVersion
+				return replyWithResult(reply.Result)
+			case "component_nego":
+				negotiations++
+				return componentNegoReply(components...)
+			default:
+				return handleKlapP110August2024(t, method, params)
+			}
+		},
+	}
+	testServer, port := createKlapServer(t, server)
+	defer testServer.Close()
+
+	device, err := NewDevice(server.username, server.password, &types.DeviceConfig{
+		Name:  "Dehumidifier",
+		Room:  "Utility",
+		Model: types.UnknownModel,
+		Ip:    "127.0.0.1",
+	}, prometheus.NewRegistry(), port)
+	assert.NoError(t, err)
+
+	assert.NoError(t, device.PollDeviceAndUpdateMetrics(context.Background()))
+	assert.NoError(t, device.PollDeviceAndUpdateMetrics(context.Background()))
+	assert.Equal(t, 1, negotiations)
+	assert.NotNil(t, device.metrics.onTime)
+	assert.Nil(t, device.metrics.powerMilliWatts)
+
+	// Reconnecting to the same firmware keeps the features that were negotiated
+	device.ResetDeviceConnection()
+	assert.NoError(t, device.PollDeviceAndUpdateMetrics(context.Background()))
+	assert.Equal(t, 1, negotiations)
+
+	// A firmware update adds energy monitoring, which is found by negotiating again
+	components = append(plugComponents, "energy_monitoring")
+	firmwareVersion = "1.4.0 Build 250101 Rel.101010"
+	assert.NoError(t, device.PollDeviceAndUpdateMetrics(context.Background()))
+	assert.Equal(t, 2, negotiations)
+	assert.NotNil(t, device.metrics.powerMilliWatts)
+	assert.Equal(t, 5203.0, testutil.ToFloat64(*device.metrics.monthEnergyWattHours))
+}
+
+func TestRegisteringANewFeatureLeavesTheOtherMetricsAlone(t *testing.T) {
+	metrics := registerMetrics(prometheus.NewRegistry(), &types.DeviceConfig{Name: "Kettle", Room: "Kitchen"})
+	metrics.registerFeatures(features{isSwitch: true})
+	(*metrics.onTime).Set(60.0)
+
+	metrics.registerFeatures(features{isSwitch: true, hasEnergyMonitoring: true})
+	assert.Equal(t, 60.0, testutil.ToFloat64(*metrics.onTime))
+	assert.Equal(t, -1.0, testutil.ToFloat64(*metrics.powerMilliWatts))
+}
+
+func TestTunableWhiteBulbHasAColourTemperatureButNoHue(t *testing.T) {
+	metrics := registerMetrics(prometheus.NewRegistry(), &types.DeviceConfig{Name: "Reading Lamp", Room: "Study"})
+	metrics.registerFeatures(featuresFromComponents(map[string]int{"brightness": 1, "color_temperature": 1}, "SMART.TAPOBULB"))
+	assert.NotNil(t, metrics.colourTemperature)
+	assert.NotNil(t, metrics.defaultColourTemperature)
+	assert.Nil(t, metrics.hue)
+}
+
+var plugComponents = []string{"device", "firmware", "quick_setup", "time", "wireless", "schedule", "countdown", "led", "default_states", "auto_off"}
+
+// bulbComponents gives the components of the bulb whose device info is given, which only has colour if it has a hue
+func bulbComponents(deviceInfo map[string]any) []string {
+	components := []string{"device", "firmware", "time", "wireless", "schedule", "countdown", "default_states", "brightness"}
+	if _, hasHue := deviceInfo["hue"]; hasHue {
+		components = append(components, "color", "color_temperature", "light_effect")
+	}
+	return components
+}
+
+func componentList(ids ...string) []map[string]any {
+	list := []map[string]any{}
+	for _, id := range ids {
+		list = append(list, map[string]any{"id": id, "ver_code": 1})
+	}
+	return list
+}
+
+func componentNegoReply(ids ...string) ([]byte, error) {
+	return replyWithResult(map[string]any{"component_list": componentList(ids...)})
+}
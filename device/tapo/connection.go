@@ -1,11 +1,33 @@
 package tapo
 
-import "fmt"
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Port is where Tapo devices serve both the KLAP and the older securePassthrough APIs
+const Port = 80
+
+// errNonZeroErrorCode is returned when the device answers with an error, e.g. -1 for a method it does not know
+var errNonZeroErrorCode = errors.New("non-zero error code returned")
 
 type tapoDeviceConnection interface {
 	forgetKeysAndSession()
-	GetDeviceInfo() (map[string]interface{}, error)
-	GetEnergyUsage() (map[string]interface{}, error)
+	protocolName() string
+	GetDeviceInfo(ctx context.Context) (map[string]interface{}, error)
+	// GetComponents lists the components that the firmware has, each with its version
+	GetComponents(ctx context.Context) (map[string]interface{}, error)
+	GetEnergyUsage(ctx context.Context) (map[string]interface{}, error)
+	// GetEnergyData gives the energy used in each interval of a period, on firmware that no longer sends its history
+	// with the energy usage
+	GetEnergyData(ctx context.Context, params energyDataParams) (map[string]interface{}, error)
+	// GetChildDeviceList gives one page of a power strip's sockets, starting from the given index
+	GetChildDeviceList(ctx context.Context, startIndex int) (map[string]interface{}, error)
+	// ControlChild calls a method on one of a power strip's sockets, which cannot be reached directly
+	ControlChild(ctx context.Context, childId string, method string) (map[string]interface{}, error)
+	// GetChildDeviceComponentList gives one page of the components of each of a power strip's sockets
+	GetChildDeviceComponentList(ctx context.Context, startIndex int) (map[string]interface{}, error)
 }
 
 type lazyDeviceConnection struct {
@@ -21,37 +43,96 @@ func (dc *lazyDeviceConnection) forgetKeysAndSession() {
 		dc.delegate.forgetKeysAndSession()
 	}
 }
-func (dc *lazyDeviceConnection) GetDeviceInfo() (map[string]interface{}, error) {
+func (dc *lazyDeviceConnection) protocolName() string {
+	if dc.delegate == nil {
+		return ""
+	}
+	return dc.delegate.protocolName()
+}
+func (dc *lazyDeviceConnection) GetDeviceInfo(ctx context.Context) (map[string]interface{}, error) {
 	if dc.delegate == nil {
-		err := dc.choose()
+		err := dc.choose(ctx)
 		if err != nil {
 			return nil, err
 		}
 	}
-	return dc.delegate.GetDeviceInfo()
+	return dc.delegate.GetDeviceInfo(ctx)
 }
 
-func (dc *lazyDeviceConnection) GetEnergyUsage() (map[string]interface{}, error) {
+func (dc *lazyDeviceConnection) GetComponents(ctx context.Context) (map[string]interface{}, error) {
 	if dc.delegate == nil {
-		err := dc.choose()
+		err := dc.choose(ctx)
 		if err != nil {
 			return nil, err
 		}
 	}
-	return dc.delegate.GetEnergyUsage()
+	return dc.delegate.GetComponents(ctx)
 }
 
-func (dc *lazyDeviceConnection) choose() error {
+func (dc *lazyDeviceConnection) GetEnergyUsage(ctx context.Context) (map[string]interface{}, error) {
+	if dc.delegate == nil {
+		err := dc.choose(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return dc.delegate.GetEnergyUsage(ctx)
+}
+
+func (dc *lazyDeviceConnection) GetEnergyData(ctx context.Context, params energyDataParams) (map[string]interface{}, error) {
+	if dc.delegate == nil {
+		err := dc.choose(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return dc.delegate.GetEnergyData(ctx, params)
+}
+
+func (dc *lazyDeviceConnection) GetChildDeviceList(ctx context.Context, startIndex int) (map[string]interface{}, error) {
+	if dc.delegate == nil {
+		err := dc.choose(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return dc.delegate.GetChildDeviceList(ctx, startIndex)
+}
+
+func (dc *lazyDeviceConnection) ControlChild(ctx context.Context, childId string, method string) (map[string]interface{}, error) {
+	if dc.delegate == nil {
+		err := dc.choose(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return dc.delegate.ControlChild(ctx, childId, method)
+}
+
+func (dc *lazyDeviceConnection) GetChildDeviceComponentList(ctx context.Context, startIndex int) (map[string]interface{}, error) {
+	if dc.delegate == nil {
+		err := dc.choose(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return dc.delegate.GetChildDeviceComponentList(ctx, startIndex)
+}
+
+func (dc *lazyDeviceConnection) choose(ctx context.Context) error {
 	klap, err := createKlapDeviceConnection(dc.email, dc.password, dc.deviceIp, dc.port)
 	if err != nil {
 		fmt.Printf("could not initialise klap connection for device %s: %s", dc.deviceIp, err)
 		return err
 	}
-	err = klap.doKeyExchange()
+	err = klap.Handshake(ctx)
 	if err == nil {
 		dc.delegate = klap
 		return err
 	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
 
 	oldTapo, err := createOldTapoDeviceConnection(dc.email, dc.password, dc.deviceIp, dc.port)
 	if err != nil {
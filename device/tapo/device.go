@@ -1,63 +1,141 @@
 package tapo
 
 import (
+	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"homepower/types"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 type Device struct {
-	deviceConfig *types.DeviceConfig
-	connection   tapoDeviceConnection
-	metrics      *prometheusMetrics
+	// mutex serialises use of the connection between polls and energy history requests
+	mutex         sync.Mutex
+	deviceConfig  *types.DeviceConfig
+	connection    tapoDeviceConnection
+	metrics       *prometheusMetrics
+	modelVerified bool
+	lastStatus    atomic.Pointer[deviceStatus]
+	protocol      atomic.Pointer[string]
+	// features are negotiated again only when the device at the address, or its firmware, is not the one they were
+	// negotiated with, so that reconnecting does not re-register metrics mid-poll
+	features      *features
+	negotiatedFor firmwareIdentity
+
+	sensorsLastSeenOnline map[string]time.Time // by child device id, for hubs
 }
 
 func NewDevice(email string, password string, config *types.DeviceConfig, registry prometheus.Registerer, port uint16) (*Device, error) {
 	var connection = connectionFactory(email, password, config.Ip, port)
 	return &Device{
-		deviceConfig: config,
-		connection:   connection,
-		metrics: registerMetrics(
-			registry,
-			types.GenerateCommonLabels(config),
-			isSwitch(config), isLight(config), hasEnergyMonitoring(config)),
+		deviceConfig:          config,
+		connection:            connection,
+		metrics:               registerMetrics(registry, config),
+		sensorsLastSeenOnline: map[string]time.Time{},
 	}, nil
 }
 
-func (dev *Device) PollDeviceAndUpdateMetrics() error {
+func (dev *Device) PollDeviceAndUpdateMetrics(ctx context.Context) error {
+	dev.mutex.Lock()
+	defer dev.mutex.Unlock()
+	defer dev.recordProtocol()
 	var status = deviceStatus{}
-	if err := dev.populateDeviceInfo(&status); err != nil {
+	if err := dev.populateDeviceInfo(ctx, &status); err != nil {
 		return fmt.Errorf("could not poll device info for %s (%s): %w", dev.deviceConfig.Ip, dev.deviceConfig.Name, err)
 	}
-	if hasEnergyMonitoring(dev.deviceConfig) {
-		if err := dev.populateEnergyInfo(&status); err != nil {
+	if identity := identityOf(&status); dev.features == nil || dev.negotiatedFor != identity {
+		if err := dev.negotiateFeatures(ctx, &status); err != nil {
+			return fmt.Errorf("could not negotiate features for %s (%s): %w", dev.deviceConfig.Ip, dev.deviceConfig.Name, err)
+		}
+	}
+	if dev.features.hasEnergyMonitoring {
+		if err := dev.populateEnergyInfo(ctx, &status); err != nil {
 			return fmt.Errorf("could not poll energy info for %s (%s): %w", dev.deviceConfig.Ip, dev.deviceConfig.Name, err)
 		}
 	}
+	if dev.features.hasOutlets {
+		if err := dev.populateOutlets(ctx, &status); err != nil {
+			return fmt.Errorf("could not poll sockets for %s (%s): %w", dev.deviceConfig.Ip, dev.deviceConfig.Name, err)
+		}
+	}
+	if dev.features.isHub {
+		if err := dev.populateSensors(ctx, &status, time.Now()); err != nil {
+			return fmt.Errorf("could not poll sensors for %s (%s): %w", dev.deviceConfig.Ip, dev.deviceConfig.Name, err)
+		}
+	}
 	if err := dev.metrics.updateMetrics(&status); err != nil {
 		return fmt.Errorf("could not update metrics for %s (%s): %w", dev.deviceConfig.Ip, dev.deviceConfig.Name, err)
 	}
+	dev.lastStatus.Store(&status)
+	if !dev.modelVerified && dev.deviceConfig.Model != types.UnknownModel {
+		dev.modelVerified = types.WarnIfReportedModelDiffers(dev.deviceConfig, status.ModelName)
+	}
 	return nil
 }
+
+// ProbeModel logs in to the device at the given IP and returns the model it reports, e.g. "P110"
+func ProbeModel(ctx context.Context, email string, password string, ip string, port uint16) (string, error) {
+	connection := connectionFactory(email, password, ip, port)
+	defer connection.forgetKeysAndSession()
+	responseResult, err := connection.GetDeviceInfo(ctx)
+	if err != nil {
+		return "", fmt.Errorf("could not make API call while probing model: %w", err)
+	}
+	model, isString := responseResult["model"].(string)
+	if !isString || model == "" {
+		return "", errors.New("device did not report a model")
+	}
+	return model, nil
+}
 func (dev *Device) ResetMetricsToRogueValues() {
+	dev.mutex.Lock()
+	defer dev.mutex.Unlock()
 	dev.metrics.resetToRogueValues()
 }
 func (dev *Device) ResetDeviceConnection() {
+	dev.mutex.Lock()
+	defer dev.mutex.Unlock()
 	dev.connection.forgetKeysAndSession()
 }
 func (dev *Device) CommonMetricLabels() map[string]string {
 	return dev.metrics.commonLabels
 }
+func (dev *Device) Model() types.DeviceType {
+	return dev.deviceConfig.Model
+}
+
+// recordProtocol copies the protocol out of the connection, which is only touched while the mutex is held, so that
+// Protocol can be called without waiting on a poll
+func (dev *Device) recordProtocol() {
+	protocol := dev.connection.protocolName()
+	dev.protocol.Store(&protocol)
+}
+func (dev *Device) Protocol() string {
+	if protocol := dev.protocol.Load(); protocol != nil {
+		return *protocol
+	}
+	return ""
+}
+func (dev *Device) LastStatus() any {
+	if status := dev.lastStatus.Load(); status != nil {
+		return status
+	}
+	return nil
+}
 
 type deviceStatus struct {
 	common
 	*smartPlugInfo
 	*smartBulbInfo
 	*energyMeterInfo
+	*powerStripInfo
+	*hubInfo
 }
 
 type common struct {
@@ -74,16 +152,32 @@ type common struct {
 	Charging        bool
 	WifiRssi        int
 	SignalLevel     int
-	DeviceType      string // e.g. SMART.TAPOBULB, SMART.TAPOPLUG
+	DeviceType      string // e.g. SMART.TAPOBULB, SMART.TAPOPLUG, SMART.TAPOHUB
 }
 type smartPlugInfo struct {
 	RelayOn bool
 	OnTime  time.Duration
 }
 type smartBulbInfo struct {
+	Brightness                  int
+	ColourTemperature           int
+	LightOn                     bool
+	Hue                         int
+	Saturation                  int
+	IsColour                    bool
+	IsVariableColourTemperature bool
+	MinColourTemperature        int
+	MaxColourTemperature        int
+	DynamicEffectOn             bool
+	DefaultStates               defaultStates
+}
+
+// defaultStates is the state the bulb comes on in after losing power: the last one it was in for "last_states", or
+// the state given for "custom"
+type defaultStates struct {
+	Type              string
 	Brightness        int
 	ColourTemperature int
-	LightOn           bool
 	Hue               int
 	Saturation        int
 }
@@ -93,18 +187,13 @@ type energyMeterInfo struct {
 	TodayEnergyWattHours int
 }
 
-func (dev *Device) populateDeviceInfo(status *deviceStatus) error {
-	responseResult, err := dev.connection.GetDeviceInfo()
+func (dev *Device) populateDeviceInfo(ctx context.Context, status *deviceStatus) error {
+	responseResult, err := dev.connection.GetDeviceInfo(ctx)
 	if err != nil {
 		return fmt.Errorf("could not make API call while fetching device info: %w", err)
 	}
 
-	nicknameBase64 := responseResult["nickname"].(string)
-	if alias, err := base64.StdEncoding.DecodeString(nicknameBase64); err == nil {
-		status.Alias = strings.TrimSpace(string(alias))
-	} else {
-		status.Alias = nicknameBase64
-	}
+	status.Alias = decodeNickname(responseResult["nickname"].(string))
 	status.DeviceId = responseResult["device_id"].(string)
 	status.FirmwareVersion = responseResult["fw_ver"].(string)
 	status.HardwareId = responseResult["hw_id"].(string)
@@ -126,31 +215,78 @@ func (dev *Device) populateDeviceInfo(status *deviceStatus) error {
 	}
 
 	if status.DeviceType == "SMART.TAPOBULB" {
-		status.smartBulbInfo = &smartBulbInfo{
-			Brightness:        int(responseResult["brightness"].(float64)),
-			ColourTemperature: int(responseResult["color_temp"].(float64)),
-			LightOn:           responseResult["device_on"].(bool),
-			Hue:               int(responseResult["hue"].(float64)),
-			Saturation:        int(responseResult["saturation"].(float64)),
-		}
-	} else if status.DeviceType == "SMART.TAPOPLUG" {
+		status.smartBulbInfo = bulbInfoFrom(responseResult)
+	} else if relayOn, isBool := responseResult["device_on"].(bool); isBool && status.DeviceType == "SMART.TAPOPLUG" {
+		// A power strip has no relay of its own, so leaves these to its sockets
 		status.smartPlugInfo = &smartPlugInfo{
-			RelayOn: responseResult["device_on"].(bool),
-			OnTime:  time.Duration(int64(responseResult["on_time"].(float64))) * time.Second,
+			RelayOn: relayOn,
+			OnTime:  time.Duration(intFrom(responseResult["on_time"])) * time.Second,
 		}
 	}
 	return nil
 }
 
-func (dev *Device) populateEnergyInfo(status *deviceStatus) error {
-	responseResult, err := dev.connection.GetEnergyUsage()
+// bulbInfoFrom reads a bulb's state.  Bulbs that are only dimmable leave out the hue, saturation and colour temperature,
+// and one whose color_temp_range starts and ends at the same temperature cannot change it.
+func bulbInfoFrom(responseResult map[string]interface{}) *smartBulbInfo {
+	info := &smartBulbInfo{
+		Brightness:        intFrom(responseResult["brightness"]),
+		ColourTemperature: intFrom(responseResult["color_temp"]),
+		Hue:               intFrom(responseResult["hue"]),
+		Saturation:        intFrom(responseResult["saturation"]),
+	}
+	info.LightOn, _ = responseResult["device_on"].(bool)
+	_, info.IsColour = responseResult["hue"].(float64)
+	if colourTemperatureRange, isList := responseResult["color_temp_range"].([]interface{}); isList && len(colourTemperatureRange) == 2 {
+		info.MinColourTemperature = intFrom(colourTemperatureRange[0])
+		info.MaxColourTemperature = intFrom(colourTemperatureRange[1])
+		info.IsVariableColourTemperature = info.MinColourTemperature < info.MaxColourTemperature
+	}
+	// The L900 light strip has its effects under lighting_effect, where the other bulbs have dynamic light effects
+	if enabled, isBool := responseResult["dynamic_light_effect_enable"].(bool); isBool {
+		info.DynamicEffectOn = enabled
+	} else if lightingEffect, isMap := responseResult["lighting_effect"].(map[string]interface{}); isMap {
+		info.DynamicEffectOn = intFrom(lightingEffect["enable"]) == 1
+	}
+	if defaults, isMap := responseResult["default_states"].(map[string]interface{}); isMap {
+		info.DefaultStates.Type, _ = defaults["type"].(string)
+		if state, isMap := defaults["state"].(map[string]interface{}); isMap {
+			info.DefaultStates.Brightness = intFrom(state["brightness"])
+			info.DefaultStates.ColourTemperature = intFrom(state["color_temp"])
+			info.DefaultStates.Hue = intFrom(state["hue"])
+			info.DefaultStates.Saturation = intFrom(state["saturation"])
+		}
+	}
+	return info
+}
+
+// intFrom gives the JSON number as an int, or 0 when it is missing
+func intFrom(value interface{}) int {
+	number, _ := value.(float64)
+	return int(number)
+}
+
+func (dev *Device) populateEnergyInfo(ctx context.Context, status *deviceStatus) error {
+	responseResult, err := dev.connection.GetEnergyUsage(ctx)
 	if err != nil {
 		return fmt.Errorf("could not make API call while fetching energy usage: %w", err)
 	}
-	status.energyMeterInfo = &energyMeterInfo{
+	status.energyMeterInfo = energyMeterInfoFrom(responseResult)
+	return nil
+}
+
+func energyMeterInfoFrom(responseResult map[string]interface{}) *energyMeterInfo {
+	return &energyMeterInfo{
 		PowerMilliWatts:      int(responseResult["current_power"].(float64)),
 		MonthEnergyWattHours: int(responseResult["month_energy"].(float64)),
 		TodayEnergyWattHours: int(responseResult["today_energy"].(float64)),
 	}
-	return nil
+}
+
+// decodeNickname decodes the base64 name given in the app, which is sometimes saved with trailing whitespace
+func decodeNickname(nicknameBase64 string) string {
+	if alias, err := base64.StdEncoding.DecodeString(nicknameBase64); err == nil {
+		return strings.TrimSpace(string(alias))
+	}
+	return nicknameBase64
 }
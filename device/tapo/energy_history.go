@@ -0,0 +1,202 @@
+package tapo
+
+import (
+	"context"
+	"fmt"
+	"homepower/types"
+	"time"
+)
+
+// Plugs with an energy meter keep a history of the energy they have used, by their own wall clock.  Older firmware
+// sends all of it with get_energy_usage:
+//   - past24h: each of the last 24 hours, ending with the current one
+//   - past7d: each hour of the last 7 days, a row to a day, ending with today
+//   - past30d: each of the last 30 days, ending with today
+//   - past1y: each of the last 12 months, ending with this month
+//
+// Newer firmware leaves these out, and gives one period at a time through get_energy_data.  Its timestamps are the
+// device's wall clock written as if it were UTC, and its interval is in minutes: 60 for each hour of up to 8 days, 1440
+// for each day of the quarter starting at start_timestamp, or 43200 for each month of the year starting there.
+
+const (
+	hourlyInterval  = 60
+	dailyInterval   = 1440
+	monthlyInterval = 43200
+	// hourlyHistoryDays is how many days of hours both kinds of firmware keep
+	hourlyHistoryDays = 7
+)
+
+type energyDataParams struct {
+	StartTimestamp int64 `json:"start_timestamp"`
+	EndTimestamp   int64 `json:"end_timestamp"`
+	Interval       int   `json:"interval"`
+}
+
+// EnergyHistory reads the hours of the last week, and the days and months, that the device holds for the year.  Each
+// bucket is keyed by when it starts, and those that have not started yet are left out.  Whether the device monitors
+// energy is only known once it has been polled.
+func (dev *Device) EnergyHistory(ctx context.Context, year int) (*types.EnergyHistory, error) {
+	dev.mutex.Lock()
+	defer dev.mutex.Unlock()
+	if !dev.metrics.hasEnergyMonitoring {
+		return nil, fmt.Errorf("could not fetch energy history: %w", types.ErrNotSupported)
+	}
+	usage, err := dev.connection.GetEnergyUsage(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not make API call while fetching energy usage: %w", err)
+	}
+	now := deviceWallClock(usage)
+	history := newEnergyHistoryBuilder(year, now)
+	if _, hasPastArrays := usage["past30d"]; hasPastArrays {
+		history.addPastArrays(usage)
+	} else if err := dev.addEnergyData(ctx, history); err != nil {
+		return nil, fmt.Errorf("could not fetch energy history: %w", err)
+	}
+	return &history.EnergyHistory, nil
+}
+
+// addEnergyData asks for the year's months, each of its quarters that has started, and the hours of the last week
+func (dev *Device) addEnergyData(ctx context.Context, history *energyHistoryBuilder) error {
+	startOfYear := time.Date(history.year, time.January, 1, 0, 0, 0, 0, time.UTC)
+	months, err := dev.energyData(ctx, startOfYear, startOfYear, monthlyInterval)
+	if err != nil {
+		return err
+	}
+	for i, energy := range months {
+		history.addMonth(startOfYear.AddDate(0, i, 0), energy)
+	}
+
+	for startOfQuarter := startOfYear; startOfQuarter.Year() == history.year && !startOfQuarter.After(history.now); startOfQuarter = startOfQuarter.AddDate(0, 3, 0) {
+		days, err := dev.energyData(ctx, startOfQuarter, startOfQuarter, dailyInterval)
+		if err != nil {
+			return err
+		}
+		endOfQuarter := startOfQuarter.AddDate(0, 3, 0)
+		for i, energy := range days {
+			if day := startOfQuarter.AddDate(0, 0, i); day.Before(endOfQuarter) {
+				history.addDay(day, energy)
+			}
+		}
+	}
+
+	firstDay, lastDay := startOfDay(history.now).AddDate(0, 0, 1-hourlyHistoryDays), startOfDay(history.now)
+	if firstDay.Before(startOfYear) {
+		firstDay = startOfYear
+	}
+	if endOfYear := startOfYear.AddDate(1, 0, -1); lastDay.After(endOfYear) {
+		lastDay = endOfYear
+	}
+	if firstDay.After(lastDay) {
+		return nil
+	}
+	hours, err := dev.energyData(ctx, firstDay, lastDay, hourlyInterval)
+	if err != nil {
+		return err
+	}
+	for i, energy := range hours {
+		history.addHour(firstDay.Add(time.Duration(i)*time.Hour), energy)
+	}
+	return nil
+}
+
+func (dev *Device) energyData(ctx context.Context, start time.Time, end time.Time, interval int) ([]int, error) {
+	responseResult, err := dev.connection.GetEnergyData(ctx, energyDataParams{
+		StartTimestamp: start.Unix(),
+		EndTimestamp:   end.Unix(),
+		Interval:       interval,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not make API call while fetching energy data every %d minutes from %s: %w", interval, start.Format(time.DateOnly), err)
+	}
+	return intsFrom(responseResult["data"]), nil
+}
+
+// energyHistoryBuilder keeps the buckets that fall in the year asked for and have started by the device's clock
+type energyHistoryBuilder struct {
+	types.EnergyHistory
+	year int
+	now  time.Time
+}
+
+func newEnergyHistoryBuilder(year int, now time.Time) *energyHistoryBuilder {
+	return &energyHistoryBuilder{
+		EnergyHistory: types.EnergyHistory{Hourly: []types.HourlyEnergy{}, Daily: []types.DailyEnergy{}, Monthly: []types.MonthlyEnergy{}},
+		year:          year,
+		now:           now,
+	}
+}
+
+func (b *energyHistoryBuilder) keeps(start time.Time) bool {
+	return start.Year() == b.year && !start.After(b.now)
+}
+
+func (b *energyHistoryBuilder) addHour(start time.Time, energyWattHours int) {
+	if b.keeps(start) {
+		b.Hourly = append(b.Hourly, types.HourlyEnergy{Year: start.Year(), Month: int(start.Month()), Day: start.Day(), Hour: start.Hour(), EnergyWattHours: energyWattHours})
+	}
+}
+
+func (b *energyHistoryBuilder) addDay(start time.Time, energyWattHours int) {
+	if b.keeps(start) {
+		b.Daily = append(b.Daily, types.DailyEnergy{Year: start.Year(), Month: int(start.Month()), Day: start.Day(), EnergyWattHours: energyWattHours})
+	}
+}
+
+func (b *energyHistoryBuilder) addMonth(start time.Time, energyWattHours int) {
+	if b.keeps(start) {
+		b.Monthly = append(b.Monthly, types.MonthlyEnergy{Year: start.Year(), Month: int(start.Month()), EnergyWattHours: energyWattHours})
+	}
+}
+
+// addPastArrays reads the history sent by older firmware, where the last entry of each array is the current hour, day
+// or month.  The last 24 hours are also the end of the last 7 days, so are only read when the days are missing.
+func (b *energyHistoryBuilder) addPastArrays(usage map[string]interface{}) {
+	today := startOfDay(b.now)
+	if pastWeek, isList := usage["past7d"].([]interface{}); isList {
+		for i, hours := range pastWeek {
+			day := today.AddDate(0, 0, i+1-len(pastWeek))
+			for hour, energy := range intsFrom(hours) {
+				b.addHour(day.Add(time.Duration(hour)*time.Hour), energy)
+			}
+		}
+	} else {
+		thisHour := b.now.Truncate(time.Hour)
+		pastDay := intsFrom(usage["past24h"])
+		for i, energy := range pastDay {
+			b.addHour(thisHour.Add(time.Duration(i+1-len(pastDay))*time.Hour), energy)
+		}
+	}
+	pastMonth := intsFrom(usage["past30d"])
+	for i, energy := range pastMonth {
+		b.addDay(today.AddDate(0, 0, i+1-len(pastMonth)), energy)
+	}
+	thisMonth := time.Date(b.now.Year(), b.now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	pastYear := intsFrom(usage["past1y"])
+	for i, energy := range pastYear {
+		b.addMonth(thisMonth.AddDate(0, i+1-len(pastYear), 0), energy)
+	}
+}
+
+// deviceWallClock reads the device's local_time, falling back to the exporter's own clock, as a time in UTC so that
+// dates can be worked out without knowing the device's time zone
+func deviceWallClock(usage map[string]interface{}) time.Time {
+	if localTime, err := time.Parse(time.DateTime, stringFrom(usage["local_time"])); err == nil {
+		return localTime
+	}
+	now := time.Now()
+	return time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute(), now.Second(), 0, time.UTC)
+}
+
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// intsFrom gives a JSON array of numbers as ints
+func intsFrom(value interface{}) []int {
+	list, _ := value.([]interface{})
+	numbers := make([]int, 0, len(list))
+	for _, entry := range list {
+		numbers = append(numbers, intFrom(entry))
+	}
+	return numbers
+}
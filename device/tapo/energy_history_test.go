@@ -0,0 +1,172 @@
+package tapo
+
+import (
+	"context"
+	"encoding/json"
+	"homepower/types"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func newEnergyHistoryTestDevice(t *testing.T, model types.DeviceType, handler func(t *testing.T, method string, params any) ([]byte, error)) *Device {
+	server := &klapServer{
+		t:        t,
+		username: "test@example.com",
+		password: "test_password",
+		handler:  handler,
+	}
+	testServer, port := createKlapServer(t, server)
+	t.Cleanup(testServer.Close)
+
+	device, err := NewDevice(server.username, server.password, &types.DeviceConfig{
+		Name:  "Heater",
+		Room:  "Study",
+		Model: model,
+		Ip:    "127.0.0.1",
+	}, prometheus.NewRegistry(), port)
+	assert.NoError(t, err)
+	// Whether the device monitors energy is only known once it has been polled
+	assert.NoError(t, device.PollDeviceAndUpdateMetrics(context.Background()))
+	return device
+}
+
+func TestEnergyHistoryIsReadFromThePastArraysOfOlderFirmware(t *testing.T) {
+	device := newEnergyHistoryTestDevice(t, types.TapoP110, handleKlapP110PastArrays)
+
+	history, err := device.EnergyHistory(context.Background(), 2022)
+	assert.NoError(t, err)
+	// The year ends with this month, and the months before 2022 are left out
+	assert.Len(t, history.Monthly, 9)
+	assert.Equal(t, types.MonthlyEnergy{Year: 2022, Month: 9, EnergyWattHours: 5203}, history.Monthly[8])
+	assert.Len(t, history.Daily, 30)
+	assert.Equal(t, types.DailyEnergy{Year: 2022, Month: 8, Day: 22, EnergyWattHours: 0}, history.Daily[0])
+	assert.Equal(t, types.DailyEnergy{Year: 2022, Month: 9, Day: 20, EnergyWattHours: 67}, history.Daily[29])
+	// Six whole days, and today up to the hour that has started
+	assert.Len(t, history.Hourly, 6*24+4)
+	assert.Equal(t, types.HourlyEnergy{Year: 2022, Month: 9, Day: 14, Hour: 0, EnergyWattHours: 15}, history.Hourly[0])
+	assert.Equal(t, types.HourlyEnergy{Year: 2022, Month: 9, Day: 20, Hour: 2, EnergyWattHours: 21}, history.Hourly[6*24+2])
+
+	history, err = device.EnergyHistory(context.Background(), 2021)
+	assert.NoError(t, err)
+	assert.Len(t, history.Monthly, 3)
+	assert.Empty(t, history.Daily)
+	assert.Empty(t, history.Hourly)
+}
+
+func TestEnergyHistoryIsAskedForAPeriodAtATimeOnNewerFirmware(t *testing.T) {
+	var requests []energyDataParams
+	device := newEnergyHistoryTestDevice(t, types.TapoP110, handleKlapP110EnergyData(&requests))
+
+	history, err := device.EnergyHistory(context.Background(), 2024)
+	assert.NoError(t, err)
+	startOf := func(year int, month time.Month, day int) int64 {
+		return time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Unix()
+	}
+	assert.Equal(t, []energyDataParams{
+		{StartTimestamp: startOf(2024, 1, 1), EndTimestamp: startOf(2024, 1, 1), Interval: monthlyInterval},
+		{StartTimestamp: startOf(2024, 1, 1), EndTimestamp: startOf(2024, 1, 1), Interval: dailyInterval},
+		{StartTimestamp: startOf(2024, 4, 1), EndTimestamp: startOf(2024, 4, 1), Interval: dailyInterval},
+		{StartTimestamp: startOf(2024, 7, 1), EndTimestamp: startOf(2024, 7, 1), Interval: dailyInterval},
+		{StartTimestamp: startOf(2024, 8, 3), EndTimestamp: startOf(2024, 8, 9), Interval: hourlyInterval},
+	}, requests)
+
+	assert.Len(t, history.Monthly, 8)
+	assert.Equal(t, types.MonthlyEnergy{Year: 2024, Month: 8, EnergyWattHours: 800}, history.Monthly[7])
+	// Each quarter's days stop at the end of the quarter, and the last is today
+	assert.Len(t, history.Daily, 31+29+31+30+31+30+31+9)
+	assert.Equal(t, types.DailyEnergy{Year: 2024, Month: 3, Day: 31, EnergyWattHours: 91}, history.Daily[90])
+	assert.Equal(t, types.DailyEnergy{Year: 2024, Month: 4, Day: 1, EnergyWattHours: 1}, history.Daily[91])
+	assert.Equal(t, types.DailyEnergy{Year: 2024, Month: 8, Day: 9, EnergyWattHours: 40}, history.Daily[len(history.Daily)-1])
+	assert.Len(t, history.Hourly, 6*24+1)
+	assert.Equal(t, types.HourlyEnergy{Year: 2024, Month: 8, Day: 9, Hour: 0, EnergyWattHours: 6*24 + 1}, history.Hourly[6*24])
+}
+
+func TestEnergyHistoryIsNotSupportedWithoutEnergyMonitoring(t *testing.T) {
+	device := newEnergyHistoryTestDevice(t, types.TapoP100, handleKlapP100)
+	_, err := device.EnergyHistory(context.Background(), 2024)
+	assert.ErrorIs(t, err, types.ErrNotSupported)
+}
+
+func replyWithResult(result any) ([]byte, error) {
+	return json.Marshal(struct {
+		ErrorCode int `json:"error_code"`
+		Result    any `json:"result"`
+	}{ErrorCode: 0, Result: result})
+}
+
+// handleKlapP110PastArrays answers as in examples.txt, with the history in get_energy_usage
+func handleKlapP110PastArrays(t *testing.T, method string, params any) ([]byte, error) {
+	t.Logf("Method: %s, Params: %s", method, params)
+	if method != "get_energy_usage" {
+		return handleKlapP110Original(t, method, params)
+	}
+	return replyWithResult(map[string]any{
+		"current_power": 2529,
+		"local_time":    "2022-09-20 03:05:19",
+		"month_energy":  5203,
+		"month_runtime": 17644,
+		"past1y":        []int{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 5203},
+		"past24h":       []int{14, 17, 14, 15, 14, 20, 13, 15, 14, 15, 17, 26, 16, 21, 17, 13, 14, 15, 15, 14, 23, 23, 21, 0},
+		"past30d":       []int{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 5, 0, 0, 0, 212, 473, 459, 484, 489, 475, 453, 417, 457, 424, 398, 390, 67},
+		"past7d": [][]int{
+			{15, 26, 17, 23, 12, 27, 17, 13, 16, 26, 14, 14, 17, 28, 15, 15, 19, 18, 29, 17, 16, 13, 20, 26},
+			{20, 12, 14, 14, 21, 22, 14, 14, 21, 19, 13, 20, 20, 20, 16, 14, 15, 15, 19, 21, 22, 18, 20, 13},
+			{23, 18, 21, 26, 14, 14, 23, 22, 13, 17, 22, 21, 22, 19, 12, 25, 13, 17, 15, 25, 23, 18, 14, 20},
+			{12, 14, 14, 24, 18, 17, 20, 20, 16, 13, 14, 20, 14, 26, 18, 13, 14, 14, 21, 20, 22, 21, 20, 19},
+			{13, 20, 20, 12, 19, 13, 19, 13, 24, 17, 13, 18, 13, 15, 25, 18, 14, 14, 17, 17, 18, 16, 13, 17},
+			{21, 18, 15, 17, 14, 17, 14, 15, 14, 20, 13, 15, 14, 15, 17, 26, 16, 21, 17, 13, 14, 15, 15, 14},
+			{23, 23, 21, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+		},
+		"today_energy":  67,
+		"today_runtime": 181,
+	})
+}
+
+// handleKlapP110EnergyData answers like the August 2024 firmware, numbering each month by its month of the year, each
+// day by its day of the quarter, and each hour by its hour of the period asked for
+func handleKlapP110EnergyData(requests *[]energyDataParams) func(t *testing.T, method string, params any) ([]byte, error) {
+	return func(t *testing.T, method string, params any) ([]byte, error) {
+		t.Logf("Method: %s, Params: %s", method, params)
+		switch method {
+		case "get_energy_usage":
+			return replyWithResult(map[string]any{
+				"today_runtime":      47,
+				"month_runtime":      11560,
+				"today_energy":       0,
+				"month_energy":       6992,
+				"local_time":         "2024-08-09 00:47:06",
+				"electricity_charge": []int{0, 0, 0},
+				"current_power":      0,
+			})
+		case "get_energy_data":
+			var dataParams energyDataParams
+			assert.NoError(t, json.Unmarshal(params.(json.RawMessage), &dataParams))
+			*requests = append(*requests, dataParams)
+			count, scale := 0, 1
+			switch dataParams.Interval {
+			case monthlyInterval:
+				count, scale = 12, 100
+			case dailyInterval:
+				count = 92
+			case hourlyInterval:
+				count = int((dataParams.EndTimestamp-dataParams.StartTimestamp)/3600) + 24
+			}
+			data := make([]int, count)
+			for i := range data {
+				data[i] = (i + 1) * scale
+			}
+			return replyWithResult(map[string]any{
+				"start_timestamp": dataParams.StartTimestamp,
+				"end_timestamp":   dataParams.EndTimestamp,
+				"interval":        dataParams.Interval,
+				"local_time":      "2024-08-09 00:47:06",
+				"data":            data,
+			})
+		default:
+			return handleKlapP110August2024(t, method, params)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package tapo
+
+import (
+	"context"
+	"maps"
+	"time"
+)
+
+// A hub's children are battery-powered sensors that talk only to the hub, which reports on each of them in its child
+// device list.  Which readings a child has depends on its model:
+//   - T310 and T315: current_temp and current_humidity
+//   - T100: detected, for motion
+//   - T110: open, for a door or window contact
+//   - KE100: current_temp and target_temp, for a radiator valve
+
+type hubInfo struct {
+	Sensors []sensorInfo
+}
+
+type sensorInfo struct {
+	Id         string
+	Nickname   string
+	Model      string
+	Online     bool
+	BatteryLow bool
+	Rssi       int
+	// LastSeenOnline is when this exporter last polled the hub and found the sensor online.  It is not a time that the
+	// hub reports, as the child device list has no timestamp for when the hub last heard from a sensor, so it is zero
+	// until the sensor is first seen online after the exporter starts.
+	LastSeenOnline time.Time
+
+	TemperatureCelsius       *float64 `json:",omitempty"`
+	HumidityPercent          *int     `json:",omitempty"`
+	MotionDetected           *bool    `json:",omitempty"`
+	Open                     *bool    `json:",omitempty"`
+	TargetTemperatureCelsius *float64 `json:",omitempty"`
+}
+
+func (dev *Device) populateSensors(ctx context.Context, status *deviceStatus, now time.Time) error {
+	children, err := dev.listChildren(ctx)
+	if err != nil {
+		return err
+	}
+	hub := &hubInfo{}
+	paired := make(map[string]bool, len(children))
+	for _, childInfo := range children {
+		sensor := sensorFrom(childInfo)
+		paired[sensor.Id] = true
+		if sensor.Online {
+			dev.sensorsLastSeenOnline[sensor.Id] = now
+		}
+		sensor.LastSeenOnline = dev.sensorsLastSeenOnline[sensor.Id]
+		hub.Sensors = append(hub.Sensors, sensor)
+	}
+	// Sensors unpaired from the hub are forgotten
+	maps.DeleteFunc(dev.sensorsLastSeenOnline, func(id string, _ time.Time) bool { return !paired[id] })
+	status.hubInfo = hub
+	return nil
+}
+
+func sensorFrom(childInfo map[string]interface{}) sensorInfo {
+	temperatureUnit := stringFrom(childInfo["temp_unit"])
+	sensor := sensorInfo{
+		Id:         stringFrom(childInfo["device_id"]),
+		Nickname:   decodeNickname(stringFrom(childInfo["nickname"])),
+		Model:      stringFrom(childInfo["model"]),
+		Online:     stringFrom(childInfo["status"]) != "offline",
+		BatteryLow: childInfo["at_low_battery"] == true,
+		Rssi:       intFrom(childInfo["rssi"]),
+	}
+	if temperature, isNumber := childInfo["current_temp"].(float64); isNumber {
+		celsius := toCelsius(temperature, temperatureUnit)
+		sensor.TemperatureCelsius = &celsius
+	}
+	if humidity, isNumber := childInfo["current_humidity"].(float64); isNumber {
+		percent := int(humidity)
+		sensor.HumidityPercent = &percent
+	}
+	if detected, isBool := childInfo["detected"].(bool); isBool {
+		sensor.MotionDetected = &detected
+	}
+	if open, isBool := childInfo["open"].(bool); isBool {
+		sensor.Open = &open
+	}
+	if target, isNumber := childInfo["target_temp"].(float64); isNumber {
+		celsius := toCelsius(target, temperatureUnit)
+		sensor.TargetTemperatureCelsius = &celsius
+	}
+	return sensor
+}
+
+// toCelsius converts a temperature from the unit chosen in the app, which is also the unit the hub reports it in
+func toCelsius(temperature float64, unit string) float64 {
+	if unit == "fahrenheit" {
+		return (temperature - 32) * 5 / 9
+	}
+	return temperature
+}
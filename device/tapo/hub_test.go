@@ -0,0 +1,159 @@
+package tapo
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"homepower/types"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestH100ExportsEachSensorsReadings(t *testing.T) {
+	server := &klapServer{
+		t:        t,
+		username: "test@example.com",
+		password: "test_password",
+		handler:  handleKlapH100,
+	}
+	testServer, port := createKlapServer(t, server)
+	defer testServer.Close()
+
+	device, err := NewDevice(server.username, server.password, &types.DeviceConfig{
+		Name:  "Hub",
+		Room:  "Hall",
+		Model: types.TapoH100,
+		Ip:    "127.0.0.1",
+	}, prometheus.NewRegistry(), port)
+	assert.NoError(t, err)
+
+	assert.NoError(t, device.PollDeviceAndUpdateMetrics(context.Background()))
+	assert.Nil(t, device.metrics.deviceTurnedOn)
+	sensors := device.metrics.sensors
+	labels := func(name string, id string, model string) prometheus.Labels {
+		return prometheus.Labels{"dev_name": name, "dev_full_name": "Hall " + name, "child_id": id, "sensor_model": model}
+	}
+	thermometer := labels("Bedroom Thermometer", "T1", "T315")
+	assert.Equal(t, 19.5, testutil.ToFloat64(sensors.temperature.With(thermometer)))
+	assert.Equal(t, 61.0, testutil.ToFloat64(sensors.humidity.With(thermometer)))
+	assert.Equal(t, 0.0, testutil.ToFloat64(sensors.batteryLow.With(thermometer)))
+	assert.Equal(t, -56.0, testutil.ToFloat64(sensors.rssi.With(thermometer)))
+	assert.Greater(t, testutil.ToFloat64(sensors.lastSeenOnline.With(thermometer)), 0.0)
+
+	motion := labels("Landing Motion", "T2", "T100")
+	assert.Equal(t, 1.0, testutil.ToFloat64(sensors.motionDetected.With(motion)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(sensors.batteryLow.With(motion)))
+
+	// A sensor that is offline has no readings, as the hub goes on reporting the last ones it had, and no time last seen
+	// online until it is first seen online after startup
+	assert.Equal(t, 0, testutil.CollectAndCount(sensors.open))
+	assert.Equal(t, 3, testutil.CollectAndCount(sensors.lastSeenOnline))
+
+	radiator := labels("Lounge Radiator", "T4", "KE100")
+	assert.Equal(t, 20.0, testutil.ToFloat64(sensors.temperature.With(radiator)))
+	assert.Equal(t, 21.0, testutil.ToFloat64(sensors.targetTemperature.With(radiator)))
+
+	// Each sensor only has the readings its model takes
+	assert.Equal(t, 2, testutil.CollectAndCount(sensors.temperature))
+	assert.Equal(t, 1, testutil.CollectAndCount(sensors.humidity))
+	assert.Equal(t, 3, testutil.CollectAndCount(sensors.batteryLow))
+
+	// -1 is a real temperature, so the sensors' series are dropped rather than set to rogue values
+	device.ResetMetricsToRogueValues()
+	assert.Equal(t, 0, testutil.CollectAndCount(sensors.temperature))
+	assert.Equal(t, 0, testutil.CollectAndCount(sensors.rssi))
+	assert.Equal(t, 0, testutil.CollectAndCount(sensors.lastSeenOnline))
+}
+
+func TestSensorsUnpairedFromTheHubAreForgotten(t *testing.T) {
+	children := h100Children
+	server := &klapServer{
+		t:        t,
+		username: "test@example.com",
+		password: "test_password",
+		handler: func(t *testing.T, method string, params any) ([]byte, error) {
+			if method == "get_child_device_list" {
+				return replyWithResult(map[string]any{"child_device_list": children, "start_index": 0, "sum": len(children)})
+			}
+			return handleKlapH100(t, method, params)
+		},
+	}
+	testServer, port := createKlapServer(t, server)
+	defer testServer.Close()
+
+	device, err := NewDevice(server.username, server.password, &types.DeviceConfig{
+		Name:  "Hub",
+		Room:  "Hall",
+		Model: types.TapoH100,
+		Ip:    "127.0.0.1",
+	}, prometheus.NewRegistry(), port)
+	assert.NoError(t, err)
+
+	assert.NoError(t, device.PollDeviceAndUpdateMetrics(context.Background()))
+	assert.Contains(t, device.sensorsLastSeenOnline, "T1")
+	children = h100Children[1:]
+	assert.NoError(t, device.PollDeviceAndUpdateMetrics(context.Background()))
+	assert.NotContains(t, device.sensorsLastSeenOnline, "T1")
+	assert.Contains(t, device.sensorsLastSeenOnline, "T2")
+	assert.Equal(t, 2, testutil.CollectAndCount(device.metrics.sensors.lastSeenOnline))
+}
+
+var h100Children = []map[string]any{
+	hubChild("T1", "Bedroom Thermometer", "T315", map[string]any{"current_temp": 19.5, "current_humidity": 61, "temp_unit": "celsius", "rssi": -56}),
+	hubChild("T2", "Landing Motion", "T100", map[string]any{"detected": true, "at_low_battery": true}),
+	hubChild("T3", "Back Door", "T110", map[string]any{"open": false, "status": "offline"}),
+	hubChild("T4", "Lounge Radiator", "KE100", map[string]any{"current_temp": 68.0, "target_temp": 69.8, "temp_unit": "fahrenheit"}),
+}
+
+func hubChild(id string, nickname string, model string, readings map[string]any) map[string]any {
+	child := map[string]any{
+		"device_id":      id,
+		"nickname":       base64.StdEncoding.EncodeToString([]byte(nickname)),
+		"model":          model,
+		"type":           "SMART.TAPOSENSOR",
+		"status":         "online",
+		"at_low_battery": false,
+		"rssi":           -60,
+	}
+	for key, value := range readings {
+		child[key] = value
+	}
+	return child
+}
+
+func handleKlapH100(t *testing.T, method string, params any) ([]byte, error) {
+	t.Logf("Method: %s, Params: %s", method, params)
+	reply := func(result any) ([]byte, error) {
+		return json.Marshal(struct {
+			ErrorCode int `json:"error_code"`
+			Result    any `json:"result"`
+		}{ErrorCode: 0, Result: result})
+	}
+	switch method {
+	case "get_device_info":
+		return reply(map[string]any{
+			"device_id":    "80230000",
+			"fw_ver":       "1.5.5 Build 240105 Rel.192438",
+			"hw_ver":       "1.0",
+			"type":         "SMART.TAPOHUB",
+			"model":        "H100",
+			"mac":          "AA-BB-CC-11-22-33",
+			"hw_id":        "999888777666555444333222111000AA",
+			"oem_id":       "A3B2C1A3B2C1A3B2C1A3B2C1A3B2C1A3",
+			"nickname":     "SHVi", // base64 for "Hub"
+			"rssi":         -40,
+			"signal_level": 3,
+			"overheated":   false,
+		})
+	case "get_child_device_list":
+		return reply(map[string]any{"child_device_list": h100Children, "start_index": 0, "sum": len(h100Children)})
+	case "component_nego":
+		return componentNegoReply("device", "firmware", "time", "wireless", "child_device", "control_child", "alarm")
+	default:
+		return nil, errors.New("method not known: " + method)
+	}
+}
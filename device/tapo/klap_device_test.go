@@ -1,12 +1,14 @@
 package tapo
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"homepower/types"
 	"testing"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -29,8 +31,13 @@ func TestP100KlapDevice(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, device)
 
-	err = device.PollDeviceAndUpdateMetrics()
+	assert.Equal(t, "", device.Protocol())
+	assert.Nil(t, device.LastStatus())
+
+	err = device.PollDeviceAndUpdateMetrics(context.Background())
 	assert.NoError(t, err)
+	assert.Equal(t, "KLAP", device.Protocol())
+	assert.NotNil(t, device.LastStatus())
 }
 
 func TestP110KlapDevice(t *testing.T) {
@@ -52,7 +59,7 @@ func TestP110KlapDevice(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, device)
 
-	err = device.PollDeviceAndUpdateMetrics()
+	err = device.PollDeviceAndUpdateMetrics(context.Background())
 	assert.NoError(t, err)
 }
 
@@ -75,8 +82,23 @@ func TestP110KlapDeviceAugust2024(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, device)
 
-	err = device.PollDeviceAndUpdateMetrics()
+	err = device.PollDeviceAndUpdateMetrics(context.Background())
+	assert.NoError(t, err)
+}
+
+func TestProbeModelKlapDevice(t *testing.T) {
+	server := &klapServer{
+		t:        t,
+		username: "test@example.com",
+		password: "test_password",
+		handler:  handleKlapP110Original,
+	}
+	testServer, port := createKlapServer(t, server)
+	defer testServer.Close()
+
+	model, err := ProbeModel(context.Background(), server.username, server.password, "127.0.0.1", port)
 	assert.NoError(t, err)
+	assert.Equal(t, "P110", model)
 }
 
 func handleKlapP100(t *testing.T, method string, params any) ([]byte, error) {
@@ -157,6 +179,8 @@ func handleKlapP100(t *testing.T, method string, params any) ([]byte, error) {
 				AutoOffRemainTime: 0,
 			},
 		})
+	} else if method == "component_nego" {
+		return componentNegoReply(plugComponents...)
 	} else {
 		return nil, errors.New("method not known: " + method)
 	}
@@ -271,6 +295,8 @@ func handleKlapP110Original(t *testing.T, method string, params any) ([]byte, er
 				TodayRuntime: 181,
 			},
 		})
+	} else if method == "component_nego" {
+		return componentNegoReply(append(plugComponents, "energy_monitoring")...)
 	} else {
 		return nil, errors.New("method not known: " + method)
 	}
@@ -378,7 +404,147 @@ func handleKlapP110August2024(t *testing.T, method string, params any) ([]byte,
 				CurrentPower:      2529,
 			},
 		})
+	} else if method == "component_nego" {
+		return componentNegoReply(append(plugComponents, "energy_monitoring")...)
 	} else {
 		return nil, errors.New("method not known: " + method)
 	}
 }
+
+func TestL530KlapDeviceExposesEffectsAndDefaultStates(t *testing.T) {
+	server := &klapServer{
+		t:        t,
+		username: "test@example.com",
+		password: "test_password",
+		handler:  handleKlapBulb(l530DeviceInfo),
+	}
+	testServer, port := createKlapServer(t, server)
+	defer testServer.Close()
+
+	device, err := NewDevice(server.username, server.password, &types.DeviceConfig{
+		Name:  "Pendant Light",
+		Room:  "Office",
+		Model: types.TapoL535,
+		Ip:    "127.0.0.1",
+	}, prometheus.NewRegistry(), port)
+	assert.NoError(t, err)
+
+	assert.NoError(t, device.PollDeviceAndUpdateMetrics(context.Background()))
+	assert.Equal(t, 1.0, testutil.ToFloat64(*device.metrics.deviceTurnedOn))
+	assert.Equal(t, 60.0, testutil.ToFloat64(*device.metrics.brightness))
+	assert.Equal(t, 2700.0, testutil.ToFloat64(*device.metrics.colourTemperature))
+	assert.Equal(t, 1.0, testutil.ToFloat64(*device.metrics.dynamicEffectOn))
+	assert.Equal(t, 45.0, testutil.ToFloat64(*device.metrics.defaultBrightness))
+	assert.Equal(t, 4000.0, testutil.ToFloat64(*device.metrics.defaultColourTemperature))
+
+	status := device.LastStatus().(*deviceStatus)
+	assert.True(t, status.IsColour)
+	assert.True(t, status.IsVariableColourTemperature)
+	assert.Equal(t, 2500, status.MinColourTemperature)
+	assert.Equal(t, 6500, status.MaxColourTemperature)
+	assert.Equal(t, "last_states", status.DefaultStates.Type)
+}
+
+func TestL510KlapDeviceHasNoColourMetrics(t *testing.T) {
+	server := &klapServer{
+		t:        t,
+		username: "test@example.com",
+		password: "test_password",
+		handler:  handleKlapBulb(l510DeviceInfo),
+	}
+	testServer, port := createKlapServer(t, server)
+	defer testServer.Close()
+
+	device, err := NewDevice(server.username, server.password, &types.DeviceConfig{
+		Name:  "Hall Light",
+		Room:  "Hall",
+		Model: types.TapoL510,
+		Ip:    "127.0.0.1",
+	}, prometheus.NewRegistry(), port)
+	assert.NoError(t, err)
+
+	assert.NoError(t, device.PollDeviceAndUpdateMetrics(context.Background()))
+	assert.Equal(t, 0.0, testutil.ToFloat64(*device.metrics.deviceTurnedOn))
+	assert.Equal(t, 40.0, testutil.ToFloat64(*device.metrics.brightness))
+	assert.Equal(t, 100.0, testutil.ToFloat64(*device.metrics.defaultBrightness))
+	assert.Nil(t, device.metrics.colourTemperature)
+	assert.Nil(t, device.metrics.hue)
+
+	status := device.LastStatus().(*deviceStatus)
+	assert.False(t, status.IsColour)
+	assert.False(t, status.IsVariableColourTemperature)
+	assert.Equal(t, "custom", status.DefaultStates.Type)
+}
+
+func TestBulbThatLeavesOutDeviceOnIsTakenToBeOff(t *testing.T) {
+	info := bulbInfoFrom(map[string]interface{}{"brightness": 40.0})
+	assert.False(t, info.LightOn)
+	assert.Equal(t, 40, info.Brightness)
+}
+
+var l530DeviceInfo = map[string]any{
+	"device_id":                   "802111122223333444455556666777788889999A",
+	"fw_ver":                      "1.1.0 Build 230823 Rel.180044",
+	"hw_ver":                      "3.0",
+	"type":                        "SMART.TAPOBULB",
+	"model":                       "L535",
+	"mac":                         "AA-BB-CC-11-22-33",
+	"hw_id":                       "999888777666555444333222111000AA",
+	"fw_id":                       "00000000000000000000000000000000",
+	"oem_id":                      "A3B2C1A3B2C1A3B2C1A3B2C1A3B2C1A3",
+	"nickname":                    "UGVuZGFudCBMaWdodA==", // base64 for "Pendant Light"
+	"rssi":                        -51,
+	"signal_level":                2,
+	"overheated":                  false,
+	"device_on":                   true,
+	"brightness":                  60,
+	"hue":                         0,
+	"saturation":                  100,
+	"color_temp":                  2700,
+	"color_temp_range":            []int{2500, 6500},
+	"dynamic_light_effect_enable": true,
+	"dynamic_light_effect_id":     "L1",
+	"default_states": map[string]any{
+		"re_power_type": "always_on",
+		"type":          "last_states",
+		"state":         map[string]int{"brightness": 45, "color_temp": 4000, "hue": 0, "saturation": 100},
+	},
+}
+
+var l510DeviceInfo = map[string]any{
+	"device_id":    "802111122223333444455556666777788889999A",
+	"fw_ver":       "1.0.7 Build 220715 Rel.175012",
+	"hw_ver":       "3.0",
+	"type":         "SMART.TAPOBULB",
+	"model":        "L510",
+	"mac":          "AA-BB-CC-11-22-33",
+	"hw_id":        "999888777666555444333222111000AA",
+	"fw_id":        "00000000000000000000000000000000",
+	"oem_id":       "A3B2C1A3B2C1A3B2C1A3B2C1A3B2C1A3",
+	"nickname":     "SGFsbCBMaWdodA==", // base64 for "Hall Light"
+	"rssi":         -60,
+	"signal_level": 2,
+	"overheated":   false,
+	"device_on":    false,
+	"brightness":   40,
+	"default_states": map[string]any{
+		"type":  "custom",
+		"state": map[string]int{"brightness": 100},
+	},
+}
+
+func handleKlapBulb(deviceInfo map[string]any) func(t *testing.T, method string, params any) ([]byte, error) {
+	return func(t *testing.T, method string, params any) ([]byte, error) {
+		t.Logf("Method: %s, Params: %v", method, params)
+		if method == "get_device_info" {
+			return json.Marshal(struct {
+				ErrorCode int `json:"error_code"`
+				Result    any `json:"result"`
+			}{ErrorCode: 0, Result: deviceInfo})
+		} else if method == "component_nego" {
+			return componentNegoReply(bulbComponents(deviceInfo)...)
+		} else {
+			return nil, errors.New("method not known: " + method)
+		}
+	}
+}
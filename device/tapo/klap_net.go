@@ -1,215 +1,77 @@
 package tapo
 
 import (
-	"bytes"
-	"crypto/rand"
-	"crypto/sha1"
-	"crypto/sha256"
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"io"
-	"log"
-	"net/http"
-	"net/http/cookiejar"
-	"net/url"
-	"strconv"
-	"time"
+	"homepower/device/klap"
 )
 
-type klapDeviceAddresses struct {
-	ip      string // x.x.x.x
-	baseUrl string // http://x.x.x.x:80
-	url     *url.URL
-}
-
+// klapDeviceConnection sends Tapo method calls over the shared KLAP transport
 type klapDeviceConnection struct {
-	email     string // Hashed email of the account that originally set up the device
-	password  string // Isn't it weird how the email is hashed and the password isn't
-	addresses klapDeviceAddresses
-	client    *http.Client // A long-lived HTTP client that also retains the HTTP session state (e.g. cookies)
-
-	localSeed  []byte
-	remoteSeed []byte
-	authHash   []byte
-	encryption *encryptionContext
+	*klap.Connection
 }
 
-//goland:noinspection HttpUrlsUsage
 func createKlapDeviceConnection(email, password, deviceIp string, port uint16) (*klapDeviceConnection, error) {
-	jar, err := cookiejar.New(nil)
-	if err != nil {
-		return nil, fmt.Errorf("could not create new cookie jar whilst initialising %s: %w", deviceIp, err)
-	}
-	tr := &http.Transport{
-		DisableKeepAlives:      false,
-		DisableCompression:     false,
-		MaxIdleConnsPerHost:    1,
-		MaxConnsPerHost:        1,
-		IdleConnTimeout:        5 * time.Minute,
-		ResponseHeaderTimeout:  5 * time.Second,
-		MaxResponseHeaderBytes: 4096,
-		ForceAttemptHTTP2:      false,
-	}
-	baseUrl := "http://" + deviceIp + ":" + strconv.FormatUint(uint64(port), 10)
-	parsedUrl, err := url.Parse(baseUrl + "/app/request")
+	connection, err := klap.NewConnection(email, password, deviceIp, port, klap.V2)
 	if err != nil {
-		return nil, fmt.Errorf("could not parse '%s' as a URL object: %w", baseUrl, err)
+		return nil, err
 	}
-	return &klapDeviceConnection{
-		email:    email,
-		password: password,
-		addresses: klapDeviceAddresses{
-			ip:      deviceIp,
-			baseUrl: baseUrl,
-			url:     parsedUrl,
-		},
-		client: &http.Client{
-			Transport: tr,
-			Jar:       jar,
-			Timeout:   10 * time.Second,
-		},
-	}, nil
+	return &klapDeviceConnection{connection}, nil
 }
 
-func (dc *klapDeviceConnection) applyHeadersTo(request *http.Request) {
-	request.Header.Set("Referer", dc.addresses.baseUrl)
-	request.Header.Set("requestByApp", "true")
-	request.Header.Set("Content-Type", "application/json; charset=UTF-8")
-	request.Header.Set("Accept", "application/json")
-	request.Header.Set("Connection", "Keep-Alive")
-	request.Header.Set("Host", dc.addresses.ip)
-	request.Header.Set("User-Agent", "okhttp/3.12.13")
+func (dc *klapDeviceConnection) forgetKeysAndSession() {
+	dc.ForgetKeysAndSession()
 }
-
-func (dc *klapDeviceConnection) doKeyExchange() error {
-	dc.localSeed = make([]byte, 16)
-	if _, err := rand.Read(dc.localSeed); err != nil {
-		return err
-	}
-	request1, err := http.NewRequest(http.MethodPost, dc.addresses.baseUrl+"/app/handshake1", bytes.NewReader(dc.localSeed))
-	if err != nil {
-		return err
-	}
-	dc.applyHeadersTo(request1)
-
-	handshakeResponse, err := dc.exchangeExpect200(request1)
-	if err != nil {
-		return err
-	}
-	if len(handshakeResponse) != 48 {
-		return fmt.Errorf("expected handshake 1 response to be 48 byte but got %d", len(handshakeResponse))
-	}
-	dc.remoteSeed = handshakeResponse[0:16]
-	userHash := sha1.Sum([]byte(dc.email))
-	passHash := sha1.Sum([]byte(dc.password))
-	authHash := sha256.Sum256(append(userHash[:], passHash[:]...))
-	dc.authHash = authHash[:]
-	localRemoteAuthBuffer := append(append(bytes.Clone(dc.localSeed), dc.remoteSeed...), dc.authHash...)
-	expectedHash := sha256.Sum256(localRemoteAuthBuffer)
-	if !bytes.Equal(expectedHash[:], handshakeResponse[16:]) {
-		return errors.New("handshake 1 response hash did not match expected credentials")
-	}
-	time.Sleep(250 * time.Millisecond)
-
-	payload := sha256.Sum256(append(append(bytes.Clone(dc.remoteSeed), dc.localSeed...), dc.authHash...))
-	request2, err := http.NewRequest(http.MethodPost, dc.addresses.baseUrl+"/app/handshake2", bytes.NewReader(payload[:]))
-	if err != nil {
-		return err
-	}
-	_, err = dc.exchangeExpect200(request2)
-	if err != nil {
-		return err
-	}
-
-	dc.encryption, err = setupEncryption(localRemoteAuthBuffer)
-	if err != nil {
-		return err
-	}
-	time.Sleep(500 * time.Millisecond)
-	fmt.Printf("KLAP Handshake Complete for %s\n", dc.addresses.ip)
-	return nil
+func (dc *klapDeviceConnection) protocolName() string {
+	return "KLAP"
 }
-
-func (dc *klapDeviceConnection) hasExchangedKeys() bool {
-	return dc.hasValidSessionCookie() && dc.localSeed != nil && len(dc.localSeed) > 0
+func (dc *klapDeviceConnection) GetDeviceInfo(ctx context.Context) (map[string]interface{}, error) {
+	return dc.makeApiCall(ctx, "{\"method\": \"get_device_info\"}")
 }
-
-func (dc *klapDeviceConnection) exchangeExpect200(request *http.Request) ([]byte, error) {
-	response, err := dc.client.Do(request)
-	if err != nil {
-		return nil, err
-	}
-	defer func(Body io.ReadCloser) {
-		_ = Body.Close()
-	}(response.Body)
-	if response.StatusCode != 200 {
-		return nil, errors.New("expected status code 200, got " + strconv.Itoa(response.StatusCode))
-	}
-	responseBody, err := io.ReadAll(response.Body)
+func (dc *klapDeviceConnection) GetComponents(ctx context.Context) (map[string]interface{}, error) {
+	return dc.makeApiCall(ctx, "{\"method\": \"component_nego\"}")
+}
+func (dc *klapDeviceConnection) GetEnergyUsage(ctx context.Context) (map[string]interface{}, error) {
+	return dc.makeApiCall(ctx, "{\"method\": \"get_energy_usage\"}")
+}
+func (dc *klapDeviceConnection) GetEnergyData(ctx context.Context, params energyDataParams) (map[string]interface{}, error) {
+	payload, err := json.Marshal(methodCall{Method: "get_energy_data", Params: params})
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("could not marshal get_energy_data payload: %w", err)
 	}
-	return responseBody, nil
+	return dc.makeApiCall(ctx, string(payload))
 }
-
-func (dc *klapDeviceConnection) hasValidSessionCookie() bool {
-	for _, cookie := range dc.client.Jar.Cookies(dc.addresses.url) {
-		if cookie.Name == "TP_SESSIONID" {
-			if cookie.Expires.Year() < 1601 { // has no expiry
-				return true
-			}
-			return cookie.Expires.After(time.Now())
-		}
+func (dc *klapDeviceConnection) GetChildDeviceList(ctx context.Context, startIndex int) (map[string]interface{}, error) {
+	payload, err := json.Marshal(methodCall{Method: "get_child_device_list", Params: childDeviceListParams{StartIndex: startIndex}})
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal get_child_device_list payload: %w", err)
 	}
-	return false
+	return dc.makeApiCall(ctx, string(payload))
 }
-
-func (dc *klapDeviceConnection) forgetKeysAndSession() {
-	dc.client.CloseIdleConnections()
-	dc.client.Jar.SetCookies(dc.addresses.url, []*http.Cookie{{
-		Name:   "TP_SESSIONID",
-		MaxAge: -1,
-	}})
-	dc.localSeed = nil
-	dc.remoteSeed = nil
-	dc.authHash = nil
-}
-
-func (dc *klapDeviceConnection) GetDeviceInfo() (map[string]interface{}, error) {
-	return dc.makeApiCall("{\"method\": \"get_device_info\"}")
-}
-func (dc *klapDeviceConnection) GetEnergyUsage() (map[string]interface{}, error) {
-	return dc.makeApiCall("{\"method\": \"get_energy_usage\"}")
-}
-func (dc *klapDeviceConnection) makeApiCall(payload string) (map[string]interface{}, error) {
-	if !dc.hasExchangedKeys() {
-		log.Println("Not logged in, will log in before making api request")
-		if err := dc.doKeyExchange(); err != nil {
-			dc.forgetKeysAndSession()
-			return nil, fmt.Errorf("could not log in before making API call: %w", err)
-		}
+func (dc *klapDeviceConnection) ControlChild(ctx context.Context, childId string, method string) (map[string]interface{}, error) {
+	payload, err := json.Marshal(methodCall{Method: "control_child", Params: controlChildParams(childId, method)})
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal control_child payload: %w", err)
 	}
-
-	encryptedPayload := dc.encryption.Encrypt([]byte(payload))
-	request, err := http.NewRequest(
-		http.MethodPost,
-		dc.addresses.baseUrl+"/app/request?seq="+strconv.Itoa(int(dc.encryption.sequenceNumber)),
-		bytes.NewReader(encryptedPayload))
-	dc.applyHeadersTo(request)
+	result, err := dc.makeApiCall(ctx, string(payload))
 	if err != nil {
 		return nil, err
 	}
-	response, err := dc.exchangeExpect200(request)
+	return unwrapControlChildResult(result)
+}
+func (dc *klapDeviceConnection) GetChildDeviceComponentList(ctx context.Context, startIndex int) (map[string]interface{}, error) {
+	payload, err := json.Marshal(methodCall{Method: "get_child_device_component_list", Params: childDeviceListParams{StartIndex: startIndex}})
 	if err != nil {
-		dc.forgetKeysAndSession()
-		return nil, err
+		return nil, fmt.Errorf("could not marshal get_child_device_component_list payload: %w", err)
 	}
-	clearText, err := dc.encryption.Decrypt(response)
+	return dc.makeApiCall(ctx, string(payload))
+}
+func (dc *klapDeviceConnection) makeApiCall(ctx context.Context, payload string) (map[string]interface{}, error) {
+	clearText, err := dc.Request(ctx, []byte(payload))
 	if err != nil {
 		return nil, err
 	}
-	//fmt.Printf("clearText:\n %s\n\n", string(clearText))
 	return dc.unmarshalApiResponse(clearText)
 }
 
@@ -219,7 +81,7 @@ func (dc *klapDeviceConnection) unmarshalApiResponse(response []byte) (map[strin
 		return nil, err
 	}
 	if errorCode, present := responseData["error_code"]; present && int(errorCode.(float64)) != 0 {
-		return nil, errors.New("non-zero error code returned: " + strconv.Itoa(int(errorCode.(float64))))
+		return nil, fmt.Errorf("%w: %d", errNonZeroErrorCode, int(errorCode.(float64)))
 	}
 	responseResult := responseData["result"].(map[string]interface{})
 	return responseResult, nil
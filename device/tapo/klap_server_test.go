@@ -118,8 +118,8 @@ func (s *klapServer) handleRequest(writer http.ResponseWriter, request *http.Req
 	require.NoError(s.t, err)
 
 	var requestBody struct {
-		Method string `json:"method"`
-		Params string `json:"params"`
+		Method string          `json:"method"`
+		Params json.RawMessage `json:"params"`
 	}
 	err = json.Unmarshal(requestClearText, &requestBody)
 	if err != nil {
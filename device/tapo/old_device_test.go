@@ -1,12 +1,14 @@
 package tapo
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"homepower/types"
 	"testing"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -29,8 +31,16 @@ func TestOldDevice(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, device)
 
-	err = device.PollDeviceAndUpdateMetrics()
+	assert.Equal(t, "", device.Protocol())
+	assert.Nil(t, device.LastStatus())
+
+	err = device.PollDeviceAndUpdateMetrics(context.Background())
 	assert.NoError(t, err)
+	assert.Equal(t, "securePassthrough", device.Protocol())
+	assert.NotNil(t, device.LastStatus())
+	// The firmware cannot list its components, so the P100 is known to be a switch from its model
+	assert.Equal(t, 1.0, testutil.ToFloat64(*device.metrics.deviceTurnedOn))
+	assert.Equal(t, 194.0, testutil.ToFloat64(*device.metrics.onTime))
 }
 
 func handleP100(t *testing.T, method string, params any) ([]byte, error) {
@@ -111,6 +121,9 @@ func handleP100(t *testing.T, method string, params any) ([]byte, error) {
 				},
 			},
 		})
+	} else if method == "component_nego" {
+		// Firmware this old does not know the method
+		return json.Marshal(map[string]any{"error_code": -1})
 	} else {
 		return nil, errors.New("method not known: " + method)
 	}
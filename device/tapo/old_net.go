@@ -2,6 +2,7 @@ package tapo
 
 import (
 	"bytes"
+	"context"
 	"crypto/cipher"
 	"encoding/base64"
 	"encoding/json"
@@ -97,8 +98,11 @@ func (dc *oldDeviceConnection) applyHeadersTo(request *http.Request) {
 	request.Header.Set("User-Agent", "okhttp/3.12.13")
 }
 
-func (dc *oldDeviceConnection) exchange(body []byte) (map[string]interface{}, error) {
-	request, err := http.NewRequest(http.MethodPost, dc.devicePostUrl(), bytes.NewReader(body))
+func (dc *oldDeviceConnection) exchange(ctx context.Context, body []byte) (map[string]interface{}, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, dc.devicePostUrl(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
 	dc.applyHeadersTo(request)
 
 	response, err := dc.client.Do(request)
@@ -159,14 +163,14 @@ func (dc *oldDeviceConnection) unmarshalPassthroughResponse(passthroughResult ma
 		return nil, err
 	}
 	if errorCode, present := responseData["error_code"]; present && int(errorCode.(float64)) != 0 {
-		return nil, errors.New("non-zero error code returned within encrypted payload: " + strconv.Itoa(int(errorCode.(float64))))
+		return nil, fmt.Errorf("%w within encrypted payload: %d", errNonZeroErrorCode, int(errorCode.(float64)))
 	}
 
 	responseResult := responseData["result"].(map[string]interface{})
 	return responseResult, nil
 }
 
-func (dc *oldDeviceConnection) doKeyExchange() error {
+func (dc *oldDeviceConnection) doKeyExchange(ctx context.Context) error {
 	dc.logout()
 	privateKey, err := NewRsaKeypair()
 	if err != nil {
@@ -190,7 +194,7 @@ func (dc *oldDeviceConnection) doKeyExchange() error {
 	if err != nil {
 		return fmt.Errorf("could not marshal key exchange request body: %w", err)
 	}
-	result, err := dc.exchange(handshakeBody)
+	result, err := dc.exchange(ctx, handshakeBody)
 	if err != nil {
 		return fmt.Errorf("could not perform key exchange POST request: %w", err)
 	}
@@ -220,9 +224,9 @@ func (dc *oldDeviceConnection) hasValidSessionCookie() bool {
 	return false
 }
 
-func (dc *oldDeviceConnection) doLogin() error {
+func (dc *oldDeviceConnection) doLogin(ctx context.Context) error {
 	if !dc.hasExchangedKeys() {
-		if err := dc.doKeyExchange(); err != nil {
+		if err := dc.doKeyExchange(ctx); err != nil {
 			return fmt.Errorf("could not do key exchange before logging in: %w", err)
 		}
 	}
@@ -239,7 +243,7 @@ func (dc *oldDeviceConnection) doLogin() error {
 		return fmt.Errorf("could not marshal login_device payload: %w", err)
 	}
 
-	passthroughResult, err := dc.exchange(passthroughBody)
+	passthroughResult, err := dc.exchange(ctx, passthroughBody)
 	if err != nil {
 		return fmt.Errorf("could not perform login POST request: %w", err)
 	}
@@ -270,25 +274,47 @@ func (dc *oldDeviceConnection) forgetKeysAndSession() {
 	dc.cbcIv = nil
 }
 
-func (dc *oldDeviceConnection) GetDeviceInfo() (map[string]interface{}, error) {
-	return dc.makeApiCall("get_device_info")
+func (dc *oldDeviceConnection) protocolName() string {
+	return "securePassthrough"
+}
+func (dc *oldDeviceConnection) GetDeviceInfo(ctx context.Context) (map[string]interface{}, error) {
+	return dc.makeApiCall(ctx, "get_device_info", nil)
+}
+func (dc *oldDeviceConnection) GetComponents(ctx context.Context) (map[string]interface{}, error) {
+	return dc.makeApiCall(ctx, "component_nego", nil)
+}
+func (dc *oldDeviceConnection) GetEnergyUsage(ctx context.Context) (map[string]interface{}, error) {
+	return dc.makeApiCall(ctx, "get_energy_usage", nil)
+}
+func (dc *oldDeviceConnection) GetEnergyData(ctx context.Context, params energyDataParams) (map[string]interface{}, error) {
+	return dc.makeApiCall(ctx, "get_energy_data", params)
+}
+func (dc *oldDeviceConnection) GetChildDeviceList(ctx context.Context, startIndex int) (map[string]interface{}, error) {
+	return dc.makeApiCall(ctx, "get_child_device_list", childDeviceListParams{StartIndex: startIndex})
+}
+func (dc *oldDeviceConnection) ControlChild(ctx context.Context, childId string, method string) (map[string]interface{}, error) {
+	result, err := dc.makeApiCall(ctx, "control_child", controlChildParams(childId, method))
+	if err != nil {
+		return nil, err
+	}
+	return unwrapControlChildResult(result)
 }
-func (dc *oldDeviceConnection) GetEnergyUsage() (map[string]interface{}, error) {
-	return dc.makeApiCall("get_energy_usage")
+func (dc *oldDeviceConnection) GetChildDeviceComponentList(ctx context.Context, startIndex int) (map[string]interface{}, error) {
+	return dc.makeApiCall(ctx, "get_child_device_component_list", childDeviceListParams{StartIndex: startIndex})
 }
-func (dc *oldDeviceConnection) makeApiCall(method string) (map[string]interface{}, error) {
+func (dc *oldDeviceConnection) makeApiCall(ctx context.Context, method string, params any) (map[string]interface{}, error) {
 	if !dc.isLoggedIn() {
 		log.Println("Not logged in, will log in before making api request")
-		if err := dc.doLogin(); err != nil {
+		if err := dc.doLogin(ctx); err != nil {
 			return nil, fmt.Errorf("could not log in before making API call: %w", err)
 		}
 	}
 
-	passthroughBody, err := dc.marshalPassthroughPayload(method, nil)
+	passthroughBody, err := dc.marshalPassthroughPayload(method, params)
 	if err != nil {
 		return nil, fmt.Errorf("could not marshal passthrough payload for %s: %w", method, err)
 	}
-	passthroughResult, err := dc.exchange(passthroughBody)
+	passthroughResult, err := dc.exchange(ctx, passthroughBody)
 	if err != nil {
 		return nil, fmt.Errorf("could not perform %s POST request: %w", method, err)
 	}
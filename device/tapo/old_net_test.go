@@ -1,6 +1,7 @@
 package tapo
 
 import (
+	"context"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -16,7 +17,7 @@ func TestOldLogin(t *testing.T) {
 	assert.Equal(t, false, dc.hasExchangedKeys())
 	assert.Equal(t, false, dc.isLoggedIn())
 
-	err = dc.doLogin()
+	err = dc.doLogin(context.Background())
 	assert.NoError(t, err)
 	assert.Equal(t, true, dc.hasExchangedKeys())
 	assert.Equal(t, true, dc.isLoggedIn())
@@ -3,71 +3,132 @@ package tapo
 import (
 	"fmt"
 	"homepower/types"
+	"strconv"
+	"strings"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 type prometheusMetrics struct {
-	isLight             bool
-	isSwitch            bool
-	hasEnergyMonitoring bool
-	commonLabels        prometheus.Labels
-
-	updateInfoMetric func(status *deviceStatus) error
-	overheated       *prometheus.Gauge
-	overCurrent      *prometheus.Gauge
-	powerProtected   *prometheus.Gauge
-	charging         *prometheus.Gauge
-	wifiRssi         *prometheus.Gauge
-	signalLevel      *prometheus.Gauge
-	deviceTurnedOn   *prometheus.Gauge
+	registry     prometheus.Registerer
+	config       *types.DeviceConfig
+	commonLabels prometheus.Labels
+
+	// Each feature's metrics are registered once it is first negotiated, and kept even if a later session lacks it
+	isLight              bool
+	isSwitch             bool
+	hasColour            bool
+	hasColourTemperature bool
+	hasEnergyMonitoring  bool
+
+	info           *prometheus.GaugeVec
+	bulbInfo       *prometheus.GaugeVec // only for lights
+	overheated     *prometheus.Gauge
+	overCurrent    *prometheus.Gauge
+	powerProtected *prometheus.Gauge
+	charging       *prometheus.Gauge
+	wifiRssi       *prometheus.Gauge
+	signalLevel    *prometheus.Gauge
+	deviceTurnedOn *prometheus.Gauge // only for switches and lights
 
 	onTime *prometheus.Gauge // only for switches
 
-	brightness        *prometheus.Gauge // only for lights
-	colourTemperature *prometheus.Gauge // only for lights
-	hue               *prometheus.Gauge // only for lights
-	saturation        *prometheus.Gauge // only for lights
+	brightness               *prometheus.Gauge // only for lights
+	dynamicEffectOn          *prometheus.Gauge // only for lights
+	defaultBrightness        *prometheus.Gauge // only for lights
+	colourTemperature        *prometheus.Gauge // only for lights with a colour temperature
+	hue                      *prometheus.Gauge // only for colour lights
+	saturation               *prometheus.Gauge // only for colour lights
+	defaultColourTemperature *prometheus.Gauge // only for lights with a colour temperature
+	defaultHue               *prometheus.Gauge // only for colour lights
+	defaultSaturation        *prometheus.Gauge // only for colour lights
+
+	powerMilliWatts      *prometheus.Gauge // only for energy monitors
+	monthEnergyWattHours *prometheus.Gauge // only for energy monitors
+	todayEnergyWattHours *prometheus.Gauge // only for energy monitors
 
-	powerMilliWatts      *prometheus.Gauge // P110
-	monthEnergyWattHours *prometheus.Gauge // P110
-	todayEnergyWattHours *prometheus.Gauge // P110
+	outlets *outletMetrics // only for power strips
+	sensors *sensorMetrics // only for hubs
 }
 
-func registerMetrics(registry prometheus.Registerer, commonLabels prometheus.Labels, isSwitch, isLight, hasEnergyMonitoring bool) *prometheusMetrics {
+// registerMetrics registers the metrics that every device has; the rest wait for registerFeatures
+func registerMetrics(registry prometheus.Registerer, config *types.DeviceConfig) *prometheusMetrics {
+	commonLabels := types.GenerateCommonLabels(config)
 	metrics := prometheusMetrics{
-		isLight:             isLight,
-		isSwitch:            isSwitch,
-		hasEnergyMonitoring: hasEnergyMonitoring,
-		commonLabels:        commonLabels,
-
-		updateInfoMetric: registerInfoMetricUpdater(registry, commonLabels),
-		overheated:       types.NewGauge(registry, commonLabels, "tapo", "overheated_bool"),
-		overCurrent:      types.NewGauge(registry, commonLabels, "tapo", "overcurrent_bool"),
-		powerProtected:   types.NewGauge(registry, commonLabels, "tapo", "power_protected_bool"),
-		charging:         types.NewGauge(registry, commonLabels, "tapo", "charging_bool"),
-		wifiRssi:         types.NewGauge(registry, commonLabels, "tapo", "wifi_rssi_db"),
-		signalLevel:      types.NewGauge(registry, commonLabels, "tapo", "signal_level"),
-		deviceTurnedOn:   types.NewGauge(registry, commonLabels, "tapo", "device_turned_on_bool"),
-	}
-	if isSwitch {
-		metrics.onTime = types.NewGauge(registry, commonLabels, "tapo", "switched_on_time_seconds")
-	}
-	if isLight {
-		metrics.brightness = types.NewGauge(registry, commonLabels, "tapo", "bulb_brightness_percent")
-		metrics.colourTemperature = types.NewGauge(registry, commonLabels, "tapo", "bulb_colour_temperature_kelvin")
-		metrics.hue = types.NewGauge(registry, commonLabels, "tapo", "bulb_hue")
-		metrics.saturation = types.NewGauge(registry, commonLabels, "tapo", "bulb_saturation_percent")
-	}
-	if hasEnergyMonitoring {
-		metrics.powerMilliWatts = types.NewGauge(registry, commonLabels, "tapo", "em_power_mw")
-		metrics.todayEnergyWattHours = types.NewGauge(registry, commonLabels, "tapo", "em_today_energy_wh")
-		metrics.monthEnergyWattHours = types.NewGauge(registry, commonLabels, "tapo", "em_month_energy_wh")
+		registry:     registry,
+		config:       config,
+		commonLabels: commonLabels,
+
+		info: prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "device_info", Namespace: "tapo", ConstLabels: commonLabels}, []string{
+			"alias", "device_id", "firmware_version", "hardware_id", "mac_address", "model_name", "oem_id", "device_type",
+		}),
+		bulbInfo: prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "bulb_info", Namespace: "tapo", ConstLabels: commonLabels}, []string{
+			"is_colour", "is_variable_temp", "min_colour_temp", "max_colour_temp", "default_state",
+		}),
+		overheated:     types.NewGauge(registry, commonLabels, "tapo", "overheated_bool"),
+		overCurrent:    types.NewGauge(registry, commonLabels, "tapo", "overcurrent_bool"),
+		powerProtected: types.NewGauge(registry, commonLabels, "tapo", "power_protected_bool"),
+		charging:       types.NewGauge(registry, commonLabels, "tapo", "charging_bool"),
+		wifiRssi:       types.NewGauge(registry, commonLabels, "tapo", "wifi_rssi_db"),
+		signalLevel:    types.NewGauge(registry, commonLabels, "tapo", "signal_level"),
 	}
+	registry.MustRegister(metrics.info)
 	metrics.resetToRogueValues()
 	return &metrics
 }
 
+// registerFeatures registers the metrics of each feature that has not been seen before.  It is called mid-poll, so only
+// the new metrics start at their rogue value until the poll updates them; the rest keep their last values.
+func (metrics *prometheusMetrics) registerFeatures(found features) {
+	registry, commonLabels := metrics.registry, metrics.commonLabels
+	newGauge := func(name string) *prometheus.Gauge {
+		gauge := types.NewGauge(registry, commonLabels, "tapo", name)
+		types.SetIfPresent(gauge, -1.0)
+		return gauge
+	}
+	if (found.isSwitch || found.isLight) && metrics.deviceTurnedOn == nil {
+		metrics.deviceTurnedOn = newGauge("device_turned_on_bool")
+	}
+	if found.isSwitch && !metrics.isSwitch {
+		metrics.isSwitch = true
+		metrics.onTime = newGauge("switched_on_time_seconds")
+	}
+	if found.isLight && !metrics.isLight {
+		metrics.isLight = true
+		registry.MustRegister(metrics.bulbInfo)
+		metrics.brightness = newGauge("bulb_brightness_percent")
+		metrics.dynamicEffectOn = newGauge("bulb_dynamic_effect_on_bool")
+		metrics.defaultBrightness = newGauge("bulb_default_brightness_percent")
+	}
+	if found.hasColour && !metrics.hasColour {
+		metrics.hasColour = true
+		metrics.hue = newGauge("bulb_hue")
+		metrics.saturation = newGauge("bulb_saturation_percent")
+		metrics.defaultHue = newGauge("bulb_default_hue")
+		metrics.defaultSaturation = newGauge("bulb_default_saturation_percent")
+	}
+	if found.hasColourTemperature && !metrics.hasColourTemperature {
+		metrics.hasColourTemperature = true
+		metrics.colourTemperature = newGauge("bulb_colour_temperature_kelvin")
+		metrics.defaultColourTemperature = newGauge("bulb_default_colour_temperature_kelvin")
+	}
+	if found.hasEnergyMonitoring && !metrics.hasEnergyMonitoring {
+		metrics.hasEnergyMonitoring = true
+		metrics.powerMilliWatts = newGauge("em_power_mw")
+		metrics.todayEnergyWattHours = newGauge("em_today_energy_wh")
+		metrics.monthEnergyWattHours = newGauge("em_month_energy_wh")
+	}
+	if found.hasOutlets && metrics.outlets == nil {
+		metrics.outlets = registerOutletMetrics(registry, metrics.config)
+	}
+	if found.hasOutletEnergyMonitoring && metrics.outlets != nil {
+		metrics.outlets.registerEnergyMetrics(registry)
+	}
+	if found.isHub && metrics.sensors == nil {
+		metrics.sensors = registerSensorMetrics(registry, metrics.config)
+	}
+}
+
 func (metrics *prometheusMetrics) updateMetrics(status *deviceStatus) error {
 	if status == nil {
 		metrics.resetToRogueValues()
@@ -85,16 +146,27 @@ func (metrics *prometheusMetrics) updateMetrics(status *deviceStatus) error {
 		if metrics.isLight && status.smartBulbInfo != nil {
 			types.SetFromBool(metrics.deviceTurnedOn, status.LightOn)
 			types.SetFromInt(metrics.brightness, status.Brightness)
+			types.SetFromBool(metrics.dynamicEffectOn, status.DynamicEffectOn)
+			types.SetFromInt(metrics.defaultBrightness, status.DefaultStates.Brightness)
 			types.SetFromInt(metrics.colourTemperature, status.ColourTemperature)
 			types.SetFromInt(metrics.hue, status.Hue)
 			types.SetFromInt(metrics.saturation, status.Saturation)
+			types.SetFromInt(metrics.defaultColourTemperature, status.DefaultStates.ColourTemperature)
+			types.SetFromInt(metrics.defaultHue, status.DefaultStates.Hue)
+			types.SetFromInt(metrics.defaultSaturation, status.DefaultStates.Saturation)
 		}
 		if metrics.hasEnergyMonitoring && status.energyMeterInfo != nil {
 			types.SetFromInt(metrics.powerMilliWatts, status.PowerMilliWatts)
 			types.SetFromInt(metrics.monthEnergyWattHours, status.MonthEnergyWattHours)
 			types.SetFromInt(metrics.todayEnergyWattHours, status.TodayEnergyWattHours)
 		}
-		if err := metrics.updateInfoMetric(status); err != nil {
+		if metrics.outlets != nil && status.powerStripInfo != nil {
+			metrics.outlets.update(status.Outlets)
+		}
+		if metrics.sensors != nil && status.hubInfo != nil {
+			metrics.sensors.update(status.Sensors)
+		}
+		if err := metrics.updateInfoMetrics(status); err != nil {
 			return fmt.Errorf("could not update info metric: %w", err)
 		}
 	}
@@ -102,7 +174,7 @@ func (metrics *prometheusMetrics) updateMetrics(status *deviceStatus) error {
 }
 
 func (metrics *prometheusMetrics) resetToRogueValues() {
-	_ = metrics.updateInfoMetric(nil)
+	_ = metrics.updateInfoMetrics(nil)
 	types.SetIfPresent(metrics.overheated, -1.0)
 	types.SetIfPresent(metrics.overCurrent, -1.0)
 	types.SetIfPresent(metrics.powerProtected, -1.0)
@@ -112,41 +184,245 @@ func (metrics *prometheusMetrics) resetToRogueValues() {
 	types.SetIfPresent(metrics.deviceTurnedOn, -1.0)
 	types.SetIfPresent(metrics.onTime, -1.0)
 	types.SetIfPresent(metrics.brightness, -1.0)
+	types.SetIfPresent(metrics.dynamicEffectOn, -1.0)
+	types.SetIfPresent(metrics.defaultBrightness, -1.0)
 	types.SetIfPresent(metrics.colourTemperature, -1.0)
 	types.SetIfPresent(metrics.hue, -1.0)
 	types.SetIfPresent(metrics.saturation, -1.0)
+	types.SetIfPresent(metrics.defaultColourTemperature, -1.0)
+	types.SetIfPresent(metrics.defaultHue, -1.0)
+	types.SetIfPresent(metrics.defaultSaturation, -1.0)
 	types.SetIfPresent(metrics.powerMilliWatts, -1.0)
 	types.SetIfPresent(metrics.monthEnergyWattHours, -1.0)
 	types.SetIfPresent(metrics.todayEnergyWattHours, -1.0)
+	if metrics.outlets != nil {
+		metrics.outlets.resetToRogueValues()
+	}
+	if metrics.sensors != nil {
+		metrics.sensors.drop()
+	}
 }
 
-func registerInfoMetricUpdater(registry prometheus.Registerer, commonLabels prometheus.Labels) func(status *deviceStatus) error {
-	var infoMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name:        "device_info",
-		Namespace:   "tapo",
-		ConstLabels: commonLabels,
-	}, []string{
-		"alias", "device_id", "firmware_version", "hardware_id", "mac_address", "model_name", "oem_id", "device_type",
+func (metrics *prometheusMetrics) updateInfoMetrics(status *deviceStatus) error {
+	metrics.info.Reset()
+	metrics.bulbInfo.Reset()
+	if status == nil {
+		return nil
+	}
+	metricWithLabelValues, err := metrics.info.GetMetricWith(prometheus.Labels{
+		"alias":            status.Alias,
+		"device_id":        status.DeviceId,
+		"firmware_version": status.FirmwareVersion,
+		"hardware_id":      status.HardwareId,
+		"mac_address":      status.Mac,
+		"model_name":       status.ModelName,
+		"oem_id":           status.OemId,
+		"device_type":      status.DeviceType,
 	})
-	registry.MustRegister(infoMetric)
-	return func(status *deviceStatus) error {
-		infoMetric.Reset()
-		if status != nil {
-			metricWithLabelValues, err := infoMetric.GetMetricWith(prometheus.Labels{
-				"alias":            status.Alias,
-				"device_id":        status.DeviceId,
-				"firmware_version": status.FirmwareVersion,
-				"hardware_id":      status.HardwareId,
-				"mac_address":      status.Mac,
-				"model_name":       status.ModelName,
-				"oem_id":           status.OemId,
-				"device_type":      status.DeviceType,
-			})
-			if err != nil {
-				return fmt.Errorf("could not generate label values for info metric: %w", err)
+	if err != nil {
+		return fmt.Errorf("could not generate label values for info metric: %w", err)
+	}
+	metricWithLabelValues.Set(1.0)
+	if metrics.isLight && status.smartBulbInfo != nil {
+		bulbMetricWithLabelValues, err := metrics.bulbInfo.GetMetricWith(prometheus.Labels{
+			"is_colour":        strconv.FormatBool(status.IsColour),
+			"is_variable_temp": strconv.FormatBool(status.IsVariableColourTemperature),
+			"min_colour_temp":  strconv.Itoa(status.MinColourTemperature),
+			"max_colour_temp":  strconv.Itoa(status.MaxColourTemperature),
+			"default_state":    status.DefaultStates.Type,
+		})
+		if err != nil {
+			return fmt.Errorf("could not generate label values for bulb metric: %w", err)
+		}
+		bulbMetricWithLabelValues.Set(1.0)
+	}
+	return nil
+}
+
+// outletMetrics holds a series per socket of a power strip, each named by its nickname from the Tapo app, since every
+// socket is a device in its own right there
+type outletMetrics struct {
+	config      *types.DeviceConfig
+	constLabels prometheus.Labels
+
+	turnedOn             *prometheus.GaugeVec
+	onTime               *prometheus.GaugeVec
+	powerMilliWatts      *prometheus.GaugeVec // only for sockets with their own energy meter, e.g. the P304M's
+	todayEnergyWattHours *prometheus.GaugeVec // only for sockets with their own energy meter, e.g. the P304M's
+	monthEnergyWattHours *prometheus.GaugeVec // only for sockets with their own energy meter, e.g. the P304M's
+
+	// lastLabels are the sockets seen in the last successful poll, which are kept while the strip cannot be reached
+	lastLabels []prometheus.Labels
+}
+
+var outletLabelNames = []string{"dev_name", "dev_full_name", "child_id", "outlet_alias"}
+
+func registerOutletMetrics(registry prometheus.Registerer, config *types.DeviceConfig) *outletMetrics {
+	constLabels := types.GenerateCommonLabels(config)
+	delete(constLabels, "dev_name")
+	delete(constLabels, "dev_full_name")
+	return &outletMetrics{
+		config:      config,
+		constLabels: constLabels,
+		turnedOn:    types.NewGaugeVec(registry, constLabels, "tapo", "outlet_turned_on_bool", outletLabelNames),
+		onTime:      types.NewGaugeVec(registry, constLabels, "tapo", "outlet_switched_on_time_seconds", outletLabelNames),
+	}
+}
+
+// registerEnergyMetrics is called once any socket is found to have its own energy meter
+func (metrics *outletMetrics) registerEnergyMetrics(registry prometheus.Registerer) {
+	if metrics.powerMilliWatts != nil {
+		return
+	}
+	metrics.powerMilliWatts = types.NewGaugeVec(registry, metrics.constLabels, "tapo", "outlet_em_power_mw", outletLabelNames)
+	metrics.todayEnergyWattHours = types.NewGaugeVec(registry, metrics.constLabels, "tapo", "outlet_em_today_energy_wh", outletLabelNames)
+	metrics.monthEnergyWattHours = types.NewGaugeVec(registry, metrics.constLabels, "tapo", "outlet_em_month_energy_wh", outletLabelNames)
+}
+
+// labelsFor names the socket by its nickname, or by the strip's name and the socket's position when it has none
+func (metrics *outletMetrics) labelsFor(outlet *outletInfo) prometheus.Labels {
+	name := outlet.Nickname
+	if name == "" {
+		name = metrics.config.Name + " " + strconv.Itoa(outlet.Position)
+	}
+	return prometheus.Labels{
+		"dev_name":      name,
+		"dev_full_name": strings.TrimSpace(metrics.config.Room + " " + name),
+		"child_id":      outlet.Id,
+		"outlet_alias":  outlet.Nickname,
+	}
+}
+
+func (metrics *outletMetrics) allVecs() []*prometheus.GaugeVec {
+	return []*prometheus.GaugeVec{metrics.turnedOn, metrics.onTime,
+		metrics.powerMilliWatts, metrics.todayEnergyWattHours, metrics.monthEnergyWattHours}
+}
+
+// update replaces every socket's series, as sockets may have been renamed since the last poll
+func (metrics *outletMetrics) update(outlets []outletInfo) {
+	for _, vec := range metrics.allVecs() {
+		if vec != nil {
+			vec.Reset()
+		}
+	}
+	metrics.lastLabels = make([]prometheus.Labels, 0, len(outlets))
+	for i := range outlets {
+		outlet := &outlets[i]
+		labels := metrics.labelsFor(outlet)
+		metrics.lastLabels = append(metrics.lastLabels, labels)
+		metrics.turnedOn.With(labels).Set(boolToFloat(outlet.RelayOn))
+		metrics.onTime.With(labels).Set(outlet.OnTime.Seconds())
+		if metrics.powerMilliWatts != nil && outlet.energyMeterInfo != nil {
+			metrics.powerMilliWatts.With(labels).Set(float64(outlet.PowerMilliWatts))
+			metrics.todayEnergyWattHours.With(labels).Set(float64(outlet.TodayEnergyWattHours))
+			metrics.monthEnergyWattHours.With(labels).Set(float64(outlet.MonthEnergyWattHours))
+		}
+	}
+}
+
+func (metrics *outletMetrics) resetToRogueValues() {
+	for _, labels := range metrics.lastLabels {
+		for _, vec := range metrics.allVecs() {
+			if vec != nil {
+				vec.With(labels).Set(-1.0)
 			}
-			metricWithLabelValues.Set(1.0)
 		}
-		return nil
 	}
 }
+
+// sensorMetrics holds a series per sensor of a hub, named by its nickname from the Tapo app.  Each sensor only has the
+// readings that its model takes.  There are no rogue values for sensors: -1 is a real temperature, so the series of a
+// sensor that is offline, or of every sensor when the hub cannot be reached, are dropped instead.
+type sensorMetrics struct {
+	config *types.DeviceConfig
+
+	batteryLow        *prometheus.GaugeVec
+	rssi              *prometheus.GaugeVec
+	lastSeenOnline    *prometheus.GaugeVec
+	temperature       *prometheus.GaugeVec // T310, T315, KE100
+	humidity          *prometheus.GaugeVec // T310, T315
+	motionDetected    *prometheus.GaugeVec // T100
+	open              *prometheus.GaugeVec // T110
+	targetTemperature *prometheus.GaugeVec // KE100
+}
+
+var sensorLabelNames = []string{"dev_name", "dev_full_name", "child_id", "sensor_model"}
+
+func registerSensorMetrics(registry prometheus.Registerer, config *types.DeviceConfig) *sensorMetrics {
+	constLabels := types.GenerateCommonLabels(config)
+	delete(constLabels, "dev_name")
+	delete(constLabels, "dev_full_name")
+	return &sensorMetrics{
+		config:            config,
+		batteryLow:        types.NewGaugeVec(registry, constLabels, "tapo", "sensor_battery_low_bool", sensorLabelNames),
+		rssi:              types.NewGaugeVec(registry, constLabels, "tapo", "sensor_rssi_db", sensorLabelNames),
+		lastSeenOnline:    types.NewGaugeVec(registry, constLabels, "tapo", "sensor_last_seen_online_by_exporter_timestamp_seconds", sensorLabelNames),
+		temperature:       types.NewGaugeVec(registry, constLabels, "tapo", "sensor_temperature_celsius", sensorLabelNames),
+		humidity:          types.NewGaugeVec(registry, constLabels, "tapo", "sensor_humidity_percent", sensorLabelNames),
+		motionDetected:    types.NewGaugeVec(registry, constLabels, "tapo", "sensor_motion_detected_bool", sensorLabelNames),
+		open:              types.NewGaugeVec(registry, constLabels, "tapo", "sensor_contact_open_bool", sensorLabelNames),
+		targetTemperature: types.NewGaugeVec(registry, constLabels, "tapo", "sensor_target_temperature_celsius", sensorLabelNames),
+	}
+}
+
+func (metrics *sensorMetrics) labelsFor(sensor *sensorInfo) prometheus.Labels {
+	name := sensor.Nickname
+	if name == "" {
+		name = metrics.config.Name + " " + sensor.Model
+	}
+	return prometheus.Labels{
+		"dev_name":      name,
+		"dev_full_name": strings.TrimSpace(metrics.config.Room + " " + name),
+		"child_id":      sensor.Id,
+		"sensor_model":  sensor.Model,
+	}
+}
+
+// update replaces every sensor's series, as sensors may have been renamed, paired or removed since the last poll.  A
+// sensor that is offline keeps only the time this exporter last saw it online, as the hub goes on reporting its last
+// readings.
+func (metrics *sensorMetrics) update(sensors []sensorInfo) {
+	metrics.drop()
+	for i := range sensors {
+		sensor := &sensors[i]
+		labels := metrics.labelsFor(sensor)
+		if !sensor.LastSeenOnline.IsZero() {
+			metrics.lastSeenOnline.With(labels).Set(float64(sensor.LastSeenOnline.Unix()))
+		}
+		if !sensor.Online {
+			continue
+		}
+		metrics.batteryLow.With(labels).Set(boolToFloat(sensor.BatteryLow))
+		metrics.rssi.With(labels).Set(float64(sensor.Rssi))
+		if sensor.TemperatureCelsius != nil {
+			metrics.temperature.With(labels).Set(*sensor.TemperatureCelsius)
+		}
+		if sensor.HumidityPercent != nil {
+			metrics.humidity.With(labels).Set(float64(*sensor.HumidityPercent))
+		}
+		if sensor.MotionDetected != nil {
+			metrics.motionDetected.With(labels).Set(boolToFloat(*sensor.MotionDetected))
+		}
+		if sensor.Open != nil {
+			metrics.open.With(labels).Set(boolToFloat(*sensor.Open))
+		}
+		if sensor.TargetTemperatureCelsius != nil {
+			metrics.targetTemperature.With(labels).Set(*sensor.TargetTemperatureCelsius)
+		}
+	}
+}
+
+// drop removes every sensor's series
+func (metrics *sensorMetrics) drop() {
+	for _, vec := range []*prometheus.GaugeVec{metrics.batteryLow, metrics.rssi, metrics.lastSeenOnline, metrics.temperature,
+		metrics.humidity, metrics.motionDetected, metrics.open, metrics.targetTemperature} {
+		vec.Reset()
+	}
+}
+
+func boolToFloat(value bool) float64 {
+	if value {
+		return 1.0
+	}
+	return 0.0
+}
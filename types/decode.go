@@ -0,0 +1,76 @@
+package types
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// Field holds one field of a device's JSON response.  Unlike a plain struct field it never fails the decode, so a
+// firmware that leaves a field out or changes its type loses only that field rather than the whole response.
+type Field[T any] struct {
+	Value   T
+	Present bool
+	Err     error // set when the field is present but could not be decoded as a T
+}
+
+func (f *Field[T]) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+	f.Present = true
+	f.Err = json.Unmarshal(data, &f.Value)
+	return nil
+}
+
+// DecodeError names the field that could not be decoded by its path through the response, e.g.
+// system.get_sysinfo.relay_state
+type DecodeError struct {
+	Path string
+	Err  error
+}
+
+func (e DecodeError) Error() string {
+	return "field " + e.Path + ": " + e.Err.Error()
+}
+
+// DecodeErrors collects every field of a response that could not be decoded, so that the rest can still be used
+type DecodeErrors []DecodeError
+
+var errMissingField = errors.New("missing")
+
+func (d *DecodeErrors) Add(path string, err error) {
+	*d = append(*d, DecodeError{Path: path, Err: err})
+}
+
+func (d DecodeErrors) Error() string {
+	messages := make([]string, len(d))
+	for i, err := range d {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Required returns the field's value, noting an error when it is missing or has the wrong type
+func Required[T any](errs *DecodeErrors, path string, field Field[T]) T {
+	if !field.Present {
+		errs.Add(path, errMissingField)
+	} else if field.Err != nil {
+		errs.Add(path, field.Err)
+	}
+	return field.Value
+}
+
+// Optional returns the field's value, or the fallback when it is missing, noting an error only when it has the wrong
+// type
+func Optional[T any](errs *DecodeErrors, path string, field Field[T], fallback T) T {
+	if !field.Present {
+		return fallback
+	}
+	if field.Err != nil {
+		errs.Add(path, field.Err)
+		return fallback
+	}
+	return field.Value
+}
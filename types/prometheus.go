@@ -3,6 +3,8 @@ package types
 import (
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -27,6 +29,25 @@ func NewGauge(registry prometheus.Registerer, commonLabels prometheus.Labels, ns
 	return &gauge
 }
 
+func NewGaugeVec(registry prometheus.Registerer, constLabels prometheus.Labels, ns, name string, labelNames []string) *prometheus.GaugeVec {
+	var gaugeVec = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, ConstLabels: constLabels, Namespace: ns}, labelNames)
+	registry.MustRegister(gaugeVec)
+	return gaugeVec
+}
+
+// NewDecodeErrorCounter counts the fields of a device's responses that could not be decoded, labelled by their path
+func NewDecodeErrorCounter(registry prometheus.Registerer, commonLabels prometheus.Labels) *prometheus.CounterVec {
+	var counter = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "decode_errors_total", ConstLabels: commonLabels, Namespace: "common"}, []string{"field"})
+	registry.MustRegister(counter)
+	return counter
+}
+
+func CountDecodeErrors(counter *prometheus.CounterVec, errs DecodeErrors) {
+	for _, err := range errs {
+		counter.WithLabelValues(err.Path).Inc()
+	}
+}
+
 func SetIfPresent(gauge *prometheus.Gauge, value float64) {
 	if gauge != nil {
 		(*gauge).Set(value)
@@ -48,3 +69,125 @@ func SetFromInt(gauge *prometheus.Gauge, value int) {
 func SetFromDurationAsSeconds(gauge *prometheus.Gauge, value time.Duration) {
 	SetIfPresent(gauge, value.Seconds())
 }
+
+// SetFromTimeAsUnixSeconds sets the gauge to the time as a unix timestamp, or to 0 for the zero time
+func SetFromTimeAsUnixSeconds(gauge *prometheus.Gauge, value time.Time) {
+	if value.IsZero() {
+		SetIfPresent(gauge, 0.0)
+	} else {
+		SetIfPresent(gauge, float64(value.Unix()))
+	}
+}
+
+// TrackingRegisterer remembers every collector registered through it, so that everything belonging to one device can
+// be unregistered together when that device is removed or recreated.
+type TrackingRegisterer struct {
+	delegate   prometheus.Registerer
+	mutex      sync.Mutex
+	collectors []prometheus.Collector
+}
+
+func NewTrackingRegisterer(delegate prometheus.Registerer) *TrackingRegisterer {
+	return &TrackingRegisterer{delegate: delegate}
+}
+
+func (r *TrackingRegisterer) Register(collector prometheus.Collector) error {
+	if err := r.delegate.Register(collector); err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.collectors = append(r.collectors, collector)
+	return nil
+}
+
+func (r *TrackingRegisterer) MustRegister(collectors ...prometheus.Collector) {
+	for _, collector := range collectors {
+		if err := r.Register(collector); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func (r *TrackingRegisterer) Unregister(collector prometheus.Collector) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for i, candidate := range r.collectors {
+		if candidate == collector {
+			r.collectors = append(r.collectors[:i], r.collectors[i+1:]...)
+			break
+		}
+	}
+	return r.delegate.Unregister(collector)
+}
+
+func (r *TrackingRegisterer) UnregisterAll() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, collector := range r.collectors {
+		r.delegate.Unregister(collector)
+	}
+	r.collectors = nil
+}
+
+// GatedRegisterer wraps every collector registered through it, so that all of a device's series can be withdrawn from
+// scrapes while the device is failing, and brought back without registering anything again.  The gate starts closed.
+type GatedRegisterer struct {
+	delegate prometheus.Registerer
+	open     atomic.Bool
+	mutex    sync.Mutex
+	wrappers map[prometheus.Collector]prometheus.Collector
+}
+
+func NewGatedRegisterer(delegate prometheus.Registerer) *GatedRegisterer {
+	return &GatedRegisterer{delegate: delegate, wrappers: map[prometheus.Collector]prometheus.Collector{}}
+}
+
+func (r *GatedRegisterer) SetOpen(open bool) {
+	r.open.Store(open)
+}
+
+func (r *GatedRegisterer) Register(collector prometheus.Collector) error {
+	wrapper := &gatedCollector{delegate: collector, open: &r.open}
+	if err := r.delegate.Register(wrapper); err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.wrappers[collector] = wrapper
+	return nil
+}
+
+func (r *GatedRegisterer) MustRegister(collectors ...prometheus.Collector) {
+	for _, collector := range collectors {
+		if err := r.Register(collector); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func (r *GatedRegisterer) Unregister(collector prometheus.Collector) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	wrapper, found := r.wrappers[collector]
+	if !found {
+		return false
+	}
+	delete(r.wrappers, collector)
+	return r.delegate.Unregister(wrapper)
+}
+
+type gatedCollector struct {
+	delegate prometheus.Collector
+	open     *atomic.Bool
+}
+
+func (c *gatedCollector) Describe(descriptions chan<- *prometheus.Desc) {
+	c.delegate.Describe(descriptions)
+}
+
+func (c *gatedCollector) Collect(metrics chan<- prometheus.Metric) {
+	if c.open.Load() {
+		c.delegate.Collect(metrics)
+	}
+}
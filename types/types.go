@@ -1,5 +1,13 @@
 package types
 
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+)
+
 const (
 	KasaHS100 = iota
 	KasaHS110
@@ -11,10 +19,28 @@ const (
 	TapoP100
 	TapoP110
 	KasaKP115
+	KasaHS300
+	KasaKP303
+	KasaKP400
+	KasaKP200
+	KasaHS220
+	KasaKS230
+	KasaKL400
+	KasaKL430
+	TapoL510
+	TapoL530
+	TapoL535
+	TapoL630
+	TapoP300
+	TapoP304M
+	TapoH100
 )
 
 type DeviceType int
 
+// UnknownModel is used when the manifest names only a driver, until the model has been detected from the device itself
+const UnknownModel DeviceType = -1
+
 const (
 	Unknown = iota
 	Kasa
@@ -23,9 +49,21 @@ const (
 
 type DeviceDriver int
 
-var kasaDeviceTypes = []DeviceType{KasaHS100, KasaHS110, KasaKL110B, KasaKL130B, KasaKL50B, KasaKP115}
-var tapoDeviceTypes = []DeviceType{TapoL900, TapoP100, TapoP110}
-var deviceTypeIsLight = []DeviceType{KasaKL50B, KasaKL110B, KasaKL130B, TapoL900}
+const (
+	RogueValues = iota
+	StaleSeries
+)
+
+// FailureMode decides what a device's metrics show after a failed poll: RogueValues sets every gauge to a sentinel such
+// as -1, while StaleSeries stops exposing the device's series until it next polls successfully.
+type FailureMode int
+
+var kasaDeviceTypes = []DeviceType{KasaHS100, KasaHS110, KasaKL110B, KasaKL130B, KasaKL50B, KasaKP115, KasaHS300, KasaKP303, KasaKP400, KasaKP200,
+	KasaHS220, KasaKS230, KasaKL400, KasaKL430}
+var tapoDeviceTypes = []DeviceType{TapoL900, TapoP100, TapoP110, TapoL510, TapoL530, TapoL535, TapoL630, TapoP300, TapoP304M, TapoH100}
+var deviceTypeIsLight = []DeviceType{KasaKL50B, KasaKL110B, KasaKL130B, KasaKL400, KasaKL430, TapoL900, TapoL510, TapoL530,
+	TapoL535, TapoL630}
+var deviceTypeHasOutlets = []DeviceType{KasaHS300, KasaKP303, KasaKP400, KasaKP200, TapoP300, TapoP304M}
 
 var deviceModelStringToDeviceType = map[string]DeviceType{
 	"HS100":  KasaHS100,
@@ -37,20 +75,117 @@ var deviceModelStringToDeviceType = map[string]DeviceType{
 	"P100":   TapoP100,
 	"P110":   TapoP110,
 	"KP115":  KasaKP115,
+	"HS300":  KasaHS300,
+	"KP303":  KasaKP303,
+	"KP400":  KasaKP400,
+	"KP200":  KasaKP200,
+	"HS220":  KasaHS220,
+	"KS230":  KasaKS230,
+	"KL400":  KasaKL400,
+	"KL430":  KasaKL430,
+	"L510":   TapoL510,
+	"L530":   TapoL530,
+	"L535":   TapoL535,
+	"L630":   TapoL630,
+	"P300":   TapoP300,
+	"P304M":  TapoP304M,
+	"H100":   TapoH100,
+}
+
+// Tapo bulbs are sold as e.g. the L530B and L530E, for bayonet and Edison screw fittings, but report themselves without
+// the fitting; either name can be used in the manifest
+var deviceModelVariants = map[string]DeviceType{
+	"L510B": TapoL510,
+	"L510E": TapoL510,
+	"L530B": TapoL530,
+	"L530E": TapoL530,
+	"L535B": TapoL535,
+	"L535E": TapoL535,
 }
 
 func DeviceTypeFor(modelName string) DeviceType {
-	if deviceType, found := deviceModelStringToDeviceType[modelName]; found {
+	if deviceType, found := LookupDeviceType(modelName); found {
 		return deviceType
 	}
 	panic("model name " + modelName + " does not correspond to a known device type")
 }
 
+func LookupDeviceType(modelName string) (DeviceType, bool) {
+	if deviceType, found := deviceModelStringToDeviceType[modelName]; found {
+		return deviceType, true
+	}
+	deviceType, found := deviceModelVariants[modelName]
+	return deviceType, found
+}
+
+// DeviceTypeForReportedModel maps the model name a device reports about itself, e.g. "KL50B(UN)" or "P110", to a
+// known device type, ignoring any regional suffix.
+func DeviceTypeForReportedModel(reportedModel string) (DeviceType, bool) {
+	modelName, _, _ := strings.Cut(reportedModel, "(")
+	return LookupDeviceType(strings.TrimSpace(modelName))
+}
+
+func ModelNameFor(deviceType DeviceType) string {
+	for modelName, candidate := range deviceModelStringToDeviceType {
+		if candidate == deviceType {
+			return modelName
+		}
+	}
+	return "unknown"
+}
+
+// WarnIfReportedModelDiffers logs when the model a device reports about itself does not match the configured model,
+// which usually means the manifest is out of date.  Returns true if the check could be made.
+func WarnIfReportedModelDiffers(config *DeviceConfig, reportedModel string) bool {
+	if reportedModel == "" {
+		return false
+	}
+	if reportedType, found := DeviceTypeForReportedModel(reportedModel); !found || reportedType != config.Model {
+		log.Printf("warning: %s %s (%s) is configured as model %s but reports itself as %s",
+			config.Room, config.Name, config.Ip, ModelNameFor(config.Model), reportedModel)
+	}
+	return true
+}
+
 type DeviceConfig struct {
-	Name  string
-	Room  string
-	Model DeviceType
-	Ip    string
+	Name         string
+	Room         string
+	Model        DeviceType
+	Driver       DeviceDriver
+	Ip           string
+	PollInterval time.Duration
+	PollJitter   time.Duration
+	Credentials  string // name of the Tapo account to log in with, or empty for the default account
+	FailureMode  FailureMode
+	// UseOutletAliases names each outlet of a power strip by the alias set in the Kasa app, rather than by the
+	// device's name from the manifest
+	UseOutletAliases bool
+	// KeepConnectionOpen keeps a Kasa device's TCP connection open between polls rather than dialling for each one
+	KeepConnectionOpen bool
+}
+
+func DriverForName(driverName string) (DeviceDriver, error) {
+	switch strings.ToLower(driverName) {
+	case "kasa":
+		return Kasa, nil
+	case "tapo":
+		return Tapo, nil
+	case "":
+		return Unknown, nil
+	default:
+		return Unknown, errors.New("driver name " + driverName + " does not correspond to a known driver")
+	}
+}
+
+func FailureModeForName(failureModeName string) (FailureMode, error) {
+	switch strings.ToLower(failureModeName) {
+	case "rogue", "":
+		return RogueValues, nil
+	case "stale":
+		return StaleSeries, nil
+	default:
+		return RogueValues, errors.New("failure mode " + failureModeName + " is not one of rogue or stale")
+	}
 }
 
 func DriverFor(deviceType DeviceType) DeviceDriver {
@@ -63,6 +198,12 @@ func DriverFor(deviceType DeviceType) DeviceDriver {
 	return Unknown
 }
 
+// HasOutlets is true for power strips, whose relays are switched and reported per outlet rather than for the whole
+// device
+func HasOutlets(model DeviceType) bool {
+	return contains(deviceTypeHasOutlets, model)
+}
+
 func contains[E comparable](haystack []E, needle E) bool {
 	for _, v := range haystack {
 		if v == needle {
@@ -73,8 +214,114 @@ func contains[E comparable](haystack []E, needle E) bool {
 }
 
 type PollableDevice interface {
-	PollDeviceAndUpdateMetrics() error
+	PollDeviceAndUpdateMetrics(ctx context.Context) error
 	ResetMetricsToRogueValues()
 	ResetDeviceConnection()
 	CommonMetricLabels() map[string]string
+	// Model is the model the device was created with, which for a device given only a driver is the one detected
+	Model() DeviceType
+	// Protocol names the protocol used to talk to the device, or is empty if it has not yet been negotiated
+	Protocol() string
+	// LastStatus is what the most recent successful poll decoded from the device, or nil before the first one; it is
+	// safe to call while the device is being polled
+	LastStatus() any
+}
+
+// ErrNotSupported is returned by control methods when the device's model cannot do what was asked
+var ErrNotSupported = errors.New("not supported by this device")
+
+// ErrInvalidValue is returned by control methods when a value is outside the range the device accepts
+var ErrInvalidValue = errors.New("value out of range")
+
+// RelayController is implemented by devices whose relay (i.e. whether the socket is powered) can be switched
+type RelayController interface {
+	SetRelay(ctx context.Context, on bool) error
+}
+
+// LedController is implemented by devices with a status LED that can be turned off
+type LedController interface {
+	SetLed(ctx context.Context, on bool) error
+}
+
+// LightController is implemented by bulbs; fields left nil in the LightState are not changed
+type LightController interface {
+	SetLightState(ctx context.Context, state LightState) error
+}
+
+type LightState struct {
+	On                *bool
+	Brightness        *int // percent
+	Hue               *int // degrees
+	Saturation        *int // percent
+	ColourTemperature *int // kelvin
+	TransitionPeriod  time.Duration
+}
+
+// EnergyHistoryProvider is implemented by devices that keep their own record of energy used per day and per month, and
+// sometimes per hour, which can be read back to fill gaps left while the exporter was not running
+type EnergyHistoryProvider interface {
+	EnergyHistory(ctx context.Context, year int) (*EnergyHistory, error)
+}
+
+// EnergyHistory is given in the device's local time.  Devices only keep hours for the last few days, and those that do
+// not keep hours at all leave Hourly empty.
+type EnergyHistory struct {
+	Hourly  []HourlyEnergy  `json:"hourly,omitempty"`
+	Daily   []DailyEnergy   `json:"daily"`
+	Monthly []MonthlyEnergy `json:"monthly"`
+}
+
+type HourlyEnergy struct {
+	Year            int `json:"year"`
+	Month           int `json:"month"`
+	Day             int `json:"day"`
+	Hour            int `json:"hour"`
+	EnergyWattHours int `json:"energy_wh"`
+}
+
+type DailyEnergy struct {
+	Year            int `json:"year"`
+	Month           int `json:"month"`
+	Day             int `json:"day"`
+	EnergyWattHours int `json:"energy_wh"`
+}
+
+type MonthlyEnergy struct {
+	Year            int `json:"year"`
+	Month           int `json:"month"`
+	EnergyWattHours int `json:"energy_wh"`
+}
+
+// RulesProvider is implemented by devices that run automations set up in the vendor's app, which can be listed so
+// that they can be audited
+type RulesProvider interface {
+	Rules(ctx context.Context) (*DeviceRules, error)
+}
+
+// DeviceRules holds each kind of rule; a kind the device does not have is left empty
+type DeviceRules struct {
+	Schedules  []Rule `json:"schedules"`
+	Countdowns []Rule `json:"countdowns"`
+	AwayMode   []Rule `json:"away_mode"` // periods in which the device switches at random to look occupied
+}
+
+type Rule struct {
+	Id      string     `json:"id"`
+	Name    string     `json:"name"`
+	Enabled bool       `json:"enabled"`
+	Days    []string   `json:"days,omitempty"` // the weekdays a repeating rule runs on, e.g. "mon"
+	Date    string     `json:"date,omitempty"` // the day a rule that does not repeat runs on, e.g. "2024-02-03"
+	Start   *RuleEvent `json:"start,omitempty"`
+	End     *RuleEvent `json:"end,omitempty"`
+	// Only for countdowns
+	Action           string `json:"action,omitempty"` // "on" or "off", when the countdown ends
+	DelaySeconds     int    `json:"delay_seconds,omitempty"`
+	RemainingSeconds int    `json:"remaining_seconds,omitempty"`
+}
+
+type RuleEvent struct {
+	Time          string `json:"time"`                     // in the device's local time, e.g. "07:30"
+	Relative      string `json:"relative,omitempty"`       // "sunrise" or "sunset" when the time follows the sun
+	OffsetMinutes int    `json:"offset_minutes,omitempty"` // from the sunrise or sunset
+	Action        string `json:"action,omitempty"`         // "on" or "off", or empty when nothing is switched
 }